@@ -0,0 +1,432 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertRule is a condition that raises an alert once it has held for For.
+type AlertRule struct {
+	// The unique name of the alert.
+	Name string
+
+	// Returns if the condition holds and a message describing it.
+	Check func(l *Logic, now time.Time) (bool, string)
+
+	// How long the condition must hold before the alert is raised.
+	For time.Duration
+
+	// How long the condition must hold while nobody is home.  0 means For.
+	AwayFor time.Duration
+}
+
+type AlertOpts struct {
+	Rules     []AlertRule
+	Notifiers []Notifier
+
+	// How often the rules are checked.  The default is 10 seconds.
+	Period time.Duration
+}
+
+// Alert is a raised alert.  Resolved is set once the condition clears.
+type Alert struct {
+	Name     string    `json:"name"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+	Raised   time.Time `json:"raised"`
+	Resolved time.Time `json:"resolved,omitempty"`
+}
+
+// Notifier tells someone about alerts being raised and resolved.
+type Notifier interface {
+	Notify(Alert) error
+}
+
+// alertEngine tracks the rules and the alerts they raise.
+type alertEngine struct {
+	opts AlertOpts
+
+	// When each rule's condition started holding.
+	pending map[string]time.Time
+
+	active map[string]*Alert
+	mutex  sync.Mutex
+}
+
+func newAlertEngine(opts AlertOpts) *alertEngine {
+	return &alertEngine{
+		opts:    opts,
+		pending: make(map[string]time.Time),
+		active:  make(map[string]*Alert),
+	}
+}
+
+// check evaluates the rules and notifies about any alerts raised or
+// resolved.
+func (e *alertEngine) check(l *Logic, now time.Time) {
+	var changed []Alert
+
+	e.mutex.Lock()
+	for _, rule := range e.opts.Rules {
+		holds, msg := rule.Check(l, now)
+		if false == holds {
+			delete(e.pending, rule.Name)
+			if a, ok := e.active[rule.Name]; ok {
+				a.Resolved = now
+				changed = append(changed, *a)
+				delete(e.active, rule.Name)
+			}
+			continue
+		}
+
+		since, ok := e.pending[rule.Name]
+		if false == ok {
+			since = now
+			e.pending[rule.Name] = now
+		}
+		if a, ok := e.active[rule.Name]; ok {
+			a.Message = msg
+			continue
+		}
+		limit := rule.For
+		if 0 != rule.AwayFor && l.away(now) {
+			limit = rule.AwayFor
+		}
+		if now.Sub(since) >= limit {
+			a := &Alert{Name: rule.Name, Message: msg, Since: since, Raised: now}
+			e.active[rule.Name] = a
+			changed = append(changed, *a)
+		}
+	}
+	e.mutex.Unlock()
+
+	for _, a := range changed {
+		if a.Resolved.IsZero() {
+			fmt.Printf("Alert: %s: %s\n", a.Name, a.Message)
+		} else {
+			fmt.Printf("Alert resolved: %s\n", a.Name)
+		}
+		for _, n := range e.opts.Notifiers {
+			if err := n.Notify(a); nil != err {
+				fmt.Printf("Alert: notifying about %s: %v\n", a.Name, err)
+			}
+		}
+	}
+}
+
+// Active returns the raised alerts by name.
+func (e *alertEngine) Active() []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	list := []Alert{}
+	for _, a := range e.active {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Alerts returns the alerts presently raised.
+func (l *Logic) Alerts() []Alert {
+	return l.alerts.Active()
+}
+
+func (l *Logic) alerting() {
+	defer l.wg.Done()
+
+	period := l.opts.Alerts.Period
+	if 0 == period {
+		period = time.Second * 10
+	}
+
+	t := l.clock.NewTicker(period)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			l.alerts.check(l, now)
+		}
+	}
+}
+
+// SensorStaleAlert is raised when the sensor has had no reading for d, or
+// has never read.
+func SensorStaleAlert(sensor string, d time.Duration) AlertRule {
+	return AlertRule{
+		Name: "sensor_stale_" + sensor,
+		Check: func(l *Logic, now time.Time) (bool, string) {
+			_, ok := freshReading(l.tempSensors, sensor, now, d)
+			return false == ok, fmt.Sprintf("no reading from %s for %s", sensor, d)
+		},
+	}
+}
+
+// BoardDisconnectedAlert is raised when the Arduino board has not reported
+// for d.  The board reports every second.
+func BoardDisconnectedAlert(d time.Duration) AlertRule {
+	return AlertRule{
+		Name: "board_disconnected",
+		For:  d,
+		Check: func(l *Logic, now time.Time) (bool, string) {
+			l.boardMutex.Lock()
+			last := l.lastUpdate
+			l.boardMutex.Unlock()
+
+			if last.IsZero() {
+				return true, "no report from the Arduino board yet"
+			}
+			return now.Sub(last) > time.Second*5, fmt.Sprintf("no report from the Arduino board since %s", last.Format(time.Kitchen))
+		},
+	}
+}
+
+// RelayMismatchAlert is raised when the relays the board reports have not
+// matched what was asked for over d.
+func RelayMismatchAlert(d time.Duration) AlertRule {
+	return AlertRule{
+		Name: "relay_mismatch",
+		For:  d,
+		Check: func(l *Logic, now time.Time) (bool, string) {
+			l.boardMutex.Lock()
+			reported, ok := l.reportedRelays, false == l.lastUpdate.IsZero()
+			l.boardMutex.Unlock()
+
+			l.relayMutex.Lock()
+			wanted := l.controlBitMask
+			l.relayMutex.Unlock()
+
+			return ok && reported != wanted, fmt.Sprintf("the board reports relays %02X, wanted %02X", reported, wanted)
+		},
+	}
+}
+
+// LeakAlert is raised when cold water has been running without a break of
+// at least 5 minutes for d, like a leak or a running toilet.  While nobody is
+// home it is raised after strict instead.
+func LeakAlert(d, strict time.Duration) AlertRule {
+	var total float64
+	var changed time.Time
+
+	return AlertRule{
+		Name:    "leak",
+		For:     d,
+		AwayFor: strict,
+		Check: func(l *Logic, now time.Time) (bool, string) {
+			l.flowMutex.Lock()
+			cold := l.flowTotals["cold"]
+			l.flowMutex.Unlock()
+
+			if cold != total {
+				total = cold
+				changed = now
+			}
+			return now.Sub(changed) < time.Minute*5, "cold water has been running continuously"
+		},
+	}
+}
+
+// ZoneBelowTargetAlert is raised when the downstairs sensor has been more
+// than margin (F) below its target for d.
+func ZoneBelowTargetAlert(sensor string, margin float64, d time.Duration) AlertRule {
+	return AlertRule{
+		Name: "zone_below_target_" + sensor,
+		For:  d,
+		Check: func(l *Logic, now time.Time) (bool, string) {
+			temp, ok := reading(l.tempSensors, sensor)
+			if false == ok {
+				return false, ""
+			}
+
+			l.downstairsMutex.Lock()
+			target := l.downstairsTemp
+			l.downstairsMutex.Unlock()
+			target = l.modeTarget(now, target)
+
+			return temp < target-margin, fmt.Sprintf("%s is %.1fF, target %.1fF", sensor, temp, target)
+		},
+	}
+}
+
+// WebhookNotifier posts the alert as JSON to a URL.
+type WebhookNotifier struct {
+	URL string
+
+	// The default is a client with a 10 second timeout.
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(a Alert) error {
+	client := n.Client
+	if nil == client {
+		client = &http.Client{Timeout: time.Second * 10}
+	}
+
+	buf, err := json.Marshal(a)
+	if nil != err {
+		return err
+	}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(buf))
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier emails the alert.
+type SMTPNotifier struct {
+	// The mail server as host:port.
+	Addr string
+
+	From string
+	To   []string
+
+	// Optional authentication, for example smtp.PlainAuth().
+	Auth smtp.Auth
+
+	// How long sending may take before giving up on the server.  The
+	// default is 30 seconds.
+	Timeout time.Duration
+}
+
+func (n *SMTPNotifier) Notify(a Alert) error {
+	subject := "Alert: " + a.Name
+	if false == a.Resolved.IsZero() {
+		subject = "Resolved: " + a.Name
+	}
+
+	msg := "From: " + n.From + "\r\n" +
+		"To: " + strings.Join(n.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" +
+		a.Message + "\r\n" +
+		"Since: " + a.Since.Format(time.RFC1123) + "\r\n"
+
+	timeout := n.Timeout
+	if 0 == timeout {
+		timeout = time.Second * 30
+	}
+	return n.send(timeout, []byte(msg))
+}
+
+// send is smtp.SendMail with a deadline so a stuck server can't hold up the
+// alerts.
+func (n *SMTPNotifier) send(timeout time.Duration, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", n.Addr, timeout)
+	if nil != err {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); nil != err {
+		conn.Close()
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(n.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if nil != err {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); nil != err {
+			return err
+		}
+	}
+	if nil != n.Auth {
+		if err = c.Auth(n.Auth); nil != err {
+			return err
+		}
+	}
+	if err = c.Mail(n.From); nil != err {
+		return err
+	}
+	for _, to := range n.To {
+		if err = c.Rcpt(to); nil != err {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if nil != err {
+		return err
+	}
+	if _, err = w.Write(msg); nil != err {
+		return err
+	}
+	if err = w.Close(); nil != err {
+		return err
+	}
+	return c.Quit()
+}
+
+// CommandNotifier runs a local command with the alert in the environment
+// as ALERT_NAME, ALERT_MESSAGE, ALERT_SINCE and ALERT_STATE (raised or
+// resolved).
+type CommandNotifier struct {
+	Command string
+	Args    []string
+
+	// How long the command may run before it is killed.  The default is
+	// 30 seconds.
+	Timeout time.Duration
+}
+
+func (n *CommandNotifier) Notify(a Alert) error {
+	state := "raised"
+	if false == a.Resolved.IsZero() {
+		state = "resolved"
+	}
+
+	timeout := n.Timeout
+	if 0 == timeout {
+		timeout = time.Second * 30
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.Command, n.Args...)
+	cmd.Env = append(os.Environ(),
+		"ALERT_NAME="+a.Name,
+		"ALERT_MESSAGE="+a.Message,
+		"ALERT_SINCE="+a.Since.Format(time.RFC3339),
+		"ALERT_STATE="+state,
+	)
+	out, err := cmd.CombinedOutput()
+	if nil != err {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingNotifier struct {
+	alerts []Alert
+}
+
+func (n *recordingNotifier) Notify(a Alert) error {
+	n.alerts = append(n.alerts, a)
+	return nil
+}
+
+func TestAlertEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	holds := false
+	n := &recordingNotifier{}
+	e := newAlertEngine(AlertOpts{
+		Rules: []AlertRule{
+			{
+				Name: "test",
+				For:  time.Minute,
+				Check: func(l *Logic, now time.Time) (bool, string) {
+					return holds, "it holds"
+				},
+			},
+		},
+		Notifiers: []Notifier{n},
+	})
+
+	e.check(nil, start)
+	assert.Equal(0, len(e.Active()))
+
+	// Not long enough.
+	holds = true
+	e.check(nil, start.Add(time.Second*10))
+	e.check(nil, start.Add(time.Second*60))
+	assert.Equal(0, len(e.Active()))
+
+	// Raised once.
+	e.check(nil, start.Add(time.Second*70))
+	e.check(nil, start.Add(time.Second*80))
+	assert.Equal(1, len(e.Active()))
+	assert.Equal(1, len(n.alerts))
+	assert.Equal("test", n.alerts[0].Name)
+	assert.Equal(start.Add(time.Second*10), n.alerts[0].Since)
+	assert.True(n.alerts[0].Resolved.IsZero())
+
+	// Resolved once.
+	holds = false
+	e.check(nil, start.Add(time.Second*90))
+	e.check(nil, start.Add(time.Second*100))
+	assert.Equal(0, len(e.Active()))
+	assert.Equal(2, len(n.alerts))
+	assert.Equal(start.Add(time.Second*90), n.alerts[1].Resolved)
+}
+
+func TestAlertRules(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	sensors.clock = clock
+	l := newTestLogic(clock, LogicOpts{}, sensors)
+	now := clock.Now()
+
+	holds, _ := SensorStaleAlert("main", time.Minute).Check(l, now)
+	assert.True(holds)
+	sensors.Set("main", 65)
+	holds, _ = SensorStaleAlert("main", time.Minute).Check(l, now)
+	assert.False(holds)
+
+	// A sensor that stops reading keeps its last temperature, but goes
+	// stale.
+	holds, _ = SensorStaleAlert("main", time.Minute).Check(l, now.Add(time.Minute))
+	assert.False(holds)
+	holds, _ = SensorStaleAlert("main", time.Minute).Check(l, now.Add(time.Minute+time.Second))
+	assert.True(holds)
+
+	holds, _ = BoardDisconnectedAlert(time.Minute).Check(l, now)
+	assert.True(holds)
+	l.lastUpdate = now
+	l.reportedRelays = 1
+	holds, _ = BoardDisconnectedAlert(time.Minute).Check(l, now.Add(time.Second))
+	assert.False(holds)
+
+	holds, _ = RelayMismatchAlert(time.Minute).Check(l, now)
+	assert.True(holds)
+	l.controlBitMask = 1
+	holds, _ = RelayMismatchAlert(time.Minute).Check(l, now)
+	assert.False(holds)
+
+	l.downstairsTemp = 70
+	holds, _ = ZoneBelowTargetAlert("main", 3, time.Minute).Check(l, now)
+	assert.True(holds)
+	sensors.Set("main", 68)
+	holds, _ = ZoneBelowTargetAlert("main", 3, time.Minute).Check(l, now)
+	assert.False(holds)
+
+	leak := LeakAlert(time.Hour, time.Minute*10)
+	holds, _ = leak.Check(l, now)
+	assert.False(holds)
+	l.flowTotals["cold"] = 0.1
+	holds, _ = leak.Check(l, now.Add(time.Minute))
+	assert.True(holds)
+	holds, _ = leak.Check(l, now.Add(time.Minute*7))
+	assert.False(holds)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	got := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/missing" == r.URL.Path {
+			w.WriteHeader(404)
+			return
+		}
+		var a Alert
+		json.NewDecoder(r.Body).Decode(&a)
+		got <- a
+	}))
+	defer server.Close()
+
+	n := &WebhookNotifier{URL: server.URL}
+	assert.Nil(n.Notify(Alert{Name: "leak", Message: "water"}))
+	a := <-got
+	assert.Equal("leak", a.Name)
+	assert.Equal("water", a.Message)
+
+	n = &WebhookNotifier{URL: server.URL + "/missing"}
+	assert.NotNil(n.Notify(Alert{Name: "leak"}))
+}
+
+// fakeSMTP accepts a single message and returns it.
+func fakeSMTP(t *testing.T) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if nil != err {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if nil != err {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				conn.Write([]byte("250 localhost\r\n"))
+			case strings.HasPrefix(cmd, "DATA"):
+				conn.Write([]byte("354 go ahead\r\n"))
+				var data string
+				for {
+					line, err := r.ReadString('\n')
+					if nil != err || ".\r\n" == line {
+						break
+					}
+					data += line
+				}
+				got <- data
+				conn.Write([]byte("250 OK\r\n"))
+			case strings.HasPrefix(cmd, "QUIT"):
+				conn.Write([]byte("221 bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+
+	return ln.Addr().String(), got
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, got := fakeSMTP(t)
+	n := &SMTPNotifier{
+		Addr: addr,
+		From: "heater@example.com",
+		To:   []string{"owner@example.com"},
+	}
+	assert.Nil(n.Notify(Alert{Name: "leak", Message: "cold water has been running", Resolved: time.Now()}))
+
+	msg := <-got
+	assert.Contains(msg, "Subject: Resolved: leak")
+	assert.Contains(msg, "cold water has been running")
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// A server that accepts but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if nil == err {
+			defer conn.Close()
+			time.Sleep(time.Second * 5)
+		}
+	}()
+
+	n := &SMTPNotifier{
+		Addr:    ln.Addr().String(),
+		From:    "heater@example.com",
+		To:      []string{"owner@example.com"},
+		Timeout: time.Millisecond * 100,
+	}
+	start := time.Now()
+	assert.NotNil(n.Notify(Alert{Name: "leak"}))
+	assert.True(time.Since(start) < time.Second)
+}
+
+func TestCommandNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "alert")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "out")
+
+	n := &CommandNotifier{
+		Command: "sh",
+		Args:    []string{"-c", "echo \"$ALERT_STATE $ALERT_NAME $ALERT_MESSAGE\" > " + file},
+	}
+	assert.Nil(n.Notify(Alert{Name: "leak", Message: "water"}))
+	buf, err := ioutil.ReadFile(file)
+	assert.Nil(err)
+	assert.Equal("raised leak water\n", string(buf))
+
+	n = &CommandNotifier{Command: "sh", Args: []string{"-c", "echo broken; exit 1"}}
+	assert.NotNil(n.Notify(Alert{Name: "leak"}))
+
+	// A command that hangs is killed.
+	n = &CommandNotifier{Command: "sleep", Args: []string{"10"}, Timeout: time.Millisecond * 100}
+	start := time.Now()
+	assert.NotNil(n.Notify(Alert{Name: "leak"}))
+	assert.True(time.Since(start) < time.Second*5)
+}
@@ -0,0 +1,330 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type AnomalyOpts struct {
+	// The zones ("downstairs", "upstairs") watched for recovering too
+	// slowly, mapped to the sensor that measures them.
+	Zones map[string]string
+
+	// A zone whose pump has run this long without the temperature rising
+	// MinRise (F) is flagged.  The defaults are 30 minutes and 0.5F.
+	NoRiseAfter time.Duration
+	MinRise     float64
+
+	// Once a zone's recovery rate is learned it is flagged sooner, when it
+	// has pumped SlowFactor times as long as the rate needs to rise
+	// MinRise.  The default is 3.
+	SlowFactor float64
+
+	// The heater loop is flagged if its pump has run this long without any
+	// flow, or if there is flow this long after the pump stopped.  The
+	// default is 2 minutes.
+	FlowTimeout time.Duration
+
+	// How much weight each new recovery rate gets in the average (0-1).
+	// The default is 0.2.
+	RateWeight float64
+}
+
+// Anomaly is something that is not behaving the way it should.
+type Anomaly struct {
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+// zoneRecovery follows how fast a zone warms for the time its pump runs.
+type zoneRecovery struct {
+	// The lowest temperature since the zone last warmed up.
+	baseline float64
+	started  bool
+
+	// How long the pump has run since the zone last warmed up or the
+	// heating run started.
+	pumped  time.Duration
+	running bool
+
+	// The average rise (F) per minute of pumping.
+	rate float64
+	seen bool
+
+	gauge prometheus.Gauge
+}
+
+type anomalyDetector struct {
+	opts  AnomalyOpts
+	zones map[string]*zoneRecovery
+
+	loopOn    bool
+	loopSince time.Time
+
+	anomalies map[string]*Anomaly
+}
+
+func newAnomalyDetector(opts AnomalyOpts) *anomalyDetector {
+	if 0 == opts.NoRiseAfter {
+		opts.NoRiseAfter = time.Minute * 30
+	}
+	if 0 == opts.MinRise {
+		opts.MinRise = 0.5
+	}
+	if 0 == opts.SlowFactor {
+		opts.SlowFactor = 3
+	}
+	if 0 == opts.FlowTimeout {
+		opts.FlowTimeout = time.Minute * 2
+	}
+	if 0 == opts.RateWeight {
+		opts.RateWeight = 0.2
+	}
+
+	d := &anomalyDetector{
+		opts:      opts,
+		zones:     make(map[string]*zoneRecovery),
+		anomalies: make(map[string]*Anomaly),
+	}
+	for zone := range opts.Zones {
+		d.zones[zone] = &zoneRecovery{
+			gauge: promauto.NewGauge(prometheus.GaugeOpts{
+				Namespace: "heaticus_maximus",
+				Subsystem: "physical",
+				Name:      zone + "_recovery_rate",
+				Help:      zone + " average temperature rise (F) per minute of pumping",
+			}),
+		}
+	}
+	return d
+}
+
+// outputName returns the name of the output for the OnOffThing.
+func (l *Logic) outputName(thing OnOffThing) string {
+	for name, o := range l.outputs {
+		if thing == o.thing {
+			return name
+		}
+	}
+	return ""
+}
+
+// heatingRun returns if the pump is running to warm its zone.  The pump
+// exercise, the purge and freeze protection only keep the water moving or
+// the pipes safe, so the zone isn't expected to warm for them.
+func heatingRun(pump OnOffThing) bool {
+	on, until := pump.State()
+	if false == on {
+		return false
+	}
+
+	claims := pump.Claims()
+	for _, c := range claims {
+		if wantsHeat(c.Name) && freezeClaim != c.Name {
+			return true
+		}
+	}
+
+	// Otherwise only a direct request, like the thermostat's, is heating
+	// and it must be what keeps the pump on.
+	for _, c := range claims {
+		if false == until.After(c.Until) {
+			return false
+		}
+	}
+	return true
+}
+
+// noRiseAfter returns how long the zone may pump without rising MinRise.
+// The caller must hold anomalyMutex.
+func (d *anomalyDetector) noRiseAfter(z *zoneRecovery) time.Duration {
+	limit := d.opts.NoRiseAfter
+	if z.seen && 0 < z.rate {
+		learned := time.Duration(d.opts.SlowFactor * d.opts.MinRise / z.rate * float64(time.Minute))
+		if learned < limit {
+			limit = learned
+		}
+	}
+	return limit
+}
+
+// flag raises or clears the named anomaly.  The caller must hold
+// anomalyMutex.
+func (l *Logic) flag(name string, raise bool, now time.Time, msg string) {
+	a, ok := l.anomaly.anomalies[name]
+	if raise && false == ok {
+		fmt.Printf("Anomaly: %s\n", msg)
+		l.anomaly.anomalies[name] = &Anomaly{Name: name, Message: msg, Since: now}
+		l.anomalyCounter.Inc()
+	} else if raise {
+		a.Message = msg
+	} else if ok {
+		fmt.Printf("Anomaly cleared: %s\n", name)
+		delete(l.anomaly.anomalies, name)
+	}
+}
+
+// anomalyStep checks the zones and the heater loop flow after dt has
+// passed.
+func (l *Logic) anomalyStep(now time.Time, dt time.Duration) {
+	l.anomalyMutex.Lock()
+	defer l.anomalyMutex.Unlock()
+
+	d := l.anomaly
+	opts := d.opts
+
+	zones := make([]string, 0, len(d.zones))
+	for zone := range d.zones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	for _, zone := range zones {
+		z := d.zones[zone]
+		temp, ok := reading(l.tempSensors, opts.Zones[zone])
+		pump := l.zonePump(zone)
+		if false == ok || nil == pump {
+			continue
+		}
+
+		l.relayMutex.Lock()
+		on := l.relayOn(l.outputName(pump))
+		l.relayMutex.Unlock()
+		on = on && heatingRun(pump)
+
+		// Each heating run is judged on its own, so a zone that holds at
+		// its target over many short runs isn't flagged.
+		if on && false == z.running {
+			z.baseline = temp
+			z.pumped = 0
+		}
+		z.running = on
+
+		if false == z.started || temp < z.baseline {
+			z.baseline = temp
+			z.started = true
+		}
+		if on {
+			z.pumped += dt
+		}
+
+		if temp >= z.baseline+opts.MinRise {
+			if 0 < z.pumped {
+				rate := (temp - z.baseline) / z.pumped.Minutes()
+				if z.seen {
+					rate = z.rate*(1-opts.RateWeight) + rate*opts.RateWeight
+				}
+				z.rate, z.seen = rate, true
+				z.gauge.Set(rate)
+			}
+			z.baseline = temp
+			z.pumped = 0
+		}
+
+		l.flag("no_rise_"+zone, z.pumped >= d.noRiseAfter(z), now,
+			fmt.Sprintf("%s has pumped %s without rising %.1fF", zone, z.pumped, opts.MinRise))
+	}
+
+	l.relayMutex.Lock()
+	loopOn := l.relayOn(l.outputName(l.heaterLoopPump))
+	l.relayMutex.Unlock()
+	if loopOn != d.loopOn || d.loopSince.IsZero() {
+		d.loopOn = loopOn
+		d.loopSince = now
+	}
+
+	l.flowMutex.Lock()
+	lastFlow := l.lastLoopFlow
+	l.flowMutex.Unlock()
+
+	// The window in which flow was or wasn't expected.
+	from := d.loopSince
+	if from.Before(lastFlow) {
+		from = lastFlow
+	}
+	noFlow := loopOn && now.Sub(from) >= opts.FlowTimeout
+	l.flag("loop_no_flow", noFlow, now,
+		fmt.Sprintf("the heater loop pump has run %s without any flow", now.Sub(from)))
+
+	flowWhileOff := false == loopOn && lastFlow.After(d.loopSince.Add(opts.FlowTimeout)) && now.Sub(lastFlow) < opts.FlowTimeout
+	l.flag("loop_flow_while_off", flowWhileOff, now, "the heater loop is flowing with the pump off")
+}
+
+// Anomalies returns the anomalies presently flagged.
+func (l *Logic) Anomalies() []Anomaly {
+	l.anomalyMutex.Lock()
+	defer l.anomalyMutex.Unlock()
+
+	list := []Anomaly{}
+	for _, a := range l.anomaly.anomalies {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// RecoveryRate returns the average temperature rise (F) per minute of
+// pumping for the zone, if it is known.
+func (l *Logic) RecoveryRate(zone string) (float64, bool) {
+	l.anomalyMutex.Lock()
+	defer l.anomalyMutex.Unlock()
+
+	if z, ok := l.anomaly.zones[zone]; ok && z.seen {
+		return z.rate, true
+	}
+	return 0, false
+}
+
+func (l *Logic) anomalyDetection() {
+	defer l.wg.Done()
+
+	period := time.Second * 10
+	t := l.clock.NewTicker(period)
+	last := l.clock.Now()
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			l.anomalyStep(now, now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// AnomalyAlert raises an alert while the named anomaly ("no_rise_<zone>",
+// "loop_no_flow", "loop_flow_while_off" or "heat_source_sensor") is flagged.
+func AnomalyAlert(name string) AlertRule {
+	return AlertRule{
+		Name: "anomaly_" + name,
+		Check: func(l *Logic, now time.Time) (bool, string) {
+			l.anomalyMutex.Lock()
+			defer l.anomalyMutex.Unlock()
+
+			if a, ok := l.anomaly.anomalies[name]; ok {
+				return true, a.Message
+			}
+			return false, ""
+		},
+	}
+}
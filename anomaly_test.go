@@ -0,0 +1,198 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAnomalyLogic(clock Clock, sensors *fakeSensors) *Logic {
+	return newTestLogic(clock, LogicOpts{
+		Anomaly: AnomalyOpts{Zones: map[string]string{"downstairs": "an_main"}},
+	}, sensors)
+}
+
+func TestAnomalyNoRise(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	l := newAnomalyLogic(clock, sensors)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "an_pump"}, 1)
+
+	step := func(d time.Duration) {
+		clock.Advance(d)
+		l.anomalyStep(clock.Now(), d)
+	}
+
+	// Idle zones don't count against themselves.
+	sensors.Set("an_main", 65)
+	step(time.Hour)
+	assert.Empty(l.Anomalies())
+
+	// Until the rate is learned 30 minutes without warming is flagged.
+	l.downstairsHeatPump.OnUntil(clock.Now().Add(time.Hour * 4))
+	l.downstairsHeatPump.State()
+	for i := 0; i < 29; i++ {
+		step(time.Minute)
+	}
+	assert.Empty(l.Anomalies())
+	step(time.Minute)
+	list := l.Anomalies()
+	if assert.Len(list, 1) {
+		assert.Equal("no_rise_downstairs", list[0].Name)
+	}
+
+	// Warming 1F over 31 minutes of pumping clears it.
+	sensors.Set("an_main", 66)
+	step(time.Minute)
+	rate, ok := l.RecoveryRate("downstairs")
+	assert.True(ok)
+	assert.InDelta(1.0/31.0, rate, 0.001)
+	assert.Empty(l.Anomalies())
+
+	// Then 1F in a minute.  Not warming is flagged once the zone has
+	// pumped 3 times as long as the learned rate needs to rise 0.5F.
+	sensors.Set("an_main", 67)
+	step(time.Minute)
+	rate, _ = l.RecoveryRate("downstairs")
+	assert.InDelta(0.8/31.0+0.2, rate, 0.001)
+	for i := 0; i < 6; i++ {
+		step(time.Minute)
+	}
+	assert.Empty(l.Anomalies())
+	step(time.Minute)
+	assert.Len(l.Anomalies(), 1)
+
+	// Warming clears it.
+	sensors.Set("an_main", 68)
+	step(time.Minute)
+	assert.Empty(l.Anomalies())
+
+	// The pump exercise and freeze protection aren't expected to warm the
+	// zone.
+	l.downstairsHeatPump.Off()
+	for _, claim := range []string{exerciseClaim, freezeClaim} {
+		l.downstairsHeatPump.NeededUntil(claim, clock.Now().Add(time.Hour))
+		for i := 0; i < 30; i++ {
+			step(time.Minute)
+		}
+		assert.Empty(l.Anomalies(), claim)
+		l.downstairsHeatPump.Release(claim)
+	}
+
+	// Unless the zone is heating too.
+	l.downstairsHeatPump.NeededUntil(freezeClaim, clock.Now().Add(time.Hour))
+	l.downstairsHeatPump.NeededUntil("wall:downstairs", clock.Now().Add(time.Hour))
+	for i := 0; i < 8; i++ {
+		step(time.Minute)
+	}
+	assert.Len(l.Anomalies(), 1)
+
+	l.downstairsHeatPump.Shutdown()
+}
+
+func TestAnomalySteadyState(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	l := newAnomalyLogic(clock, sensors)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "an_steady"}, 1)
+
+	step := func(d time.Duration) {
+		clock.Advance(d)
+		l.anomalyStep(clock.Now(), d)
+	}
+
+	// Holding at the target the thermostat runs the pump 10 minutes at a
+	// time and the zone never rises the 0.5F that resets the count.
+	sensors.Set("an_main", 68)
+	for run := 0; run < 6; run++ {
+		l.downstairsHeatPump.OnUntil(clock.Now().Add(time.Minute * 10))
+		for i := 0; i < 10; i++ {
+			step(time.Minute)
+		}
+		step(time.Minute * 20)
+		assert.Empty(l.Anomalies(), "run %d", run)
+	}
+
+	// A single long run without rising is still flagged.
+	l.downstairsHeatPump.OnUntil(clock.Now().Add(time.Hour))
+	for i := 0; i < 31; i++ {
+		step(time.Minute)
+	}
+	assert.Len(l.Anomalies(), 1)
+
+	l.downstairsHeatPump.Shutdown()
+}
+
+func TestAnomalyLoopFlow(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newAnomalyLogic(clock, newFakeSensors())
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "an_loop"}, 2)
+
+	step := func(d time.Duration) {
+		clock.Advance(d)
+		l.anomalyStep(clock.Now(), d)
+	}
+	names := func() []string {
+		var list []string
+		for _, a := range l.Anomalies() {
+			list = append(list, a.Name)
+		}
+		return list
+	}
+
+	step(time.Second * 10)
+	assert.Empty(names())
+
+	// The pump runs without any flow.
+	l.heaterLoopPump.OnUntil(clock.Now().Add(time.Hour))
+	l.heaterLoopPump.State()
+	step(time.Second * 10)
+	step(time.Minute)
+	assert.Empty(names())
+	step(time.Minute)
+	assert.Equal([]string{"loop_no_flow"}, names())
+
+	// Flow clears it.
+	l.recordFlow("loop", 0.1)
+	step(time.Second * 10)
+	assert.Empty(names())
+
+	// Some coasting after the pump stops is fine.
+	l.heaterLoopPump.Off()
+	l.heaterLoopPump.State()
+	step(time.Second * 10)
+	l.recordFlow("loop", 0.1)
+	step(time.Second * 10)
+	assert.Empty(names())
+
+	// Flow long after isn't.
+	step(time.Minute * 5)
+	l.recordFlow("loop", 0.1)
+	step(time.Second * 10)
+	assert.Equal([]string{"loop_flow_while_off"}, names())
+	step(time.Minute * 2)
+	assert.Empty(names())
+
+	l.heaterLoopPump.Shutdown()
+}
@@ -127,6 +127,25 @@ func (a *ArduinoIoBoard) SetRelayState(state int) (err error) {
 	return err
 }
 
+// SetDuty drives an output (0-5) with a PWM duty (0-255) instead of the
+// relay state.  A duty of 0 returns the output to the relay state.  Only
+// outputs 1-3 can do PWM.
+func (a *ArduinoIoBoard) SetDuty(output, duty int) (err error) {
+	if nil == a.serial {
+		return fmt.Errorf("Arduino '%s' not open.", a.Filename)
+	}
+
+	b := []byte(fmt.Sprintf("p %d %d\n", output, duty))
+	for 0 < len(b) {
+		n, err := a.serial.Write(b)
+		if nil != err {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
 func (a *ArduinoIoBoard) read() (rv string, err error) {
 	if nil != a.serial {
 		b := make([]byte, 1)
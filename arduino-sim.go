@@ -0,0 +1,407 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The help text exactly as io-module.ino prints it.
+const arduinoSimHelp = "s [0-63] sets the relay output bitmask\np [1-3] [0-255] sets the PWM duty of an output, 0 returns it to the bitmask\ng gets the latest output\ndata format: %02X|%02X|%02X\\n, sn, input, output\n\r\n"
+
+type ArduinoSimOpts struct {
+	// The serial number reported by the board.
+	SerialNumber int
+
+	// How often a status line is sent even if nothing changed.  The
+	// default is 1 second like the firmware.
+	ReportPeriod time.Duration
+
+	// Called whenever the relay outputs change.
+	OnRelay func(state int)
+
+	// Called whenever the PWM duty (0-255) of an output (0-5) changes.
+	OnDuty func(output, duty int)
+}
+
+// ArduinoSim is a simulated io-module board behind a pseudo-terminal.  Open
+// an ArduinoIoBoard with Path() to talk to it.
+type ArduinoSim struct {
+	opts    ArduinoSimOpts
+	master  *os.File
+	slave   *os.File
+	path    string
+	input   int
+	output  int
+	relays  int
+	duty    [6]int
+	changed chan bool
+	done    chan bool
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+}
+
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) (err error) {
+	conn, err := f.SyscallConn()
+	if nil != err {
+		return err
+	}
+	conn.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg))
+		if 0 != errno {
+			err = errno
+		}
+	})
+	return err
+}
+
+// NewArduinoSim creates a pseudo-terminal that speaks the io-module.ino
+// protocol.
+func NewArduinoSim(opts ArduinoSimOpts) (*ArduinoSim, error) {
+	if 0 == opts.ReportPeriod {
+		opts.ReportPeriod = time.Second
+	}
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if nil != err {
+		return nil, err
+	}
+
+	var unlock int32
+	if err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); nil != err {
+		master.Close()
+		return nil, err
+	}
+	var n uint32
+	if err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); nil != err {
+		master.Close()
+		return nil, err
+	}
+
+	s := &ArduinoSim{
+		opts:    opts,
+		master:  master,
+		path:    fmt.Sprintf("/dev/pts/%d", n),
+		changed: make(chan bool, 1),
+		done:    make(chan bool),
+	}
+
+	// Keep the slave side open so the master doesn't see a hang up when
+	// the daemon closes and reopens the port.  It also sets raw mode.
+	s.slave, err = os.OpenFile(s.path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if nil != err {
+		master.Close()
+		return nil, err
+	}
+
+	var tio syscall.Termios
+	if err = ioctl(s.slave, syscall.TCGETS, unsafe.Pointer(&tio)); nil == err {
+		tio.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		tio.Oflag &^= syscall.OPOST
+		tio.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		tio.Cflag &^= syscall.CSIZE | syscall.PARENB
+		tio.Cflag |= syscall.CS8
+		tio.Cc[syscall.VMIN] = 1
+		tio.Cc[syscall.VTIME] = 0
+		err = ioctl(s.slave, syscall.TCSETS, unsafe.Pointer(&tio))
+	}
+	if nil != err {
+		s.slave.Close()
+		master.Close()
+		return nil, err
+	}
+
+	s.wg.Add(2)
+	go s.report()
+	go s.commands()
+
+	return s, nil
+}
+
+// Path returns the serial device the simulated board is attached to.
+func (s *ArduinoSim) Path() string {
+	return s.path
+}
+
+// Close disconnects the simulated board.
+func (s *ArduinoSim) Close() {
+	close(s.done)
+	s.master.Close()
+	s.slave.Close()
+	s.wg.Wait()
+}
+
+// Relays returns the relay output state.
+func (s *ArduinoSim) Relays() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.relays
+}
+
+// Duty returns the PWM duty (0-255) of an output (0-5).  0 means the
+// output follows the relays.
+func (s *ArduinoSim) Duty(output int) int {
+	if output < 0 || 5 < output {
+		return 0
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.duty[output]
+}
+
+// SetInput sets an input pin (2-7) high or low.
+func (s *ArduinoSim) SetInput(bit int, high bool) {
+	if bit < 2 || 7 < bit {
+		return
+	}
+
+	s.mutex.Lock()
+	before := s.input
+	if high {
+		s.input |= 1 << uint(bit)
+	} else {
+		s.input &^= 1 << uint(bit)
+	}
+	after := s.input
+	s.mutex.Unlock()
+
+	if before != after {
+		s.notify()
+	}
+}
+
+// Pulse toggles an input pin count times, period apart, the way a flow
+// meter does.  It returns once the pulses are done.
+func (s *ArduinoSim) Pulse(bit, count int, period time.Duration) {
+	for i := 0; i < count; i++ {
+		s.mutex.Lock()
+		high := 0 == s.input&(1<<uint(bit))
+		s.mutex.Unlock()
+
+		s.SetInput(bit, high)
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(period):
+		}
+	}
+}
+
+// RunScript runs a list of input changes, one per line.  Each line is a
+// delay from the previous line followed by a command:
+//
+//	2s set 5 1          - set input 5 high
+//	500ms pulse 6 20 1s - toggle input 6 20 times, 1 second apart
+//
+// Blank lines and lines starting with # are ignored.
+func (s *ArduinoSim) RunScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		f := strings.Fields(scanner.Text())
+		if 0 == len(f) || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+
+		err := fmt.Errorf("Script line %d: invalid command '%s'", line, scanner.Text())
+		if len(f) < 4 {
+			return err
+		}
+
+		delay, derr := time.ParseDuration(f[0])
+		bit, berr := strconv.Atoi(f[2])
+		if nil != derr || nil != berr {
+			return err
+		}
+
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		switch {
+		case "set" == f[1]:
+			s.SetInput(bit, "0" != f[3])
+		case "pulse" == f[1] && 5 == len(f):
+			count, cerr := strconv.Atoi(f[3])
+			period, perr := time.ParseDuration(f[4])
+			if nil != cerr || nil != perr {
+				return err
+			}
+			s.Pulse(bit, count, period)
+		default:
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *ArduinoSim) notify() {
+	select {
+	case s.changed <- true:
+	default:
+	}
+}
+
+// report sends the status line when the inputs change and at least every
+// report period, like the firmware.
+func (s *ArduinoSim) report() {
+	defer s.wg.Done()
+
+	t := time.NewTicker(s.opts.ReportPeriod)
+	for {
+		select {
+		case <-s.done:
+			t.Stop()
+			return
+		case <-t.C:
+		case <-s.changed:
+		}
+		s.status()
+	}
+}
+
+func (s *ArduinoSim) status() {
+	s.mutex.Lock()
+	line := fmt.Sprintf("%02X|%02X|%02X\n", s.opts.SerialNumber, s.input, s.output)
+	s.mutex.Unlock()
+
+	s.master.Write([]byte(line))
+}
+
+// commands handles the commands sent to the board.
+func (s *ArduinoSim) commands() {
+	defer s.wg.Done()
+
+	r := bufio.NewReader(s.master)
+	for {
+		cmd, err := r.ReadByte()
+		if nil != err {
+			return
+		}
+
+		switch cmd {
+		case '?':
+			s.master.Write([]byte(arduinoSimHelp))
+		case 's':
+			state, err := parseInt(r)
+			if nil != err {
+				return
+			}
+			s.setRelays(state)
+		case 'p':
+			output, err := parseInt(r)
+			if nil != err {
+				return
+			}
+			duty, err := parseInt(r)
+			if nil != err {
+				return
+			}
+			s.setDuty(output, duty)
+		case 'g':
+			s.status()
+		}
+	}
+}
+
+// parseInt works like the Arduino Serial.parseInt(): leading characters
+// that are not digits are skipped and the number ends at the first
+// character that is not a digit, which is left unread.
+func parseInt(r *bufio.Reader) (int, error) {
+	rv, found, negative := 0, false, false
+	for {
+		b, err := r.ReadByte()
+		if nil != err {
+			return 0, err
+		}
+
+		switch {
+		case '0' <= b && b <= '9':
+			rv = rv*10 + int(b-'0')
+			found = true
+			continue
+		case '-' == b && false == found:
+			negative = true
+			continue
+		case false == found:
+			continue
+		}
+
+		r.UnreadByte()
+		if negative {
+			rv = -rv
+		}
+		return rv, nil
+	}
+}
+
+func (s *ArduinoSim) setRelays(state int) {
+	s.mutex.Lock()
+	// Like the firmware the reported output follows the command even when
+	// it is out of range and the relays are left alone.
+	s.output = state
+	valid := 0 <= state && state < 64
+	if valid {
+		s.relays = state
+	}
+	s.mutex.Unlock()
+
+	if false == valid {
+		s.master.Write([]byte("Invalid range.  Expecting: [0-63]\n"))
+		return
+	}
+
+	if nil != s.opts.OnRelay {
+		s.opts.OnRelay(state)
+	}
+}
+
+// The outputs that can do PWM, like pins 9, 10 and 11 on the board.
+const arduinoPwmCapable = 0x0e
+
+func (s *ArduinoSim) setDuty(output, duty int) {
+	if output < 0 || 5 < output || 0 == (1<<uint(output))&arduinoPwmCapable {
+		s.master.Write([]byte("Invalid output.  Expecting: [1-3]\n"))
+		return
+	}
+	if duty < 0 || 255 < duty {
+		s.master.Write([]byte("Invalid duty.  Expecting: [0-255]\n"))
+		return
+	}
+
+	s.mutex.Lock()
+	s.duty[output] = duty
+	s.mutex.Unlock()
+
+	if nil != s.opts.OnDuty {
+		s.opts.OnDuty(output, duty)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readUntil reads lines from the simulator until one matches.  An error,
+// like the deadline passing, fails the test.
+func readUntil(t *testing.T, r *bufio.Reader, match func(line string) bool) string {
+	for {
+		line, err := r.ReadString('\n')
+		if nil != err {
+			t.Fatalf("Reading the simulator: %v", err)
+		}
+		if match(line) {
+			return line
+		}
+	}
+}
+
+func prefix(p string) func(string) bool {
+	return func(line string) bool { return strings.HasPrefix(line, p) }
+}
+
+func TestArduinoSim(t *testing.T) {
+	assert := assert.New(t)
+
+	relays := make(chan int, 10)
+	sim, err := NewArduinoSim(ArduinoSimOpts{
+		SerialNumber: 0x12,
+		ReportPeriod: 100 * time.Millisecond,
+		OnRelay: func(state int) {
+			relays <- state
+		},
+	})
+	assert.Nil(err)
+	if nil != err {
+		return
+	}
+	defer sim.Close()
+
+	port, err := os.OpenFile(sim.Path(), os.O_RDWR, 0)
+	assert.Nil(err)
+	defer port.Close()
+	assert.Nil(port.SetReadDeadline(time.Now().Add(time.Second * 10)))
+	r := bufio.NewReader(port)
+
+	// Periodic status.
+	line, err := r.ReadString('\n')
+	assert.Nil(err)
+	assert.Equal("12|00|00\n", line)
+
+	// Relay changes are echoed in the status.
+	port.Write([]byte("s 13\n"))
+	assert.Equal(13, <-relays)
+	assert.Equal(13, sim.Relays())
+	port.Write([]byte("g"))
+	readUntil(t, r, prefix("12|00|0D\n"))
+
+	// Out of range relay values are refused.
+	port.Write([]byte("s 64\n"))
+	readUntil(t, r, prefix("Invalid range"))
+	assert.Equal(13, sim.Relays())
+
+	// PWM only works on the capable outputs.
+	port.Write([]byte("p 2 128\n"))
+	assert.Eventually(func() bool { return 128 == sim.Duty(2) }, time.Second, time.Millisecond)
+	port.Write([]byte("p 5 128\n"))
+	readUntil(t, r, prefix("Invalid output"))
+	assert.Equal(0, sim.Duty(5))
+
+	// Scripted inputs.
+	assert.Nil(sim.RunScript(strings.NewReader("# comment\n0s set 5 1\n0s pulse 7 1 1ms\n")))
+	readUntil(t, r, prefix("12|A0|"))
+	assert.NotNil(sim.RunScript(strings.NewReader("1s jump 5 1\n")))
+}
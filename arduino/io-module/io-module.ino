@@ -11,6 +11,12 @@ const long SERIAL_NUMBER = 0;
 unsigned int _output_state = 0;
 unsigned int _input_state = 0;
 
+/* The outputs (0-5, pins 8-13) that can do PWM; pins 9, 10 and 11. */
+const unsigned int PWM_CAPABLE = 0x0e;
+
+/* The outputs presently driven with PWM instead of on/off. */
+unsigned int _pwm_state = 0;
+
 void setup() {
 
   /* Setup the outputs and set them to 0 / off. */
@@ -47,13 +53,20 @@ void loop() {
 
     switch (cmd) {
       case '?':
-        Serial.println(F("s [0-63] sets the relay output bitmask\ng gets the latest output\ndata format: %02X|%02X|%02X\\n, sn, input, output\n"));
+        Serial.println(F("s [0-63] sets the relay output bitmask\np [1-3] [0-255] sets the PWM duty of an output, 0 returns it to the bitmask\ng gets the latest output\ndata format: %02X|%02X|%02X\\n, sn, input, output\n"));
 
         break;
       case 's':
         _output_state = Serial.parseInt();
         SetRelayState(_output_state);
         break;
+      case 'p':
+        {
+          long output = Serial.parseInt();
+          long duty = Serial.parseInt();
+          SetPwm(output, duty);
+        }
+        break;
       case 'g':
         OutputData();
         break;
@@ -89,6 +102,9 @@ void SetRelayState( long out )
   int j = 8;
   if ( 0 <= out && out < 64 ) {
     for (int i = 0; i < 6; i++, j++) {
+      if ((1 << i) & _pwm_state) {
+        continue;
+      }
       if ((1 << i) & out) {
         digitalWrite(j, HIGH);
       } else {
@@ -100,6 +116,27 @@ void SetRelayState( long out )
   }
 }
 
+void SetPwm( long output, long duty )
+{
+  if ( output < 0 || 5 < output || 0 == ((1 << output) & PWM_CAPABLE) ) {
+    Serial.print( "Invalid output.  Expecting: [1-3]\n" );
+    return;
+  }
+  if ( duty < 0 || 255 < duty ) {
+    Serial.print( "Invalid duty.  Expecting: [0-255]\n" );
+    return;
+  }
+
+  if ( 0 == duty ) {
+    /* Back to following the relay bitmask. */
+    bitClear(_pwm_state, output);
+    SetRelayState(_output_state);
+  } else {
+    bitSet(_pwm_state, output);
+    analogWrite(8 + output, duty);
+  }
+}
+
 // Figure out the state of the inputs and the clock.
 // Return if the output report should be sent.
 bool UpdateInputState()
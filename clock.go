@@ -0,0 +1,240 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time so tests and simulations can run in virtual
+// time.
+type Clock interface {
+	Now() time.Time
+	Since(time.Time) time.Duration
+	Sleep(time.Duration)
+	After(time.Duration) <-chan time.Time
+	NewTicker(time.Duration) Ticker
+	NewTimer(time.Duration) Timer
+	AfterFunc(time.Duration, func()) Timer
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{t: time.NewTicker(d)}
+}
+
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &realTimer{t: time.AfterFunc(d, f)}
+}
+
+func (r *realTicker) C() <-chan time.Time       { return r.t.C }
+func (r *realTicker) Stop()                     { r.t.Stop() }
+func (r *realTimer) C() <-chan time.Time        { return r.t.C }
+func (r *realTimer) Stop() bool                 { return r.t.Stop() }
+func (r *realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+// FakeClock only moves when it is told to.  Timers, tickers and sleepers
+// fire in order as the time passes them.  Functions given to AfterFunc()
+// are called by Advance() before it returns.
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeWaiter
+	mutex   sync.Mutex
+}
+
+type fakeWaiter struct {
+	clock  *FakeClock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+	f      func()
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return &fakeTicker{c.add(d, d, nil)}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0, nil)
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(d, 0, f)
+}
+
+func (c *FakeClock) add(d, period time.Duration, f func()) *fakeWaiter {
+	w := &fakeWaiter{
+		clock:  c,
+		period: period,
+		c:      make(chan time.Time, 1),
+		f:      f,
+	}
+
+	c.mutex.Lock()
+	w.when = c.now.Add(d)
+	c.waiters = append(c.waiters, w)
+	c.mutex.Unlock()
+
+	// Like the real timers, a zero or negative duration fires right away.
+	if d <= 0 {
+		c.Advance(0)
+	}
+	return w
+}
+
+// Advance moves the clock forward by d, firing everything that comes due
+// along the way.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	c.mutex.Unlock()
+
+	for {
+		c.mutex.Lock()
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].when.Before(c.waiters[j].when)
+		})
+		if 0 == len(c.waiters) || c.waiters[0].when.After(end) {
+			c.now = end
+			c.mutex.Unlock()
+			return
+		}
+
+		w := c.waiters[0]
+		if w.when.After(c.now) {
+			c.now = w.when
+		}
+		now := c.now
+		if 0 < w.period {
+			w.when = w.when.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+		c.mutex.Unlock()
+
+		if nil != w.f {
+			w.f()
+		} else {
+			select {
+			case w.c <- now:
+			default:
+			}
+		}
+	}
+}
+
+// Set moves the clock forward to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+func (c *FakeClock) remove(w *fakeWaiter) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, v := range c.waiters {
+		if v == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t *fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) Stop() bool {
+	return w.clock.remove(w)
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	active := w.clock.remove(w)
+
+	w.clock.mutex.Lock()
+	w.when = w.clock.now.Add(d)
+	w.clock.waiters = append(w.clock.waiters, w)
+	w.clock.mutex.Unlock()
+
+	if d <= 0 {
+		w.clock.Advance(0)
+	}
+	return active
+}
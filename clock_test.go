@@ -0,0 +1,73 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	var fired []time.Time
+	clock.AfterFunc(3*time.Second, func() {
+		fired = append(fired, clock.Now())
+	})
+	stopped := clock.AfterFunc(time.Second, func() {
+		fired = append(fired, clock.Now())
+	})
+	assert.True(stopped.Stop())
+
+	ticker := clock.NewTicker(2 * time.Second)
+	timer := clock.NewTimer(5 * time.Second)
+
+	clock.Advance(4 * time.Second)
+	assert.Equal(start.Add(4*time.Second), clock.Now())
+	assert.Equal([]time.Time{start.Add(3 * time.Second)}, fired)
+
+	// Like the real ticker, missed ticks are dropped.
+	assert.Equal(start.Add(2*time.Second), <-ticker.C())
+	select {
+	case <-ticker.C():
+		assert.Fail("unexpected tick")
+	default:
+	}
+
+	select {
+	case <-timer.C():
+		assert.Fail("timer fired early")
+	default:
+	}
+	clock.Set(start.Add(5 * time.Second))
+	assert.Equal(start.Add(5*time.Second), <-timer.C())
+	assert.False(timer.Stop())
+
+	// Resetting to now fires right away, like a new zero timer.
+	assert.False(timer.Reset(0))
+	assert.Equal(start.Add(5*time.Second), <-timer.C())
+	count := 0
+	f := clock.AfterFunc(time.Hour, func() { count++ })
+	assert.True(f.Reset(-time.Second))
+	assert.Equal(1, count)
+
+	ticker.Stop()
+	assert.Equal(time.Second, clock.Since(start.Add(4*time.Second)))
+}
@@ -0,0 +1,325 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// BTU to heat a gallon of water 1F.
+	btuPerGallonF = 8.33
+
+	btuPerTherm = 100000
+
+	// How many daily and monthly rollups are kept.
+	energyDays   = 62
+	energyMonths = 24
+)
+
+type EnergyOutput struct {
+	// The power the output draws while it is on.
+	Watts float64
+
+	// The zone the energy is charged to.  The default is the output name.
+	Zone string
+}
+
+type EnergyOpts struct {
+	// The outputs that use electricity, by OnOffThing name.
+	Outputs map[string]EnergyOutput
+
+	// The cost of a kWh of electricity.
+	ElectricRate float64
+
+	// The cost of a therm of heat source fuel.
+	FuelRate float64
+
+	// How much of the fuel's energy ends up in the water (0-1).  The
+	// default is 0.85.
+	Efficiency float64
+
+	// The domestic cold water inlet and hot water temperatures (F) used to
+	// work out the energy in the hot water used.  The defaults are 55F and
+	// 120F.
+	ColdWaterTemp float64
+	HotWaterTemp  float64
+
+	// Where the rollups are saved so they survive restarts.  If empty they
+	// are only kept in memory.
+	File string
+}
+
+// EnergyUsage is the energy and cost charged to a zone.
+type EnergyUsage struct {
+	KWh    float64 `json:"kwh"`
+	Therms float64 `json:"therms"`
+	Cost   float64 `json:"cost"`
+}
+
+// EnergyReport is the daily ("2006-01-02") and monthly ("2006-01") usage by
+// zone.
+type EnergyReport struct {
+	Days   map[string]map[string]EnergyUsage `json:"days"`
+	Months map[string]map[string]EnergyUsage `json:"months"`
+}
+
+// energyLedger adds up the energy used by zone.
+type energyLedger struct {
+	opts   EnergyOpts
+	report EnergyReport
+	mutex  sync.Mutex
+
+	// Metrics by zone.  The zones come from claim names, so they are labels
+	// instead of part of the metric names.
+	kwh    *prometheus.CounterVec
+	therms *prometheus.CounterVec
+	cost   *prometheus.CounterVec
+}
+
+func newEnergyLedger(opts EnergyOpts, namespace string) *energyLedger {
+	if 0 == opts.Efficiency {
+		opts.Efficiency = 0.85
+	}
+	if 0 == opts.ColdWaterTemp {
+		opts.ColdWaterTemp = 55
+	}
+	if 0 == opts.HotWaterTemp {
+		opts.HotWaterTemp = 120
+	}
+
+	return &energyLedger{
+		opts: opts,
+		report: EnergyReport{
+			Days:   make(map[string]map[string]EnergyUsage),
+			Months: make(map[string]map[string]EnergyUsage),
+		},
+		kwh: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "energy",
+			Name:      "kwh",
+			Help:      "electricity used by zone (kWh)",
+		}, []string{"zone"}),
+		therms: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "energy",
+			Name:      "therms",
+			Help:      "heat source fuel used by zone (therms)",
+		}, []string{"zone"}),
+		cost: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "energy",
+			Name:      "cost",
+			Help:      "energy cost by zone",
+		}, []string{"zone"}),
+	}
+}
+
+// add charges electricity (kWh) and heat delivered (BTU) to a zone.
+func (e *energyLedger) add(when time.Time, zone string, kwh, btu float64) {
+	var u EnergyUsage
+	u.KWh = kwh
+	u.Therms = btu / btuPerTherm / e.opts.Efficiency
+	u.Cost = u.KWh*e.opts.ElectricRate + u.Therms*e.opts.FuelRate
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	rollup(e.report.Days, when.Format("2006-01-02"), zone, u, energyDays)
+	rollup(e.report.Months, when.Format("2006-01"), zone, u, energyMonths)
+
+	e.kwh.WithLabelValues(zone).Add(u.KWh)
+	e.therms.WithLabelValues(zone).Add(u.Therms)
+	e.cost.WithLabelValues(zone).Add(u.Cost)
+}
+
+// rollup adds the usage to the period and drops the oldest periods past
+// keep.  The period keys sort by time.
+func rollup(periods map[string]map[string]EnergyUsage, period, zone string, u EnergyUsage, keep int) {
+	zones, ok := periods[period]
+	if false == ok {
+		zones = make(map[string]EnergyUsage)
+		periods[period] = zones
+
+		if len(periods) > keep {
+			var list []string
+			for k := range periods {
+				list = append(list, k)
+			}
+			sort.Strings(list)
+			for _, k := range list[:len(list)-keep] {
+				delete(periods, k)
+			}
+		}
+	}
+
+	total := zones[zone]
+	total.KWh += u.KWh
+	total.Therms += u.Therms
+	total.Cost += u.Cost
+	zones[zone] = total
+}
+
+// Report returns a copy of the rollups.
+func (e *energyLedger) Report() EnergyReport {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	rv := EnergyReport{
+		Days:   make(map[string]map[string]EnergyUsage),
+		Months: make(map[string]map[string]EnergyUsage),
+	}
+	for k, v := range e.report.Days {
+		rv.Days[k] = make(map[string]EnergyUsage)
+		for zone, u := range v {
+			rv.Days[k][zone] = u
+		}
+	}
+	for k, v := range e.report.Months {
+		rv.Months[k] = make(map[string]EnergyUsage)
+		for zone, u := range v {
+			rv.Months[k][zone] = u
+		}
+	}
+	return rv
+}
+
+func (e *energyLedger) load() error {
+	buf, err := ioutil.ReadFile(e.opts.File)
+	if nil != err {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return json.Unmarshal(buf, &e.report)
+}
+
+func (e *energyLedger) save() error {
+	e.mutex.Lock()
+	buf, err := json.Marshal(&e.report)
+	e.mutex.Unlock()
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(e.opts.File, buf, 0644)
+}
+
+// Energy returns the energy used by zone per day and month.
+func (l *Logic) Energy() EnergyReport {
+	return l.energy.Report()
+}
+
+// recordLoopHeat charges the heat carried by the heater loop flow to the
+// zones using the loop.  The heat is the flow times the heat source supply
+// minus return temperature.  Samples where the return is as warm as the
+// supply (purging, exercising or a cold start) carry no heat to charge.
+func (l *Logic) recordLoopHeat(gallons float64) {
+	supply, ok := reading(l.tempSensors, l.opts.HeatSource.SupplySensor)
+	if false == ok {
+		return
+	}
+	ret, ok := reading(l.tempSensors, l.opts.HeatSource.ReturnSensor)
+	if false == ok || supply-ret <= 0 {
+		return
+	}
+
+	var zones []string
+	for _, c := range l.heaterLoopPump.Claims() {
+		if wantsHeat(c.Name) {
+			zones = append(zones, c.Name)
+		}
+	}
+	if 0 == len(zones) {
+		zones = append(zones, "heater_loop")
+	}
+
+	btu := gallons * btuPerGallonF * (supply - ret) / float64(len(zones))
+	now := l.clock.Now()
+	for _, zone := range zones {
+		l.energy.add(now, zone, 0, btu)
+	}
+}
+
+// recordHotWaterHeat charges the heat in the hot water used to "domestic".
+func (l *Logic) recordHotWaterHeat(gallons float64) {
+	opts := l.energy.opts
+	btu := gallons * btuPerGallonF * (opts.HotWaterTemp - opts.ColdWaterTemp)
+	l.energy.add(l.clock.Now(), "domestic", 0, btu)
+}
+
+// energyAccounting charges the electricity used by the outputs while their
+// relays are on.
+func (l *Logic) energyAccounting() {
+	defer l.wg.Done()
+
+	opts := l.energy.opts
+	if "" != opts.File {
+		if err := l.energy.load(); nil != err {
+			fmt.Printf("Energy: %v\n", err)
+		}
+	}
+
+	t := l.clock.NewTicker(time.Second * 10)
+	last := l.clock.Now()
+	saved := last
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			if "" != opts.File {
+				l.energy.save()
+			}
+			return
+		case now := <-t.C():
+			l.energyStep(now, now.Sub(last))
+			last = now
+
+			if "" != opts.File && now.Sub(saved) > time.Hour {
+				if err := l.energy.save(); nil != err {
+					fmt.Printf("Energy: %v\n", err)
+				}
+				saved = now
+			}
+		}
+	}
+}
+
+// energyStep charges the outputs whose relays are on for the electricity
+// they used over the last dt.
+func (l *Logic) energyStep(now time.Time, dt time.Duration) {
+	for name, out := range l.energy.opts.Outputs {
+		l.relayMutex.Lock()
+		on := l.relayOn(name)
+		l.relayMutex.Unlock()
+		if false == on {
+			continue
+		}
+
+		zone := out.Zone
+		if "" == zone {
+			zone = name
+		}
+		l.energy.add(now, zone, out.Watts*dt.Hours()/1000, 0)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnergyLedger(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "energy")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	e := newEnergyLedger(EnergyOpts{
+		ElectricRate: 0.10,
+		FuelRate:     1.00,
+		Efficiency:   0.5,
+		File:         filepath.Join(dir, "energy.json"),
+	}, testNamespace("testing_ledger"))
+
+	when := time.Date(2019, 1, 7, 12, 0, 0, 0, time.UTC)
+	e.add(when, "downstairs", 2, 0)
+	e.add(when, "downstairs", 0, 50000)
+	e.add(when.AddDate(0, 0, 1), "downstairs", 1, 0)
+
+	r := e.Report()
+	assert.InDelta(2, r.Days["2019-01-07"]["downstairs"].KWh, 0.0001)
+	assert.InDelta(1, r.Days["2019-01-07"]["downstairs"].Therms, 0.0001)
+	assert.InDelta(1.2, r.Days["2019-01-07"]["downstairs"].Cost, 0.0001)
+	assert.InDelta(3, r.Months["2019-01"]["downstairs"].KWh, 0.0001)
+
+	// Only the latest days are kept.
+	for i := 0; i < energyDays+5; i++ {
+		e.add(when.AddDate(0, 0, i), "upstairs", 1, 0)
+	}
+	r = e.Report()
+	assert.Equal(energyDays, len(r.Days))
+	_, found := r.Days["2019-01-07"]
+	assert.False(found)
+	assert.Equal(3, len(r.Months))
+
+	// The rollups survive a restart.
+	assert.Nil(e.save())
+	reloaded := newEnergyLedger(EnergyOpts{File: e.opts.File}, testNamespace("testing_reloaded"))
+	assert.Nil(reloaded.load())
+	assert.Equal(r, reloaded.Report())
+}
+
+func TestLoopHeat(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	l := newTestLogic(clock, LogicOpts{
+		HeatSource: HeatSourceOpts{SupplySensor: "supply", ReturnSensor: "return"},
+		Energy:     EnergyOpts{Efficiency: 1},
+	}, sensors)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "eh_loop"}, 1)
+	l.checkInterlocks()
+
+	// No readings, no heat.
+	l.recordLoopHeat(10)
+	assert.Equal(0, len(l.Energy().Days))
+
+	sensors.Set("supply", 140)
+	sensors.Set("return", 120)
+	l.heaterLoopPump.NeededUntil("downstairs", clock.Now().Add(time.Minute))
+	l.heaterLoopPump.NeededUntil("upstairs", clock.Now().Add(time.Minute))
+	l.heaterLoopPump.NeededUntil(purgeClaim, clock.Now().Add(time.Minute))
+	l.recordLoopHeat(10)
+
+	// 10 gallons * 8.33 * 20F split between the zones.
+	day := l.Energy().Days["2019-01-07"]
+	assert.InDelta(833.0/btuPerTherm, day["downstairs"].Therms, 0.000001)
+	assert.InDelta(833.0/btuPerTherm, day["upstairs"].Therms, 0.000001)
+	_, found := day[purgeClaim]
+	assert.False(found)
+
+	// Exercise runs are left out of the split like purges.
+	l.heaterLoopPump.NeededUntil(exerciseClaim, clock.Now().Add(time.Minute))
+	l.recordLoopHeat(10)
+	day = l.Energy().Days["2019-01-07"]
+	assert.InDelta(833.0*2/btuPerTherm, day["downstairs"].Therms, 0.000001)
+	_, found = day[exerciseClaim]
+	assert.False(found)
+	l.heaterLoopPump.Release(exerciseClaim)
+
+	// A return warmer than the supply carries no heat.
+	sensors.Set("return", 150)
+	l.recordLoopHeat(10)
+	day = l.Energy().Days["2019-01-07"]
+	assert.InDelta(833.0*2/btuPerTherm, day["downstairs"].Therms, 0.000001)
+	sensors.Set("return", 120)
+
+	// Any claim name is a zone.
+	l.heaterLoopPump.NeededUntil("wall:upstairs", clock.Now().Add(time.Minute))
+	l.recordLoopHeat(10)
+	day = l.Energy().Days["2019-01-07"]
+	assert.InDelta(833.0*2/3/btuPerTherm, day["wall:upstairs"].Therms, 0.000001)
+
+	l.recordHotWaterHeat(1)
+	day = l.Energy().Days["2019-01-07"]
+	assert.InDelta(8.33*65/btuPerTherm, day["domestic"].Therms, 0.000001)
+
+	l.heaterLoopPump.Shutdown()
+}
+
+func TestOutputEnergy(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{
+		Energy: EnergyOpts{Outputs: map[string]EnergyOutput{
+			"eh_loop":    {Watts: 100},
+			"downstairs": {Watts: 50, Zone: "basement"},
+		}},
+	}, nil)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "eh_loop"}, 1)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "downstairs"}, 2)
+	l.checkInterlocks()
+
+	// Nothing is charged while the relays are off.
+	l.energyStep(clock.Now(), time.Hour)
+	assert.Equal(0, len(l.Energy().Days))
+
+	// Only the output that's on is charged, to its zone.
+	l.heaterLoopPump.OnUntil(clock.Now().Add(2 * time.Hour))
+	l.energyStep(clock.Now(), 30*time.Minute)
+	day := l.Energy().Days["2019-01-07"]
+	assert.InDelta(0.05, day["eh_loop"].KWh, 0.0001)
+	_, found := day["basement"]
+	assert.False(found)
+
+	l.downstairsHeatPump.OnUntil(clock.Now().Add(2 * time.Hour))
+	l.energyStep(clock.Now(), time.Hour)
+	day = l.Energy().Days["2019-01-07"]
+	assert.InDelta(0.15, day["eh_loop"].KWh, 0.0001)
+	assert.InDelta(0.05, day["basement"].KWh, 0.0001)
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The claim pumps are exercised under.
+const exerciseClaim = "exercise"
+
+// How long after At an exercise that could not run (blackout, interlock)
+// is retried before waiting for the next day.
+const exerciseWindow = time.Hour
+
+// How many exercise runs are remembered.
+const maxExerciseRuns = 50
+
+type ExerciseOpts struct {
+	// How long a pump may sit idle before it is exercised.  If 0 the pumps
+	// are never exercised.
+	Interval time.Duration
+
+	// How long each exercise runs the pump.  The default is 30 seconds.
+	RunTime time.Duration
+
+	// The time of day the exercise is run.
+	At TimeOfDay
+
+	// The outputs exercised.  The default is the heater loop and zone
+	// pumps.
+	Outputs []string
+}
+
+// ExerciseRun is a pump being exercised.
+type ExerciseRun struct {
+	Output string    `json:"output"`
+	Start  time.Time `json:"start"`
+	Until  time.Time `json:"until"`
+}
+
+type exerciser struct {
+	opts ExerciseOpts
+
+	// When each output's relay was last seen on.
+	active map[string]time.Time
+
+	runs  []ExerciseRun
+	mutex sync.Mutex
+}
+
+func newExerciser(opts ExerciseOpts) *exerciser {
+	if 0 == opts.RunTime {
+		opts.RunTime = time.Second * 30
+	}
+	if 0 == len(opts.Outputs) {
+		opts.Outputs = []string{"heater_loop_pump", "downstairs_heat_pump", "upstairs_heat_pump"}
+	}
+	return &exerciser{
+		opts:   opts,
+		active: make(map[string]time.Time),
+	}
+}
+
+// exerciseBlocked returns why the named output can't be exercised now, or
+// an empty string if it can.  Unlike a real demand, an exercise never stops
+// anything the output excludes.  The caller must hold relayMutex.
+func (l *Logic) exerciseBlocked(name string) string {
+	if reason := l.excluded(name); "" != reason {
+		return reason
+	}
+	for _, v := range l.opts.Interlocks {
+		if name == v.Excludes && l.relayOn(v.Output) {
+			return fmt.Sprintf("%s excludes %s which is running", v.Output, name)
+		}
+	}
+	return ""
+}
+
+// exerciseStep exercises any of the outputs that have been idle too long if
+// it is time to.
+func (l *Logic) exerciseStep(now time.Time) {
+	e := l.exercise
+	opts := e.opts
+
+	at := opts.At.On(now)
+	inWindow := false == now.Before(at) && now.Before(at.Add(exerciseWindow))
+
+	for _, name := range opts.Outputs {
+		o, ok := l.outputs[name]
+		if false == ok {
+			continue
+		}
+
+		l.relayMutex.Lock()
+		on := l.relayOn(name)
+		blocked := l.exerciseBlocked(name)
+		for _, v := range l.opts.Interlocks {
+			if name == v.Output && "" != v.Requires && "" == blocked {
+				blocked = l.exerciseBlocked(v.Requires)
+			}
+		}
+		l.relayMutex.Unlock()
+
+		e.mutex.Lock()
+		last, seen := e.active[name]
+		if on || false == seen {
+			// Time starts counting from when the pump was first seen.
+			e.active[name] = now
+			last = now
+		}
+		e.mutex.Unlock()
+
+		if on || false == inWindow || now.Sub(last) < opts.Interval {
+			continue
+		}
+		if "" != blocked {
+			fmt.Printf("Exercise: %s waiting: %s\n", name, blocked)
+			continue
+		}
+
+		until := now.Add(opts.RunTime)
+		result := o.thing.NeededUntil(exerciseClaim, until)
+		if Rejected == result.Outcome {
+			fmt.Printf("Exercise: %s rejected: %s\n", name, result.Reason)
+			continue
+		}
+
+		fmt.Printf("Exercise: running %s until %s (%s)\n", name, until.Format(time.Kitchen), result.Outcome)
+		l.exerciseCounter.Inc()
+		l.history.add("exercise."+name, now, 1)
+
+		e.mutex.Lock()
+		e.active[name] = now
+		e.runs = append(e.runs, ExerciseRun{Output: name, Start: now, Until: until})
+		if len(e.runs) > maxExerciseRuns {
+			e.runs = e.runs[len(e.runs)-maxExerciseRuns:]
+		}
+		e.mutex.Unlock()
+	}
+}
+
+// Exercises returns the recent pump exercise runs, oldest first.
+func (l *Logic) Exercises() []ExerciseRun {
+	l.exercise.mutex.Lock()
+	defer l.exercise.mutex.Unlock()
+
+	return append([]ExerciseRun{}, l.exercise.runs...)
+}
+
+// pumpExercise keeps idle pumps from seizing by running them briefly once
+// they have sat idle for the interval.
+func (l *Logic) pumpExercise() {
+	defer l.wg.Done()
+
+	t := l.clock.NewTicker(time.Minute)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			l.exerciseStep(now)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPumpExercise(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{
+		Interlocks: []Interlock{
+			{Output: "ex_zone", Requires: "ex_loop"},
+			{Output: "ex_fan", Excludes: "ex_loop"},
+		},
+		Exercise: ExerciseOpts{
+			Interval: time.Hour * 48,
+			At:       MustTimeOfDay("10:00"),
+			Outputs:  []string{"ex_loop", "ex_zone"},
+		},
+	}, nil)
+	loop := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ex_loop"}, 1)
+	zone := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ex_zone"}, 2)
+	fan := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ex_fan"}, 4)
+	l.checkInterlocks()
+
+	relay := func(name string) bool {
+		l.relayMutex.Lock()
+		defer l.relayMutex.Unlock()
+		return l.relayOn(name)
+	}
+	sync := func() {
+		loop.State()
+		zone.State()
+		fan.State()
+	}
+
+	l.exerciseStep(clock.Now())
+	assert.Empty(l.Exercises())
+
+	// Idle long enough, but not the time of day yet.
+	clock.Advance(time.Hour * 57)
+	l.exerciseStep(clock.Now())
+	assert.Empty(l.Exercises())
+
+	// 10:00 on the third day.
+	clock.Advance(time.Hour)
+	l.exerciseStep(clock.Now())
+	sync()
+	runs := l.Exercises()
+	if assert.Len(runs, 2) {
+		assert.Equal("ex_loop", runs[0].Output)
+		assert.Equal("ex_zone", runs[1].Output)
+		assert.Equal(clock.Now().Add(time.Second*30), runs[0].Until)
+	}
+	assert.True(relay("ex_loop"))
+	assert.True(relay("ex_zone"))
+
+	clock.Advance(time.Second * 30)
+	sync()
+	assert.False(relay("ex_loop"))
+	assert.False(relay("ex_zone"))
+
+	// A pump that ran on its own isn't exercised.
+	clock.Advance(time.Hour * 24)
+	zone.OnUntil(clock.Now().Add(time.Minute))
+	sync()
+	l.exerciseStep(clock.Now())
+	clock.Advance(time.Minute)
+	sync()
+	assert.False(relay("ex_zone"))
+
+	clock.Advance(time.Hour * 24)
+	l.exerciseStep(clock.Now())
+	assert.Len(l.Exercises(), 2)
+
+	// The fan excludes the loop, so both wait for it to stop.
+	clock.Advance(time.Hour * 48)
+	fan.OnUntil(clock.Now().Add(time.Hour))
+	sync()
+	l.exerciseStep(clock.Now())
+	assert.Len(l.Exercises(), 2)
+	assert.False(relay("ex_loop"))
+
+	fan.Off()
+	sync()
+	clock.Advance(time.Minute)
+	l.exerciseStep(clock.Now())
+	runs = l.Exercises()
+	if assert.Len(runs, 4) {
+		assert.Equal("ex_loop", runs[2].Output)
+		assert.Equal("ex_zone", runs[3].Output)
+	}
+	clock.Advance(time.Second * 30)
+	sync()
+
+	// Outside the window nothing happens.
+	clock.Advance(time.Hour*24*3 + time.Hour*2)
+	l.exerciseStep(clock.Now())
+	assert.Len(l.Exercises(), 4)
+
+	assert.Equal([]string{"exercise.ex_loop", "exercise.ex_zone"}, l.history.Names())
+
+	loop.Shutdown()
+	zone.Shutdown()
+	fan.Shutdown()
+}
+
+func TestPumpExerciseNoHeat(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	sensors.clock = clock
+
+	l := newTestLogic(clock, LogicOpts{
+		Interlocks: []Interlock{
+			{Output: "exh_burner", Requires: "exh_loop"},
+		},
+		Exercise: ExerciseOpts{
+			Interval: time.Hour * 24,
+			At:       MustTimeOfDay("10:00"),
+			Outputs:  []string{"exh_loop"},
+		},
+	}, sensors)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "exh_loop"}, 1)
+	l.heatSource = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "exh_burner"}, 16)
+	l.checkInterlocks()
+	hs := newHeatSourceState(HeatSourceOpts{Bit: 16, SupplySensor: "supply"})
+
+	l.exerciseStep(clock.Now())
+	clock.Advance(time.Hour * 34)
+	l.exerciseStep(clock.Now())
+	assert.Len(l.Exercises(), 1)
+
+	// The loop runs for its exercise but the burner stays off.
+	sensors.Set("supply", 120)
+	l.heatSourceStep(clock.Now(), hs)
+	on, _ := l.heaterLoopPump.State()
+	assert.True(on)
+	on, _ = l.heatSource.State()
+	assert.False(on)
+
+	l.heaterLoopPump.Shutdown()
+	l.heatSource.Shutdown()
+}
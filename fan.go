@@ -0,0 +1,158 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type FanOpts struct {
+	// The indoor temperature (F) above which the house should be cooled.
+	// Zero disables the automatic cooling.
+	ComfortTemp float64
+
+	// How much cooler (F) it must be outside than inside before the fan
+	// is run.  The default is 3F.
+	MinDelta float64
+
+	// How far (F) past the start conditions things must go before the fan
+	// stops.  The default is 1F.
+	Hysteresis float64
+
+	// The name of the TempSensors sensor used as the indoor temperature.
+	// The default is "downstairs_main".
+	IndoorSensor string
+
+	// The times of day the fan may run automatically.  If empty the fan
+	// may run at any time.
+	Windows DailyWindows
+
+	// The longest the fan runs automatically before resting.  It rests
+	// until the end of the window, or as long as it ran if there are no
+	// windows.  The default is no limit.
+	MaxRunTime time.Duration
+}
+
+// heating returns if any part of the heating system is running.
+func (l *Logic) heating() bool {
+	for _, v := range []OnOffThing{l.heaterLoopPump, l.downstairsHeatPump, l.upstairsHeatPump} {
+		if on, _ := v.State(); on {
+			return true
+		}
+	}
+	return false
+}
+
+// fanClaim is the automatic cooling's claim on the fan, so stopping it
+// never cancels a run asked for with Fan().
+const fanClaim = "cooling"
+
+// fanState is what fanStep remembers between steps.
+type fanState struct {
+	running   bool
+	started   time.Time
+	restUntil time.Time
+}
+
+// fanAutomation runs the whole house fan to cool the house when it is
+// cooler outside than inside.  The fan is never run automatically while
+// any heating is running.
+func (l *Logic) fanAutomation() {
+	defer l.wg.Done()
+
+	var s fanState
+
+	t := l.clock.NewTicker(time.Second)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			l.fanStep(now, &s)
+		}
+	}
+}
+
+// fanStep starts, keeps running or stops the automatic cooling.
+func (l *Logic) fanStep(now time.Time, s *fanState) {
+	opts := l.opts.Fan
+	if 0 == opts.MinDelta {
+		opts.MinDelta = 3
+	}
+	if 0 == opts.Hysteresis {
+		opts.Hysteresis = 1
+	}
+	if "" == opts.IndoorSensor {
+		opts.IndoorSensor = "downstairs_main"
+	}
+
+	stop := func(why string) {
+		if s.running {
+			fmt.Printf("Whole house fan: stopping, %s\n", why)
+			l.wholeHouseFan.Release(fanClaim)
+			s.running = false
+		}
+	}
+
+	indoor, iok := reading(l.tempSensors, opts.IndoorSensor)
+	outdoor, ook := l.outdoorTemp()
+
+	if false == iok || false == ook {
+		stop("temperatures unknown")
+		return
+	}
+	if l.heating() {
+		stop("heating is running")
+		return
+	}
+
+	end, inWindow := now, true
+	if 0 < len(opts.Windows) {
+		end, inWindow = opts.Windows.Until(now)
+	}
+	if false == inWindow {
+		stop("outside the window")
+		return
+	}
+
+	if s.running {
+		if indoor < opts.ComfortTemp-opts.Hysteresis ||
+			outdoor > indoor-opts.MinDelta+opts.Hysteresis {
+			stop("cooling is no longer helping")
+			return
+		}
+		if 0 < opts.MaxRunTime && now.Sub(s.started) >= opts.MaxRunTime {
+			stop("maximum run time reached")
+			s.restUntil = now.Add(opts.MaxRunTime)
+			if 0 < len(opts.Windows) {
+				s.restUntil = end
+			}
+			return
+		}
+	} else {
+		if now.Before(s.restUntil) ||
+			indoor <= opts.ComfortTemp ||
+			outdoor > indoor-opts.MinDelta {
+			return
+		}
+		fmt.Printf("Whole house fan: starting, indoor %.1fF outdoor %.1fF\n", indoor, outdoor)
+		s.running = true
+		s.started = now
+	}
+
+	l.wholeHouseFan.NeededUntil(fanClaim, now.Add(time.Minute))
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOutdoor struct {
+	temp float64
+}
+
+func (f *fakeOutdoor) Get() (float64, bool) { return f.temp, true }
+func (f *fakeOutdoor) Shutdown()            {}
+
+func TestFanAutomation(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	outdoor := &fakeOutdoor{temp: 70}
+
+	l := newTestLogic(clock, LogicOpts{
+		Fan: FanOpts{
+			ComfortTemp: 74,
+			Windows: DailyWindows{
+				{Start: MustTimeOfDay("18:00"), End: MustTimeOfDay("06:00")},
+			},
+			MaxRunTime: time.Hour * 2,
+		},
+	}, sensors)
+	l.outdoor = outdoor
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fa_loop"}, 1)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fa_downstairs"}, 2)
+	l.upstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fa_upstairs"}, 4)
+	l.wholeHouseFan = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fa_fan"}, 8)
+
+	var s fanState
+	cooling := func() bool {
+		for _, c := range l.wholeHouseFan.Claims() {
+			if fanClaim == c.Name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Not above the comfort temperature.
+	sensors.Set("downstairs_main", 74)
+	l.fanStep(clock.Now(), &s)
+	assert.False(cooling())
+
+	// Not cool enough outside.
+	sensors.Set("downstairs_main", 78)
+	outdoor.temp = 76
+	l.fanStep(clock.Now(), &s)
+	assert.False(cooling())
+
+	outdoor.temp = 70
+	l.fanStep(clock.Now(), &s)
+	assert.True(cooling())
+
+	// Stopping the cooling leaves a manual run alone.
+	l.Fan(clock.Now().Add(time.Hour * 3))
+	clock.Advance(time.Minute)
+	sensors.Set("downstairs_main", 72)
+	l.fanStep(clock.Now(), &s)
+	assert.False(cooling())
+	on, _ := l.wholeHouseFan.State()
+	assert.True(on)
+	l.wholeHouseFan.Off()
+
+	// Heating running stops it.
+	sensors.Set("downstairs_main", 78)
+	l.fanStep(clock.Now(), &s)
+	assert.True(cooling())
+	l.heaterLoopPump.OnUntil(clock.Now().Add(time.Minute))
+	l.fanStep(clock.Now(), &s)
+	assert.False(cooling())
+	clock.Advance(time.Minute)
+
+	// After the maximum run time it rests until the end of the window.
+	l.fanStep(clock.Now(), &s)
+	assert.True(cooling())
+	for i := 0; i < 120; i++ {
+		clock.Advance(time.Minute)
+		l.fanStep(clock.Now(), &s)
+	}
+	assert.False(cooling())
+	clock.Advance(time.Hour)
+	l.fanStep(clock.Now(), &s)
+	assert.False(cooling())
+
+	// Outside the window it doesn't run.
+	clock.Set(time.Date(2019, 1, 7, 12, 0, 0, 0, time.UTC))
+	l.fanStep(clock.Now(), &s)
+	assert.False(cooling())
+
+	// The next window.
+	clock.Set(time.Date(2019, 1, 7, 18, 0, 0, 0, time.UTC))
+	l.fanStep(clock.Now(), &s)
+	assert.True(cooling())
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+	l.upstairsHeatPump.Shutdown()
+	l.wholeHouseFan.Shutdown()
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type FreezeOpts struct {
+	// Below this temperature (F) on any sensor the heat is forced on.  nil
+	// means 40F.
+	Floor *float64
+
+	// Per sensor floors (F) that override Floor, for example a garage
+	// sensor that normally reads colder than the house.  A very low floor
+	// effectively ignores a sensor, like the outdoor one.
+	Floors map[string]float64
+
+	// Maps a sensor name to the zones ("downstairs", "upstairs") that heat
+	// the area it measures.  The heater loop pump is always forced on; the
+	// zone pumps are only forced on for the sensors listed here.
+	Zones map[string][]string
+
+	// How long the pumps are forced on each time a sensor is below the
+	// floor.  The check repeats every 10 seconds so the pumps stay on until
+	// all the sensors are above their floors.  The default is 5 minutes.
+	RunTime time.Duration
+}
+
+// freezeClaim is freeze protection's claim on the pumps.
+const freezeClaim = "freeze"
+
+// freezeProtection watches every temperature sensor and forces the heat on
+// when any of them are below their floor.  It ignores the user targets, the
+// schedules and the warm weather shutdown.
+func (l *Logic) freezeProtection() {
+	defer l.wg.Done()
+
+	freezing := make(map[string]bool)
+
+	t := l.clock.NewTicker(time.Second * 10)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			l.freezeStep(now, freezing)
+		}
+	}
+}
+
+// freezeStep forces the heat on for the sensors below their floor.  freezing
+// holds the sensors that were below their floor at the last step.
+func (l *Logic) freezeStep(now time.Time, freezing map[string]bool) {
+	floor := 40.0
+	if nil != l.opts.Freeze.Floor {
+		floor = *l.opts.Freeze.Floor
+	}
+	runTime := l.opts.Freeze.RunTime
+	if 0 == runTime {
+		runTime = time.Minute * 5
+	}
+
+	for _, name := range (*l.tempSensors).Names() {
+		min := floor
+		if v, ok := l.opts.Freeze.Floors[name]; ok {
+			min = v
+		}
+
+		temp, ok := reading(l.tempSensors, name)
+		if false == ok || temp >= min {
+			if freezing[name] {
+				fmt.Printf("Freeze protection: %s recovered at %.1fF\n", name, temp)
+				delete(freezing, name)
+			}
+			continue
+		}
+
+		if false == freezing[name] {
+			fmt.Printf("Freeze protection: %s is %.1fF, below %.1fF\n", name, temp, min)
+			freezing[name] = true
+			l.freezeCounter.Inc()
+		}
+
+		until := now.Add(runTime)
+		l.heaterLoopPump.NeededUntil(freezeClaim, until)
+		for _, zone := range l.opts.Freeze.Zones[name] {
+			if pump := l.zonePump(zone); nil != pump {
+				pump.NeededUntil(freezeClaim, until)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreezeProtection(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	l := newTestLogic(clock, LogicOpts{
+		Freeze: FreezeOpts{
+			Floors: map[string]float64{"garage": 32},
+			Zones:  map[string][]string{"bedroom": {"upstairs", "attic"}},
+		},
+	}, sensors)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fz_loop"}, 1)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fz_downstairs"}, 2)
+	l.upstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "fz_upstairs"}, 4)
+
+	sensors.Set("bedroom", 41)
+	sensors.Set("garage", 35)
+	sensors.Set("outdoor", -1000)
+
+	// Above the default floor and the garage's own floor.
+	freezing := make(map[string]bool)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Empty(l.heaterLoopPump.Claims())
+	assert.Empty(freezing)
+
+	// The garage only runs the loop.
+	sensors.Set("garage", 31)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Equal([]OnOffClaim{{Name: "freeze", Until: clock.Now().Add(time.Minute * 5)}}, l.heaterLoopPump.Claims())
+	assert.Empty(l.upstairsHeatPump.Claims())
+	assert.Empty(l.downstairsHeatPump.Claims())
+	assert.Equal(map[string]bool{"garage": true}, freezing)
+
+	// The bedroom runs its zone too and unknown zones are skipped.
+	sensors.Set("bedroom", 39)
+	clock.Advance(time.Second * 10)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Equal([]OnOffClaim{{Name: "freeze", Until: clock.Now().Add(time.Minute * 5)}}, l.upstairsHeatPump.Claims())
+	assert.Empty(l.downstairsHeatPump.Claims())
+	assert.Equal(map[string]bool{"bedroom": true, "garage": true}, freezing)
+
+	// Staying cold keeps renewing the claims.
+	clock.Advance(time.Second * 10)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Equal(clock.Now().Add(time.Minute*5), l.heaterLoopPump.Claims()[0].Until)
+
+	// Once recovered the pumps are held on for the rest of the run time.
+	sensors.Set("garage", 33)
+	sensors.Set("bedroom", 41)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Empty(freezing)
+	clock.Advance(time.Minute*5 - time.Second)
+	assert.Len(l.heaterLoopPump.Claims(), 1)
+	assert.Len(l.upstairsHeatPump.Claims(), 1)
+	clock.Advance(time.Second)
+	assert.Empty(l.heaterLoopPump.Claims())
+	assert.Empty(l.upstairsHeatPump.Claims())
+
+	// A floor of 0F can be set.
+	floor := 0.0
+	l.opts.Freeze.Floor = &floor
+	sensors.Set("bedroom", 1)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Empty(l.heaterLoopPump.Claims())
+	sensors.Set("bedroom", -1)
+	l.freezeStep(clock.Now(), freezing)
+	assert.Len(l.heaterLoopPump.Claims(), 1)
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+	l.upstairsHeatPump.Shutdown()
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The heater loop pump claim the heat source uses to keep water moving
+// while the burner fires and for the post purge after.
+const purgeClaim = "purge"
+
+type HeatSourceOpts struct {
+	// The relay bit that calls for the boiler or water heater to fire.  If
+	// 0 the heat source is only monitored.
+	Bit int
+
+	// The names of the TempSensors sensors on the heat source supply and
+	// return lines.
+	SupplySensor string
+	ReturnSensor string
+
+	// How old a supply or return reading may be before the heat source is
+	// shut down as faulted.  The default is 30 seconds.
+	MaxAge time.Duration
+
+	// The supply temperature (F) the burner is stopped at.  The default is
+	// 180F.
+	HighLimit float64
+
+	// How far (F) below HighLimit the supply must cool before the burner
+	// fires again.  The default is 10F.
+	Hysteresis float64
+
+	// How long the heater loop pump keeps running after the burner stops
+	// to move the heat left in the heat exchanger out to the loads.  The
+	// default is 2 minutes.
+	PostPurge time.Duration
+}
+
+// heatSourceState is what the heat source control remembers between steps.
+type heatSourceState struct {
+	opts HeatSourceOpts
+
+	// If the supply has reached the high limit and not cooled off yet.
+	limited bool
+
+	// If the supply or return sensor had no fresh reading last time.
+	faulted bool
+}
+
+func newHeatSourceState(opts HeatSourceOpts) *heatSourceState {
+	if 0 == opts.HighLimit {
+		opts.HighLimit = 180
+	}
+	if 0 == opts.Hysteresis {
+		opts.Hysteresis = 10
+	}
+	if 0 == opts.PostPurge {
+		opts.PostPurge = time.Minute * 2
+	}
+	if 0 == opts.MaxAge {
+		opts.MaxAge = time.Second * 30
+	}
+	return &heatSourceState{opts: opts}
+}
+
+// wantsHeat returns if a heater loop claim is a call for heat.  The purge
+// and pump exercise only need the water moving.
+func wantsHeat(claim string) bool {
+	return purgeClaim != claim && exerciseClaim != claim
+}
+
+// loopDemand returns if anything needs heat from the heater loop.
+func (l *Logic) loopDemand() bool {
+	for _, c := range l.heaterLoopPump.Claims() {
+		if wantsHeat(c.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// heatSourceControl fires the heat source while there is demand on the
+// heater loop and the supply is below the high limit.
+func (l *Logic) heatSourceControl() {
+	defer l.wg.Done()
+
+	hs := newHeatSourceState(l.opts.HeatSource)
+	t := l.clock.NewTicker(time.Second)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			l.heatSourceStep(now, hs)
+		}
+	}
+}
+
+func (l *Logic) heatSourceStep(now time.Time, hs *heatSourceState) {
+	opts := hs.opts
+
+	supply, supplyOk := freshReading(l.tempSensors, opts.SupplySensor, now, opts.MaxAge)
+	ret, retOk := freshReading(l.tempSensors, opts.ReturnSensor, now, opts.MaxAge)
+	if supplyOk && retOk {
+		l.deltaTGauge.Set(supply - ret)
+	}
+
+	if supplyOk {
+		if supply >= opts.HighLimit && false == hs.limited {
+			fmt.Printf("Heat source: supply is %.1fF, at the %.1fF high limit\n", supply, opts.HighLimit)
+			hs.limited = true
+			l.highLimitCounter.Inc()
+		} else if supply < opts.HighLimit-opts.Hysteresis && hs.limited {
+			fmt.Printf("Heat source: supply cooled to %.1fF\n", supply)
+			hs.limited = false
+		}
+	}
+
+	// Without fresh supply and return readings the high limit can't be
+	// enforced, so the burner and the pump are stopped until they return.
+	var stale []string
+	if "" != opts.SupplySensor && false == supplyOk {
+		stale = append(stale, opts.SupplySensor)
+	}
+	if "" != opts.ReturnSensor && false == retOk {
+		stale = append(stale, opts.ReturnSensor)
+	}
+	faulted := 0 < len(stale)
+	l.anomalyMutex.Lock()
+	l.flag("heat_source_sensor", faulted, now,
+		fmt.Sprintf("no reading from %s for %s", strings.Join(stale, ", "), opts.MaxAge))
+	l.anomalyMutex.Unlock()
+	started := faulted && false == hs.faulted
+	hs.faulted = faulted
+
+	if nil == l.heatSource {
+		return
+	}
+
+	if started {
+		l.heaterLoopPump.ForceOff()
+	}
+	if hs.limited || hs.faulted {
+		if on, _ := l.heatSource.State(); on {
+			l.heatSource.ForceOff()
+		}
+		return
+	}
+
+	if false == l.loopDemand() {
+		if on, _ := l.heatSource.State(); on {
+			l.heatSource.Off()
+		}
+		return
+	}
+
+	// The purge claim runs out PostPurge after the burner stops.  The short
+	// call means the burner stops quickly if this ever stops running.
+	l.heaterLoopPump.NeededUntil(purgeClaim, now.Add(opts.PostPurge))
+	l.heatSource.OnUntil(now.Add(time.Second * 5))
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSensors is a TempSensors with readings set by the test.  Readings are
+// timestamped with the clock if there is one.
+type fakeSensors struct {
+	mutex    sync.Mutex
+	readings map[string]float64
+	lastRead map[string]time.Time
+	clock    Clock
+}
+
+func newFakeSensors() *fakeSensors {
+	return &fakeSensors{
+		readings: make(map[string]float64),
+		lastRead: make(map[string]time.Time),
+	}
+}
+
+func (f *fakeSensors) Set(name string, temp float64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.readings[name] = temp
+	if nil != f.clock && -1000 != temp {
+		f.lastRead[name] = f.clock.Now()
+	}
+}
+
+func (f *fakeSensors) LastRead(name string) time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lastRead[name]
+}
+
+func (f *fakeSensors) Get(name string) float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if v, ok := f.readings[name]; ok {
+		return v
+	}
+	return -1000
+}
+
+func (f *fakeSensors) Names() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var list []string
+	for name := range f.readings {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (f *fakeSensors) Shutdown() {}
+
+func TestHeatSource(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	sensors.clock = clock
+
+	l := newTestLogic(clock, LogicOpts{Interlocks: []Interlock{
+		{Output: "hs_burner", Requires: "hs_loop"},
+	}}, sensors)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "hs_loop"}, 1)
+	l.heatSource = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "hs_burner"}, 16)
+	l.checkInterlocks()
+
+	hs := newHeatSourceState(HeatSourceOpts{
+		Bit:          16,
+		SupplySensor: "supply",
+		ReturnSensor: "return",
+	})
+	burner := func() bool {
+		on, _ := l.heatSource.State()
+		return on
+	}
+
+	// No demand, no fire.
+	sensors.Set("supply", 120)
+	sensors.Set("return", 100)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.False(burner())
+
+	// A zone needs the loop so the burner fires along with the loop.
+	l.heaterLoopPump.NeededUntil("downstairs", clock.Now().Add(time.Minute))
+	l.heatSourceStep(clock.Now(), hs)
+	assert.True(burner())
+	assert.Equal(17, l.controlBitMask)
+
+	// High limit.
+	sensors.Set("supply", 181)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.False(burner())
+	sensors.Set("supply", 175)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.False(burner())
+	sensors.Set("supply", 169)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.True(burner())
+
+	// No supply reading, no fire and no pump.
+	sensors.Set("supply", -1000)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.False(burner())
+	assert.Equal(0, l.controlBitMask)
+	sensors.Set("supply", 150)
+	l.heaterLoopPump.NeededUntil("downstairs", clock.Now().Add(time.Minute))
+	l.heatSourceStep(clock.Now(), hs)
+	assert.True(burner())
+
+	// A stale return reading stops the burner and the pump and flags the
+	// fault until the readings come back.
+	clock.Advance(time.Second * 20)
+	sensors.Set("supply", 150)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.True(burner())
+	clock.Advance(time.Second * 11)
+	sensors.Set("supply", 150)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.False(burner())
+	on, _ := l.heaterLoopPump.State()
+	assert.False(on)
+	if assert.Len(l.Anomalies(), 1) {
+		assert.Equal("heat_source_sensor", l.Anomalies()[0].Name)
+		assert.Contains(l.Anomalies()[0].Message, "return")
+	}
+
+	l.heaterLoopPump.NeededUntil("downstairs", clock.Now().Add(time.Minute))
+	sensors.Set("return", 130)
+	l.heatSourceStep(clock.Now(), hs)
+	assert.True(burner())
+	assert.Empty(l.Anomalies())
+
+	// The demand ends; the burner stops and the loop purges.
+	l.heaterLoopPump.Release("downstairs")
+	l.heatSourceStep(clock.Now(), hs)
+	assert.False(burner())
+	on, until := l.heaterLoopPump.State()
+	assert.True(on)
+	assert.Equal(clock.Now().Add(time.Minute*2), until)
+
+	clock.Advance(time.Minute * 2)
+	on, _ = l.heaterLoopPump.State()
+	assert.False(on)
+
+	l.heatSource.Shutdown()
+	l.heaterLoopPump.Shutdown()
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+type HistoryOpts struct {
+	// How often the values are sampled.  The default is 10 seconds.
+	SamplePeriod time.Duration
+
+	// Where the history is saved so it survives restarts.  If empty it is
+	// only kept in memory.
+	File string
+}
+
+// HistoryPoint is the average of a series over a step starting at T (Unix
+// seconds).
+type HistoryPoint struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// historyTiers are the resolutions each series is kept at.  Each tier is a
+// ring buffer so the store never grows.
+var historyTiers = []struct {
+	step  time.Duration
+	count int
+}{
+	{time.Minute, 24 * 60},
+	{time.Minute * 10, 7 * 24 * 6},
+	{time.Hour, 90 * 24},
+}
+
+type historyTier struct {
+	Step   time.Duration  `json:"step"`
+	Points []HistoryPoint `json:"points"`
+	Next   int            `json:"next"`
+
+	// The step being filled.
+	Start int64   `json:"start"`
+	Sum   float64 `json:"sum"`
+	Count int     `json:"count"`
+}
+
+type historySeries struct {
+	Tiers []*historyTier `json:"tiers"`
+}
+
+// historyStore is a small time series store of downsampled ring buffers.
+type historyStore struct {
+	series map[string]*historySeries
+	mutex  sync.Mutex
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{series: make(map[string]*historySeries)}
+}
+
+func (h *historyStore) add(name string, when time.Time, v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[name]
+	if false == ok {
+		s = &historySeries{}
+		for _, v := range historyTiers {
+			s.Tiers = append(s.Tiers, &historyTier{Step: v.step})
+		}
+		h.series[name] = s
+	}
+
+	for i, t := range s.Tiers {
+		start := when.Truncate(t.Step).Unix()
+		if start != t.Start && 0 < t.Count {
+			t.push(HistoryPoint{T: t.Start, V: t.Sum / float64(t.Count)}, historyTiers[i].count)
+			t.Sum, t.Count = 0, 0
+		}
+		t.Start = start
+		t.Sum += v
+		t.Count++
+	}
+}
+
+func (t *historyTier) push(p HistoryPoint, max int) {
+	if len(t.Points) < max {
+		t.Points = append(t.Points, p)
+		return
+	}
+	t.Points[t.Next] = p
+	t.Next = (t.Next + 1) % max
+}
+
+// valid returns if a loaded tier fits the i'th of historyTiers.
+func (t *historyTier) valid(i int) bool {
+	if nil == t || t.Step != historyTiers[i].step || len(t.Points) > historyTiers[i].count {
+		return false
+	}
+	if t.Count < 0 || t.Next < 0 {
+		return false
+	}
+
+	// Next only moves once the ring is full.
+	if len(t.Points) < historyTiers[i].count {
+		return 0 == t.Next
+	}
+	return t.Next < len(t.Points)
+}
+
+// points returns the points oldest first, including the step being filled.
+func (t *historyTier) points() []HistoryPoint {
+	list := append([]HistoryPoint{}, t.Points[t.Next:]...)
+	list = append(list, t.Points[:t.Next]...)
+	if 0 < t.Count {
+		list = append(list, HistoryPoint{T: t.Start, V: t.Sum / float64(t.Count)})
+	}
+	return list
+}
+
+// Names returns the names of the series, sorted.
+func (h *historyStore) Names() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var list []string
+	for name := range h.series {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Query returns the points of the series between from and to at the finest
+// resolution that goes back far enough.
+func (h *historyStore) Query(name string, from, to, now time.Time) []HistoryPoint {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[name]
+	if false == ok {
+		return nil
+	}
+
+	tier := s.Tiers[len(s.Tiers)-1]
+	for i, t := range s.Tiers {
+		if false == now.Add(-t.Step*time.Duration(historyTiers[i].count)).After(from) {
+			tier = t
+			break
+		}
+	}
+
+	list := []HistoryPoint{}
+	for _, p := range tier.points() {
+		when := time.Unix(p.T, 0)
+		if false == when.Add(tier.Step).After(from) || when.After(to) {
+			continue
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+func (h *historyStore) load(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if nil != err {
+		return err
+	}
+
+	series := make(map[string]*historySeries)
+	if err = json.Unmarshal(buf, &series); nil != err {
+		return err
+	}
+
+	// Drop anything saved with different tiers or that is damaged.
+	for name, s := range series {
+		if nil == s || len(s.Tiers) != len(historyTiers) {
+			fmt.Printf("History: discarding '%s' from %s\n", name, file)
+			delete(series, name)
+			continue
+		}
+		for i, t := range s.Tiers {
+			if false == t.valid(i) {
+				fmt.Printf("History: discarding '%s' from %s\n", name, file)
+				delete(series, name)
+				break
+			}
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.series = series
+	return nil
+}
+
+func (h *historyStore) save(file string) error {
+	h.mutex.Lock()
+	buf, err := json.Marshal(h.series)
+	h.mutex.Unlock()
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(file, buf, 0644)
+}
+
+// History returns the points of the named series between from and to.
+func (l *Logic) History(name string, from, to time.Time) []HistoryPoint {
+	return l.history.Query(name, from, to, l.clock.Now())
+}
+
+// HistoryNames returns the names of the recorded series.
+func (l *Logic) HistoryNames() []string {
+	return l.history.Names()
+}
+
+// recordFlow adds gallons to the named flow total used for the history.
+func (l *Logic) recordFlow(name string, gallons float64) {
+	l.flowMutex.Lock()
+	l.flowTotals[name] += gallons
+	if "loop" == name {
+		l.lastLoopFlow = l.clock.Now()
+	}
+	l.flowMutex.Unlock()
+}
+
+// sampleHistory records the temperatures, targets, outputs and flow rates.
+func (l *Logic) sampleHistory(now time.Time, flows map[string]float64, elapsed time.Duration) {
+	if nil != l.tempSensors && nil != *l.tempSensors {
+		for _, name := range (*l.tempSensors).Names() {
+			if temp, ok := reading(l.tempSensors, name); ok {
+				l.history.add("temp."+name, now, temp)
+			}
+		}
+	}
+
+	l.downstairsMutex.Lock()
+	target := l.downstairsTemp
+	l.downstairsMutex.Unlock()
+	l.history.add("target.downstairs", now, l.modeTarget(now, target))
+
+	l.relayMutex.Lock()
+	for _, name := range l.outputNames {
+		on := 0.0
+		if l.relayOn(name) {
+			on = 1.0
+		}
+		l.history.add("output."+name, now, on)
+	}
+	l.relayMutex.Unlock()
+
+	// Flow is kept in gallons per minute.
+	l.flowMutex.Lock()
+	for name, total := range l.flowTotals {
+		if 0 < elapsed {
+			l.history.add("flow."+name, now, (total-flows[name])/elapsed.Minutes())
+		}
+		flows[name] = total
+	}
+	l.flowMutex.Unlock()
+}
+
+// historySampler samples the history periodically and saves it.
+func (l *Logic) historySampler() {
+	defer l.wg.Done()
+
+	opts := l.opts.History
+	if 0 == opts.SamplePeriod {
+		opts.SamplePeriod = time.Second * 10
+	}
+
+	if "" != opts.File {
+		if err := l.history.load(opts.File); nil != err {
+			fmt.Printf("History: %v\n", err)
+		}
+	}
+
+	flows := make(map[string]float64)
+	t := l.clock.NewTicker(opts.SamplePeriod)
+	last := l.clock.Now()
+	saved := last
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			if "" != opts.File {
+				l.history.save(opts.File)
+			}
+			return
+		case now := <-t.C():
+			l.sampleHistory(now, flows, now.Sub(last))
+			last = now
+
+			if "" != opts.File && now.Sub(saved) > time.Hour {
+				if err := l.history.save(opts.File); nil != err {
+					fmt.Printf("History: %v\n", err)
+				}
+				saved = now
+			}
+		}
+	}
+}
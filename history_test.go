@@ -0,0 +1,110 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryStore(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHistoryStore()
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+
+	// Two samples per minute are averaged.
+	h.add("temp", start, 60)
+	h.add("temp", start.Add(30*time.Second), 62)
+	h.add("temp", start.Add(time.Minute), 64)
+
+	now := start.Add(time.Minute + 30*time.Second)
+	list := h.Query("temp", start, now, now)
+	assert.Equal([]HistoryPoint{
+		{T: start.Unix(), V: 61},
+		{T: start.Add(time.Minute).Unix(), V: 64},
+	}, list)
+	assert.Equal([]string{"temp"}, h.Names())
+	assert.Nil(h.Query("missing", start, now, now))
+
+	// Two days of samples wrap the minute ring so a week long query uses
+	// the 10 minute tier.
+	for when := start.Add(2 * time.Minute); when.Before(start.Add(48 * time.Hour)); when = when.Add(time.Minute) {
+		h.add("temp", when, 70)
+	}
+	now = start.Add(48 * time.Hour)
+	list = h.Query("temp", now.Add(-time.Hour), now, now)
+	assert.Equal(60, len(list))
+	assert.Equal(now.Add(-time.Hour).Unix(), list[0].T)
+
+	list = h.Query("temp", now.Add(-7*24*time.Hour), now, now)
+	assert.Equal(48*6, len(list))
+	assert.Equal(start.Unix(), list[0].T)
+	assert.InDelta((60+62+64+70*8)/11.0, list[0].V, 0.0001)
+
+	// It survives a restart.
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.json")
+
+	assert.Nil(h.save(file))
+	reloaded := newHistoryStore()
+	assert.Nil(reloaded.load(file))
+	assert.Equal(list, reloaded.Query("temp", now.Add(-7*24*time.Hour), now, now))
+}
+
+func TestHistoryLoadCorrupt(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.json")
+
+	h := newHistoryStore()
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	h.add("good", start, 60)
+	h.add("good", start.Add(time.Minute), 61)
+	h.add("bad_next", start, 60)
+	h.add("bad_next", start.Add(time.Minute), 61)
+	h.series["bad_next"].Tiers[0].Next = 5
+	h.add("wrapped", start, 60)
+	h.series["wrapped"].Tiers[0].Points = make([]HistoryPoint, historyTiers[0].count)
+	h.series["wrapped"].Tiers[0].Next = historyTiers[0].count
+	assert.Nil(h.save(file))
+
+	// Series that are missing tiers or null are damaged too.
+	buf, err := ioutil.ReadFile(file)
+	assert.Nil(err)
+	buf = append(buf[:len(buf)-1], []byte(`,"no_tiers":{"tiers":[]},"null":null,"null_tier":{"tiers":[null,null,null]}}`)...)
+	assert.Nil(ioutil.WriteFile(file, buf, 0644))
+
+	reloaded := newHistoryStore()
+	assert.Nil(reloaded.load(file))
+	assert.Equal([]string{"good"}, reloaded.Names())
+	now := start.Add(time.Minute)
+	assert.Equal(h.Query("good", start, now, now), reloaded.Query("good", start, now, now))
+
+	// A file that isn't JSON is an error and leaves the store alone.
+	assert.Nil(ioutil.WriteFile(file, []byte("{not json"), 0644))
+	assert.NotNil(reloaded.load(file))
+	assert.Equal([]string{"good"}, reloaded.Names())
+}
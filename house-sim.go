@@ -0,0 +1,427 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OutdoorProfile returns the outdoor temperature (F) at a time.
+type OutdoorProfile func(time.Time) float64
+
+// DailyOutdoor is an outdoor profile that swings between low at 6am and
+// high at 6pm each day.
+func DailyOutdoor(low, high float64) OutdoorProfile {
+	return func(when time.Time) float64 {
+		hours := float64(when.Hour()) + float64(when.Minute())/60
+		return (low+high)/2 - (high-low)/2*math.Cos((hours-6)/24*2*math.Pi)
+	}
+}
+
+// LoadOutdoorProfile reads a "RFC3339 time,temperature (F)" CSV, for example
+// a week of recorded weather, and interpolates between the samples.
+func LoadOutdoorProfile(r io.Reader) (OutdoorProfile, error) {
+	type sample struct {
+		when time.Time
+		temp float64
+	}
+
+	records, err := csv.NewReader(r).ReadAll()
+	if nil != err {
+		return nil, err
+	}
+
+	var list []sample
+	for _, v := range records {
+		if len(v) < 2 {
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, v[0])
+		if nil != err {
+			return nil, err
+		}
+		temp, err := strconv.ParseFloat(v[1], 64)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, sample{when: when, temp: temp})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].when.Before(list[j].when) })
+
+	return func(when time.Time) float64 {
+		if 0 == len(list) {
+			return 0
+		}
+		i := sort.Search(len(list), func(i int) bool { return false == list[i].when.Before(when) })
+		if 0 == i {
+			return list[0].temp
+		}
+		if len(list) == i {
+			return list[len(list)-1].temp
+		}
+		lo, hi := list[i-1], list[i]
+		f := float64(when.Sub(lo.when)) / float64(hi.when.Sub(lo.when))
+		return lo.temp + (hi.temp-lo.temp)*f
+	}, nil
+}
+
+type ThermalZoneOpts struct {
+	// The name the zone's temperature is reported as, like a TempSensors
+	// name.
+	Sensor string
+
+	// The zone ("downstairs", "upstairs") whose pump heats this area.
+	Zone string
+
+	// How fast the zone loses heat in F per hour for each degree F it is
+	// warmer than outside.
+	Loss float64
+
+	// How fast the zone gains heat in F per hour when the radiant heat is
+	// fully up to temperature.
+	Gain float64
+
+	// The time constant of the radiant heat warming up after the pump
+	// starts and cooling down after it stops.
+	Lag time.Duration
+
+	// The starting temperature (F).
+	Initial float64
+}
+
+type HouseModelOpts struct {
+	Zones []ThermalZoneOpts
+
+	// The outdoor temperature over time.
+	Outdoor OutdoorProfile
+
+	// The step the model is integrated with.  The default is 10 seconds.
+	Step time.Duration
+
+	// The source of time for Run().  The default is the wall clock.
+	Clock Clock
+}
+
+type thermalZone struct {
+	opts ThermalZoneOpts
+	temp float64
+
+	// How much of the radiant heat is being delivered (0-1).
+	emitter float64
+}
+
+// HouseModel is a simple thermal model of the house.  It implements
+// TempSensors so it can stand in for the real sensors; the outdoor
+// temperature is reported as "outdoor".
+type HouseModel struct {
+	opts  HouseModelOpts
+	zones []*thermalZone
+	now   time.Time
+	mutex sync.Mutex
+	done  chan bool
+	wg    sync.WaitGroup
+}
+
+func NewHouseModel(opts HouseModelOpts, start time.Time) *HouseModel {
+	if 0 == opts.Step {
+		opts.Step = 10 * time.Second
+	}
+	if nil == opts.Outdoor {
+		opts.Outdoor = DailyOutdoor(20, 35)
+	}
+	if nil == opts.Clock {
+		opts.Clock = RealClock{}
+	}
+
+	h := &HouseModel{
+		opts: opts,
+		now:  start,
+	}
+	for _, v := range opts.Zones {
+		h.zones = append(h.zones, &thermalZone{opts: v, temp: v.Initial})
+	}
+	return h
+}
+
+// Advance moves the model forward to when.  pump reports if a zone's pump
+// is running.
+func (h *HouseModel) Advance(when time.Time, pump func(zone string) bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for h.now.Before(when) {
+		step := h.opts.Step
+		if when.Sub(h.now) < step {
+			step = when.Sub(h.now)
+		}
+		hours := step.Hours()
+		outdoor := h.opts.Outdoor(h.now)
+
+		for _, z := range h.zones {
+			target := 0.0
+			if nil != pump && pump(z.opts.Zone) {
+				target = 1.0
+			}
+			if 0 < z.opts.Lag {
+				z.emitter += (target - z.emitter) * (1 - math.Exp(-float64(step)/float64(z.opts.Lag)))
+			} else {
+				z.emitter = target
+			}
+
+			z.temp += (z.opts.Gain*z.emitter - z.opts.Loss*(z.temp-outdoor)) * hours
+		}
+		h.now = h.now.Add(step)
+	}
+}
+
+// Run advances the model along with its clock until Shutdown() is called.
+func (h *HouseModel) Run(pump func(zone string) bool) {
+	h.done = make(chan bool)
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		t := h.opts.Clock.NewTicker(time.Second)
+		last := h.opts.Clock.Now()
+		for {
+			select {
+			case <-h.done:
+				t.Stop()
+				return
+			case now := <-t.C():
+				h.mutex.Lock()
+				when := h.now.Add(now.Sub(last))
+				h.mutex.Unlock()
+				h.Advance(when, pump)
+				last = now
+			}
+		}
+	}()
+}
+
+func (h *HouseModel) Shutdown() {
+	if nil != h.done {
+		close(h.done)
+		h.wg.Wait()
+	}
+}
+
+func (h *HouseModel) Get(name string) float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.get(name)
+}
+
+// get returns the named temperature.  The caller must hold the mutex.
+func (h *HouseModel) get(name string) float64 {
+	if "outdoor" == name {
+		return h.opts.Outdoor(h.now)
+	}
+	for _, z := range h.zones {
+		if name == z.opts.Sensor {
+			return z.temp
+		}
+	}
+	return -1000
+}
+
+// LastRead returns the model's time for its sensors, which always read.
+func (h *HouseModel) LastRead(name string) time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if -1000 == h.get(name) {
+		return time.Time{}
+	}
+	return h.now
+}
+
+func (h *HouseModel) Names() []string {
+	list := []string{"outdoor"}
+	for _, z := range h.zones {
+		list = append(list, z.opts.Sensor)
+	}
+	sort.Strings(list)
+	return list
+}
+
+type HouseSimOpts struct {
+	Model HouseModelOpts
+
+	// The downstairs thermostat, setpoint schedule, outdoor reset and house
+	// mode, which are run by the real Logic.  The model's downstairs zone
+	// must report as "downstairs_main" and the outdoor temperature is the
+	// model's "outdoor".
+	Logic LogicOpts
+
+	// The downstairs target (F) until the schedule sets one.
+	Target float64
+
+	Start    time.Time
+	Duration time.Duration
+
+	// How often the thermostat is asked.  The default is 1 minute.
+	Interval time.Duration
+
+	// The namespace of the simulated pumps' metrics.  Each simulation run in
+	// a process needs its own.
+	Namespace string
+}
+
+// HouseSimZoneResult is the outcome for a single zone.
+type HouseSimZoneResult struct {
+	// How long and how far the zone was below its target.
+	DegreeHoursBelow float64
+
+	// The furthest (F) the zone was below and above its target.
+	MaxBelow float64
+	MaxAbove float64
+
+	// How long the zone pump ran and how many times it started.
+	PumpTime time.Duration
+	Starts   int
+
+	// The temperature (F) at the end.
+	Final float64
+}
+
+// newSimLogic returns a Logic with only the pumps and the outdoor
+// temperature the downstairs thermostat needs, and no board.
+func newSimLogic(opts HouseSimOpts, clock Clock, ts *TempSensors) *Logic {
+	lo := opts.Logic
+	lo.Clock = clock
+	lo.Interlocks = nil
+	lo.WallThermostats = nil
+	lo.Levels = nil
+
+	l := &Logic{
+		arduino:     &ArduinoIoBoard{},
+		tempSensors: ts,
+		opts:        lo,
+		clock:       clock,
+		done:        make(chan bool),
+		outputs:     make(map[string]*output),
+		anomaly:     newAnomalyDetector(AnomalyOpts{}),
+		walls:       &wallThermostats{heating: make(map[string]bool)},
+		inputs:      newInputTracker(opts.Namespace, nil),
+		downstairsTempGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "downstairs_target_temp",
+		}),
+		interlockCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "interlock_violations",
+		}),
+	}
+
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{
+		Namespace: opts.Namespace,
+		Name:      "heater_loop_pump",
+	}, 1)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{
+		Namespace: opts.Namespace,
+		Name:      "downstairs_heat_pump",
+	}, 8)
+	l.outdoor = NewOutdoorTemp(OutdoorTempOpts{
+		Namespace: opts.Namespace,
+		Sensor:    "outdoor",
+		Clock:     clock,
+	}, ts)
+
+	l.SetDownstairsTarget(opts.Target)
+	if sp, ok := lo.DownstairsSchedule.Current(opts.Start); ok {
+		l.SetDownstairsTarget(sp.Target)
+	}
+	return l
+}
+
+// SimulateHouse runs the downstairs thermostat of the real Logic against
+// the house model in virtual time so strategies can be compared without
+// waiting on the real house.
+func SimulateHouse(opts HouseSimOpts) *HouseSimZoneResult {
+	if 0 == opts.Interval {
+		opts.Interval = time.Minute
+	}
+	if "" == opts.Namespace {
+		opts.Namespace = "house_sim"
+	}
+
+	clock := NewFakeClock(opts.Start)
+	opts.Model.Clock = clock
+	h := NewHouseModel(opts.Model, opts.Start)
+	var ts TempSensors = h
+
+	l := newSimLogic(opts, clock, &ts)
+	defer func() {
+		l.heaterLoopPump.Shutdown()
+		l.downstairsHeatPump.Shutdown()
+	}()
+
+	thermostat := l.opts.DownstairsThermostat
+	if nil == thermostat {
+		thermostat = &BurstThermostat{}
+	}
+
+	r := &HouseSimZoneResult{}
+	running := false
+	last := opts.Start
+	end := opts.Start.Add(opts.Duration)
+	for now := opts.Start; now.Before(end); now = now.Add(opts.Interval) {
+		l.downstairsStep(thermostat, last, now)
+		last = now
+
+		present := h.Get("downstairs_main")
+		l.downstairsMutex.Lock()
+		target := l.downstairsTemp
+		l.downstairsMutex.Unlock()
+
+		if present < target {
+			r.DegreeHoursBelow += (target - present) * opts.Interval.Hours()
+			r.MaxBelow = math.Max(r.MaxBelow, target-present)
+		} else {
+			r.MaxAbove = math.Max(r.MaxAbove, present-target)
+		}
+
+		// The pump runs until its deadline, which may be part way through
+		// the interval.
+		on, until := l.downstairsHeatPump.State()
+		if on && false == running {
+			r.Starts++
+		}
+		running = on
+
+		next := now.Add(opts.Interval)
+		if on {
+			stop := next
+			if until.Before(next) {
+				stop = until
+			}
+			r.PumpTime += stop.Sub(now)
+			h.Advance(stop, func(zone string) bool { return "downstairs" == zone })
+		}
+		h.Advance(next, nil)
+		clock.Set(next)
+	}
+
+	r.Final = h.Get("downstairs_main")
+	return r
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testHouse = HouseModelOpts{
+	Zones: []ThermalZoneOpts{
+		{
+			Sensor:  "downstairs_main",
+			Zone:    "downstairs",
+			Loss:    0.05,
+			Gain:    6,
+			Lag:     time.Minute * 30,
+			Initial: 68,
+		},
+	},
+	Outdoor: DailyOutdoor(5, 25),
+}
+
+func TestHouseModelCoolsWithoutHeat(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	h := NewHouseModel(testHouse, start)
+	h.Advance(start.Add(72*time.Hour), nil)
+
+	// Without heat the house drifts to the outdoor temperature.
+	assert.InDelta(h.Get("outdoor"), h.Get("downstairs_main"), 10)
+	assert.Equal(-1000.0, h.Get("upstairs_main"))
+	assert.Equal([]string{"downstairs_main", "outdoor"}, h.Names())
+}
+
+func TestSimulateWinterWeek(t *testing.T) {
+	assert := assert.New(t)
+
+	week := func(namespace string, thermostat Thermostat) *HouseSimZoneResult {
+		return SimulateHouse(HouseSimOpts{
+			Model:     testHouse,
+			Logic:     LogicOpts{DownstairsThermostat: thermostat},
+			Target:    68,
+			Start:     time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC),
+			Duration:  7 * 24 * time.Hour,
+			Namespace: namespace,
+		})
+	}
+
+	burst := week(testNamespace("sim_burst"), &BurstThermostat{})
+	deadband := week(testNamespace("sim_deadband"), &DeadbandThermostat{Differential: 1})
+	proportional := week(testNamespace("sim_proportional"), &ProportionalThermostat{Band: 1})
+
+	for _, r := range []*HouseSimZoneResult{burst, deadband, proportional} {
+		// Comfortable all week.
+		assert.True(r.MaxBelow < 1.5, "max below: %f", r.MaxBelow)
+		assert.InDelta(68, r.Final, 2)
+		assert.True(0 < r.PumpTime)
+	}
+
+	// The deadband cycles the pump less often.
+	assert.True(deadband.Starts < burst.Starts, "%d vs %d", deadband.Starts, burst.Starts)
+
+	// Backing off near the target overshoots less.
+	assert.True(proportional.MaxAbove <= burst.MaxAbove, "%f vs %f", proportional.MaxAbove, burst.MaxAbove)
+}
+
+func TestLoadOutdoorProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := LoadOutdoorProfile(strings.NewReader(
+		"2019-01-07T00:00:00Z,10\n2019-01-07T02:00:00Z,20\n"))
+	assert.Nil(err)
+	assert.Equal(10.0, p(time.Date(2019, 1, 6, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(15.0, p(time.Date(2019, 1, 7, 1, 0, 0, 0, time.UTC)))
+	assert.Equal(20.0, p(time.Date(2019, 1, 8, 0, 0, 0, 0, time.UTC)))
+
+	_, err = LoadOutdoorProfile(strings.NewReader("yesterday,10\n"))
+	assert.NotNil(err)
+}
+
+func TestSimulateAway(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	r := SimulateHouse(HouseSimOpts{
+		Model: testHouse,
+		Logic: LogicOpts{
+			Mode: ModeOpts{
+				AwaySetpoint: 60,
+				Schedule: []ModePeriod{
+					{Mode: Away, Start: start, End: start.Add(time.Hour * 48)},
+				},
+			},
+		},
+		Target:    68,
+		Start:     start,
+		Duration:  time.Hour * 36,
+		Namespace: testNamespace("sim_away"),
+	})
+
+	// The Logic holds the house at the away setpoint instead of the target.
+	assert.InDelta(60, r.Final, 1)
+	assert.True(7 < r.MaxBelow, "max below: %f", r.MaxBelow)
+}
@@ -0,0 +1,376 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// InputKind is what is wired to an Arduino input.
+type InputKind int
+
+const (
+	// PulseInput is a meter that changes state for each unit, like the flow
+	// meters.  Every change is a pulse.
+	PulseInput InputKind = iota
+
+	// ContactInput is a switch that stays where it is put, like a door
+	// switch, a float switch or a wall thermostat's call for heat.
+	ContactInput
+
+	// ButtonInput is a momentary switch.  Only presses are events.
+	ButtonInput
+)
+
+func (k InputKind) String() string {
+	switch k {
+	case PulseInput:
+		return "pulse"
+	case ContactInput:
+		return "contact"
+	case ButtonInput:
+		return "button"
+	}
+	return "unknown"
+}
+
+func (k InputKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// FlowMeter is the water a PulseInput meters, 0.1 gallon per pulse.
+type FlowMeter int
+
+const (
+	// NoFlow is an input that isn't a flow meter.
+	NoFlow FlowMeter = iota
+
+	// ColdWaterFlow meters the domestic cold water coming in.
+	ColdWaterFlow
+
+	// HotWaterFlow meters the domestic hot water being used.
+	HotWaterFlow
+
+	// HeaterLoopFlow meters the heater loop.
+	HeaterLoopFlow
+)
+
+type InputOpts struct {
+	// The bit of the board's input byte, which is the Arduino pin (2-7).
+	Bit int
+
+	Kind InputKind
+
+	// The water a PulseInput meters, if any.  The flow meters are counted,
+	// recorded and charged for their heat.
+	Flow FlowMeter
+
+	// The input is active when the pin is low, like a normally closed
+	// switch or an opto-isolator pulling the pin down.
+	Invert bool
+
+	// How long a contact or button must stay in a new state before it
+	// counts.  The board already filters out contact bounce, so this is for
+	// slower chatter.  0 takes every change.
+	Debounce time.Duration
+}
+
+// defaultInputs are the flow meters the board has always had.
+func defaultInputs() map[string]InputOpts {
+	return map[string]InputOpts{
+		"cold_water":  {Bit: ColdWaterIndex, Kind: PulseInput, Flow: ColdWaterFlow},
+		"hot_water":   {Bit: HotWaterIndex, Kind: PulseInput, Flow: HotWaterFlow},
+		"heater_loop": {Bit: HeaterLoopIndex, Kind: PulseInput, Flow: HeaterLoopFlow},
+	}
+}
+
+// InputEvent is a pulse, a contact opening or closing, or a button press.
+type InputEvent struct {
+	Name string
+	Kind InputKind
+	Flow FlowMeter
+
+	// If the input became active.  Pulses and presses are always active.
+	Active bool
+	When   time.Time
+}
+
+// InputStatus is the state of a single input.
+type InputStatus struct {
+	Name   string    `json:"name"`
+	Kind   InputKind `json:"kind"`
+	Bit    int       `json:"bit"`
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since,omitempty"`
+
+	// The pulses, or the times a contact or button became active.
+	Count float64 `json:"count"`
+}
+
+type input struct {
+	name string
+	opts InputOpts
+
+	// The last level read from the board.
+	raw int
+
+	// The debounced state and when it last changed.
+	active bool
+	since  time.Time
+
+	// When the level first differed from the debounced state.
+	changing time.Time
+
+	count float64
+
+	state  prometheus.Gauge
+	events prometheus.Counter
+}
+
+type inputTracker struct {
+	inputs      map[string]*input
+	names       []string
+	subscribers map[string][]func(InputEvent)
+
+	// If the board has reported yet.
+	seen bool
+
+	mutex sync.Mutex
+}
+
+func newInputTracker(namespace string, opts map[string]InputOpts) *inputTracker {
+	t := &inputTracker{
+		inputs:      make(map[string]*input),
+		subscribers: make(map[string][]func(InputEvent)),
+	}
+	for name, o := range opts {
+		in := &input{
+			name: name,
+			opts: o,
+			state: promauto.NewGauge(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "input",
+				Name:      name + "_state",
+				Help:      "the state of the input (0 = inactive, 1 = active)",
+			}),
+		}
+		help := "the count of times the input became active"
+		if PulseInput == o.Kind {
+			help = "the count of pulses from the input"
+		}
+		in.events = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "input",
+			Name:      name + "_events",
+			Help:      help,
+		})
+		t.inputs[name] = in
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+
+	bits := make(map[int]string)
+	for _, name := range t.names {
+		bit := t.inputs[name].opts.Bit
+		if bit < 0 || 7 < bit {
+			fmt.Printf("Inputs: %s uses bit %d which the board doesn't have\n", name, bit)
+		}
+		if other, ok := bits[bit]; ok {
+			fmt.Printf("Inputs: %s and %s both use bit %d\n", other, name, bit)
+		}
+		if in := t.inputs[name]; NoFlow != in.opts.Flow && PulseInput != in.opts.Kind {
+			fmt.Printf("Inputs: %s is a flow meter but not a pulse input\n", name)
+		}
+		bits[bit] = name
+	}
+	return t
+}
+
+// inputOpts returns the configured inputs or the flow meters if there are
+// none.
+func (l *Logic) inputOpts() map[string]InputOpts {
+	if nil == l.opts.Inputs {
+		return defaultInputs()
+	}
+	return l.opts.Inputs
+}
+
+// step reads the input's level and returns the event it causes, if any.
+// The caller must hold the tracker mutex.
+func (in *input) step(level int, now time.Time) (InputEvent, bool) {
+	last := in.raw
+	in.raw = level
+	ev := InputEvent{Name: in.name, Kind: in.opts.Kind, Flow: in.opts.Flow, When: now}
+
+	if PulseInput == in.opts.Kind {
+		if level == last {
+			return ev, false
+		}
+		in.count++
+		in.events.Inc()
+		in.since = now
+		ev.Active = true
+		return ev, true
+	}
+
+	active := (0 != level) != in.opts.Invert
+	if active == in.active {
+		in.changing = time.Time{}
+		return ev, false
+	}
+	if in.changing.IsZero() {
+		in.changing = now
+	}
+	if now.Sub(in.changing) < in.opts.Debounce {
+		return ev, false
+	}
+
+	in.active = active
+	in.since = now
+	in.changing = time.Time{}
+	if active {
+		in.count++
+		in.events.Inc()
+		in.state.Set(1)
+	} else {
+		in.state.Set(0)
+	}
+
+	ev.Active = active
+	if ButtonInput == in.opts.Kind && false == active {
+		return ev, false
+	}
+	return ev, true
+}
+
+// update reads the board's inputs and returns the events they cause.  The
+// first report only sets where the inputs start.
+func (t *inputTracker) update(levels map[int]int, now time.Time) []InputEvent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var list []InputEvent
+	for _, name := range t.names {
+		in := t.inputs[name]
+		level := levels[in.opts.Bit]
+		if false == t.seen {
+			in.raw = level
+			if PulseInput != in.opts.Kind {
+				in.active = (0 != level) != in.opts.Invert
+				if in.active {
+					in.state.Set(1)
+				}
+			}
+			continue
+		}
+		if ev, ok := in.step(level, now); ok {
+			list = append(list, ev)
+		}
+	}
+	t.seen = true
+	return list
+}
+
+// Subscribe calls fn with every event from the named input.  fn is called
+// from the board's update and must not block.
+func (l *Logic) Subscribe(name string, fn func(InputEvent)) {
+	l.inputs.mutex.Lock()
+	l.inputs.subscribers[name] = append(l.inputs.subscribers[name], fn)
+	l.inputs.mutex.Unlock()
+}
+
+// InputActive returns if the named contact or button is active and if there
+// is such an input that has been read.
+func (l *Logic) InputActive(name string) (active, ok bool) {
+	active, _, ok = l.inputState(name)
+	return active, ok
+}
+
+// inputState returns if the named input is active, when it last changed
+// (the zero time if it hasn't since the board first reported) and if there
+// is such an input that has been read.
+func (l *Logic) inputState(name string) (active bool, since time.Time, ok bool) {
+	l.inputs.mutex.Lock()
+	defer l.inputs.mutex.Unlock()
+
+	in, ok := l.inputs.inputs[name]
+	if false == ok || false == l.inputs.seen {
+		return false, time.Time{}, false
+	}
+	return in.active, in.since, true
+}
+
+// Inputs returns the state of the inputs.
+func (l *Logic) Inputs() []InputStatus {
+	l.inputs.mutex.Lock()
+	defer l.inputs.mutex.Unlock()
+
+	list := []InputStatus{}
+	for _, name := range l.inputs.names {
+		in := l.inputs.inputs[name]
+		list = append(list, InputStatus{
+			Name:   name,
+			Kind:   in.opts.Kind,
+			Bit:    in.opts.Bit,
+			Active: in.active,
+			Since:  in.since,
+			Count:  in.count,
+		})
+	}
+	return list
+}
+
+// inputEvent acts on an event: the flow meters are counted, then the rules
+// and the subscribers are run.
+func (l *Logic) inputEvent(ev InputEvent) {
+	switch ev.Flow {
+	case ColdWaterFlow:
+		/* Cold water has increased 0.1G */
+		l.coldWaterCounter.Add(0.1)
+		l.recordFlow("cold", 0.1)
+	case HotWaterFlow:
+		/* Hot water has increased 0.1G */
+		l.hotWaterCounter.Add(0.1)
+		l.recordFlow("hot", 0.1)
+		l.recordHotWater(0.1)
+		l.recordHotWaterHeat(0.1)
+
+		/* Make hot water because we know we need it. */
+		l.heaterLoopPump.NeededUntil("domestic", ev.When.Add(time.Second*30))
+	case HeaterLoopFlow:
+		/* Heater Loop has increased 0.1G */
+		l.heaterLoopCounter.Add(0.1)
+		l.recordFlow("loop", 0.1)
+		l.recordLoopHeat(0.1)
+	}
+
+	if ev.Active {
+		l.ruleInput(ev.Name)
+	}
+
+	l.inputs.mutex.Lock()
+	subscribers := append([]func(InputEvent){}, l.inputs.subscribers[ev.Name]...)
+	l.inputs.mutex.Unlock()
+
+	for _, fn := range subscribers {
+		fn(ev)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputs(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Inputs: map[string]InputOpts{
+		"in_meter":  {Bit: 5, Kind: PulseInput, Flow: ColdWaterFlow},
+		"in_door":   {Bit: 3, Kind: ContactInput, Debounce: time.Second * 2},
+		"in_call":   {Bit: 2, Kind: ContactInput, Invert: true},
+		"in_button": {Bit: 4, Kind: ButtonInput},
+	}}, nil)
+
+	var events []InputEvent
+	record := func(ev InputEvent) { events = append(events, ev) }
+	for _, name := range []string{"in_meter", "in_door", "in_call", "in_button"} {
+		l.Subscribe(name, record)
+	}
+
+	_, ok := l.InputActive("in_call")
+	assert.False(ok)
+
+	board := func(levels ...int) {
+		s := &ArduinoBoardStatus{Inputs: make(map[int]int)}
+		for i, level := range levels {
+			s.Inputs[i+2] = level
+		}
+		l.Update(s)
+		clock.Advance(time.Second)
+	}
+
+	// The first report only sets where things start.  The call for heat
+	// pulls its pin low.
+	board(1, 0, 0, 0)
+	assert.Empty(events)
+	active, ok := l.InputActive("in_call")
+	assert.True(ok)
+	assert.False(active)
+
+	// Every meter change is a pulse, counted by what the meter is for
+	// rather than its name.
+	board(1, 0, 0, 1)
+	board(1, 0, 0, 0)
+	board(1, 0, 0, 0)
+	if assert.Len(events, 2) {
+		assert.Equal("in_meter", events[0].Name)
+		assert.Equal(ColdWaterFlow, events[0].Flow)
+		assert.True(events[0].Active)
+	}
+	assert.InDelta(0.2, l.flowTotals["cold"], 0.000001)
+	events = nil
+
+	// The call for heat starts and stops.
+	board(0, 0, 0, 0)
+	board(1, 0, 0, 0)
+	if assert.Len(events, 2) {
+		assert.Equal(InputEvent{Name: "in_call", Kind: ContactInput, Active: true, When: events[0].When}, events[0])
+		assert.False(events[1].Active)
+	}
+	events = nil
+
+	// The door has to stay open for 2 seconds.
+	board(1, 1, 0, 0)
+	board(1, 0, 0, 0)
+	board(1, 1, 0, 0)
+	board(1, 1, 0, 0)
+	assert.Empty(events)
+	board(1, 1, 0, 0)
+	if assert.Len(events, 1) {
+		assert.Equal("in_door", events[0].Name)
+		assert.True(events[0].Active)
+	}
+	active, _ = l.InputActive("in_door")
+	assert.True(active)
+	events = nil
+
+	// Only button presses are events.
+	board(1, 1, 1, 0)
+	board(1, 1, 0, 0)
+	if assert.Len(events, 1) {
+		assert.Equal("in_button", events[0].Name)
+	}
+
+	s := l.Inputs()
+	if assert.Len(s, 4) {
+		assert.Equal("in_button", s[0].Name)
+		assert.Equal(1.0, s[0].Count)
+		assert.Equal("in_call", s[1].Name)
+		assert.Equal(1.0, s[1].Count)
+		assert.Equal("in_door", s[2].Name)
+		assert.True(s[2].Active)
+		assert.Equal("in_meter", s[3].Name)
+		assert.Equal(2.0, s[3].Count)
+	}
+}
+
+func TestInputRules(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Inputs: map[string]InputOpts{
+		"ir_button": {Bit: 2, Kind: ButtonInput},
+	}}, nil)
+	pump := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ir_pump"}, 1)
+	l.checkInterlocks()
+
+	action := []RuleAction{{On: "ir_pump", For: time.Minute}}
+	r, err := l.compileRule(Rule{Name: "press", When: RuleTrigger{Input: "ir_button"}, Do: action})
+	assert.Nil(err)
+	l.automation.rules = []*compiledRule{r}
+
+	// The flow meters are only there by default.
+	_, err = l.compileRule(Rule{When: RuleTrigger{Input: "hot_water"}, Do: action})
+	assert.NotNil(err)
+
+	board := func(level int) {
+		l.Update(&ArduinoBoardStatus{Inputs: map[int]int{2: level}})
+	}
+
+	// The first report only sets where the button starts.
+	board(0)
+	assert.Empty(pump.Claims())
+
+	// Pressing the button runs the rule.
+	board(1)
+	board(0)
+	assert.Equal([]OnOffClaim{{Name: ruleClaim + "press", Until: clock.Now().Add(time.Minute)}}, pump.Claims())
+	on, _ := pump.State()
+	assert.True(on)
+
+	pump.Shutdown()
+}
@@ -0,0 +1,350 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// The number of interlock violations remembered for the status API.
+const maxViolations = 50
+
+// Interlock is a rule between two outputs that is enforced when the relays
+// are changed.  Outputs are referred to by their OnOffThing names.
+type Interlock struct {
+	// The output the rule applies to.
+	Output string
+
+	// Another output that must be running whenever Output is.  It is
+	// started automatically when Output starts.
+	Requires string
+
+	// How long Requires runs before Output is started.  This only applies
+	// if Requires was not already running.
+	Lead time.Duration
+
+	// How long Requires keeps running after Output stops, for example to
+	// purge the heat out of a loop.
+	Overrun time.Duration
+
+	// Another output that must never run at the same time as Output.
+	// Output is refused while Excludes is running and is stopped if
+	// Excludes starts.
+	Excludes string
+}
+
+// InterlockViolation is a request that an interlock refused or cut short.
+type InterlockViolation struct {
+	When   time.Time `json:"when"`
+	Output string    `json:"output"`
+	Reason string    `json:"reason"`
+}
+
+// LevelOpts makes an output run at levels instead of just on and off.
+type LevelOpts struct {
+	// The levels (%) the output can run at, see LevelThingOpts.
+	Levels       []float64
+	DefaultLevel float64
+
+	// If set, the level is made by switching the relay on for that share of
+	// each period, for example for a mixing valve.
+	CyclePeriod time.Duration
+
+	// Extra relays switched on along with the output, like the high speed
+	// relay of a two speed fan.
+	Stages []LevelStage
+
+	// The relay bit (2, 4 or 8) driven with PWM at the level, for example
+	// the speed input of an ECM circulator.  0 means none.
+	PWMBit int
+}
+
+// LevelStage is a relay switched on when an output runs at or above Level.
+type LevelStage struct {
+	Level float64
+	Bit   int
+}
+
+// output is the control layer view of an OnOffThing.
+type output struct {
+	thing OnOffThing
+	bit   int
+
+	// If the OnOffThing wants the output on and the level (%) it wants.
+	wanted bool
+	level  float64
+
+	// How levels are made and the PWM duty last sent to the board.
+	levels LevelOpts
+	duty   int
+
+	// When a wanted output may actually be switched on, used to give the
+	// outputs it requires their lead time.
+	startAt time.Time
+
+	// The outputs that require this one mapped to when they stop needing
+	// it.  The zero time means for as long as they are wanted.
+	holds map[string]time.Time
+
+	// The manual override, if any.
+	override Override
+}
+
+// newOutput creates an OnOffThing that is switched through the interlocks.
+// If the output has LevelOpts it is a LevelThing.
+func (l *Logic) newOutput(opts OnOffThingOpts, bit int) OnOffThing {
+	name := opts.Name
+	opts.Gpio = func(on bool) {
+		l.control(name, on)
+	}
+	opts.Permit = func() string {
+		return l.permit(name)
+	}
+
+	opts.Clock = l.clock
+
+	o := &output{
+		bit:   bit,
+		holds: make(map[string]time.Time),
+	}
+	l.outputs[name] = o
+	l.outputNames = append(l.outputNames, name)
+
+	lo, ok := l.opts.Levels[name]
+	if false == ok {
+		o.thing = NewOnOffThing(opts)
+		return o.thing
+	}
+
+	o.levels = lo
+	o.thing = NewLevelThing(LevelThingOpts{
+		OnOffThingOpts: opts,
+		Levels:         lo.Levels,
+		DefaultLevel:   lo.DefaultLevel,
+		CyclePeriod:    lo.CyclePeriod,
+		Set: func(level float64) {
+			l.controlLevel(name, level)
+		},
+	})
+	return o.thing
+}
+
+// checkInterlocks drops any rules that refer to outputs that do not exist.
+func (l *Logic) checkInterlocks() {
+	var list []Interlock
+	for _, v := range l.opts.Interlocks {
+		ok := true
+		for _, name := range []string{v.Output, v.Requires, v.Excludes} {
+			if _, found := l.outputs[name]; "" != name && false == found {
+				fmt.Printf("Interlock: ignoring rule for unknown output '%s'\n", name)
+				ok = false
+			}
+		}
+		if ok && "" != v.Output {
+			list = append(list, v)
+		}
+	}
+	l.opts.Interlocks = list
+}
+
+// relayOn returns if the named output's relay is presently on.
+func (l *Logic) relayOn(name string) bool {
+	if o, ok := l.outputs[name]; ok {
+		return 0 != l.controlBitMask&o.bit
+	}
+	return false
+}
+
+// excluded returns why the named output is not allowed to start, or an
+// empty string if it is allowed.
+func (l *Logic) excluded(name string) string {
+	for _, v := range l.opts.Interlocks {
+		if name == v.Output && "" != v.Excludes && l.relayOn(v.Excludes) {
+			return fmt.Sprintf("%s excludes %s which is running", name, v.Excludes)
+		}
+	}
+	return ""
+}
+
+// refusal returns why the named output is not allowed to start, counting
+// the outputs it requires, or an empty string if it is allowed.  The caller
+// must hold relayMutex.
+func (l *Logic) refusal(name string) string {
+	if reason := l.excluded(name); "" != reason {
+		return reason
+	}
+	for _, v := range l.opts.Interlocks {
+		if name == v.Output && "" != v.Requires {
+			if reason := l.excluded(v.Requires); "" != reason {
+				return "requires " + reason
+			}
+		}
+	}
+	return ""
+}
+
+// permit is the OnOffThing's check before it turns the named output on, so
+// a refused request is reported to the requester as Rejected.
+func (l *Logic) permit(name string) string {
+	l.relayMutex.Lock()
+	defer l.relayMutex.Unlock()
+
+	reason := l.refusal(name)
+	if "" != reason {
+		l.violation(name, reason)
+	}
+	return reason
+}
+
+// violation records that the interlocks refused or stopped the named
+// output.  The caller must hold relayMutex.
+func (l *Logic) violation(name, reason string) {
+	fmt.Printf("Interlock: %s: %s\n", name, reason)
+
+	l.violations = append(l.violations, InterlockViolation{
+		When:   l.clock.Now(),
+		Output: name,
+		Reason: reason,
+	})
+	if len(l.violations) > maxViolations {
+		l.violations = l.violations[len(l.violations)-maxViolations:]
+	}
+	l.interlockCounter.Inc()
+}
+
+// startOutput applies the interlocks to a request to turn on the named
+// output.  The caller must hold relayMutex.
+func (l *Logic) startOutput(name string) {
+	o := l.outputs[name]
+	now := l.clock.Now()
+
+	// The OnOffThing asked permit() first, so this only catches a level
+	// change or an output that started in between.
+	if reason := l.refusal(name); "" != reason {
+		l.violation(name, reason)
+		l.stopOutput(name)
+		return
+	}
+
+	if o.wanted {
+		return
+	}
+
+	// Anything that cannot run alongside this output is stopped.
+	for _, v := range l.opts.Interlocks {
+		if name == v.Excludes && l.outputs[v.Output].wanted {
+			l.violation(v.Output, fmt.Sprintf("stopped because %s started", name))
+			l.stopOutput(v.Output)
+
+			// The stopped OnOffThing may be waiting on relayMutex, so it
+			// is turned off once this returns.
+			go l.outputs[v.Output].thing.ForceOff()
+		}
+	}
+
+	o.wanted = true
+	o.startAt = now
+	for _, v := range l.opts.Interlocks {
+		if name != v.Output || "" == v.Requires {
+			continue
+		}
+		if false == l.relayOn(v.Requires) && now.Add(v.Lead).After(o.startAt) {
+			o.startAt = now.Add(v.Lead)
+		}
+		l.outputs[v.Requires].holds[name] = time.Time{}
+	}
+
+	if o.startAt.After(now) {
+		l.clock.AfterFunc(o.startAt.Sub(now), l.refreshRelays)
+	}
+}
+
+// stopOutput applies the interlocks to a request to turn off the named
+// output.  The caller must hold relayMutex.
+func (l *Logic) stopOutput(name string) {
+	o := l.outputs[name]
+	if false == o.wanted {
+		return
+	}
+	o.wanted = false
+
+	for _, v := range l.opts.Interlocks {
+		if name != v.Output || "" == v.Requires {
+			continue
+		}
+		required := l.outputs[v.Requires]
+		if 0 < v.Overrun {
+			required.holds[name] = l.clock.Now().Add(v.Overrun)
+			l.clock.AfterFunc(v.Overrun, l.refreshRelays)
+		} else {
+			delete(required.holds, name)
+		}
+	}
+}
+
+// applyRelays works out which relays should be on and sends them to the
+// board.  The caller must hold relayMutex.
+func (l *Logic) applyRelays() {
+	now := l.clock.Now()
+
+	on := make(map[string]bool)
+	for name, o := range l.outputs {
+		on[name] = o.wanted && false == now.Before(o.startAt)
+		for holder, until := range o.holds {
+			if until.IsZero() || now.Before(until) {
+				on[name] = true
+			} else {
+				delete(o.holds, holder)
+			}
+		}
+	}
+
+	l.applyOverrides(now, on)
+
+	mask := 0
+	for name, o := range l.outputs {
+		if on[name] {
+			mask |= o.bit
+			for _, stage := range o.levels.Stages {
+				if o.level >= stage.Level {
+					mask |= stage.Bit
+				}
+			}
+		}
+
+		if 0 != o.levels.PWMBit {
+			duty := 0
+			if on[name] {
+				duty = int(o.level*255/100 + 0.5)
+			}
+			if duty != o.duty {
+				o.duty = duty
+				l.arduino.SetDuty(bits.TrailingZeros(uint(o.levels.PWMBit)), duty)
+			}
+		}
+	}
+
+	l.controlBitMask = mask
+	l.arduino.SetRelayState(l.controlBitMask)
+}
+
+func (l *Logic) refreshRelays() {
+	l.relayMutex.Lock()
+	defer l.relayMutex.Unlock()
+
+	l.applyRelays()
+}
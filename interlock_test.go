@@ -0,0 +1,106 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterlockRequires(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Interlocks: []Interlock{
+		{Output: "il_zone", Requires: "il_loop", Lead: 30 * time.Second, Overrun: 30 * time.Second},
+	}}, nil)
+	zone := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "il_zone"}, 1)
+	loop := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "il_loop"}, 2)
+	l.checkInterlocks()
+
+	// The loop starts first, then the zone after the lead time.
+	zone.OnUntil(clock.Now().Add(time.Hour))
+	assert.True(l.Status().Outputs[1].Relay)
+	assert.False(l.Status().Outputs[0].Relay)
+	clock.Advance(29 * time.Second)
+	assert.False(l.Status().Outputs[0].Relay)
+	clock.Advance(time.Second)
+	assert.True(l.Status().Outputs[0].Relay)
+
+	// The loop keeps running after the zone stops.
+	zone.Off()
+	assert.False(l.Status().Outputs[0].Relay)
+	assert.True(l.Status().Outputs[1].Relay)
+	clock.Advance(30 * time.Second)
+	assert.False(l.Status().Outputs[1].Relay)
+
+	zone.Shutdown()
+	loop.Shutdown()
+}
+
+func TestInterlockExcludes(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestLogic(RealClock{}, LogicOpts{Interlocks: []Interlock{
+		{Output: "il_fan", Excludes: "il_heat"},
+		{Output: "il_fan", Excludes: "il_missing"},
+	}}, nil)
+	fan := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "il_fan"}, 1)
+	heat := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "il_heat"}, 2)
+	l.checkInterlocks()
+	assert.Equal(1, len(l.opts.Interlocks))
+
+	// The fan is refused while the heat is running.
+	heat.OnUntil(time.Now().Add(time.Minute))
+	heat.NeededUntil("other", time.Now().Add(time.Minute))
+	r := fan.OnUntil(time.Now().Add(time.Minute))
+	assert.Equal(Rejected, r.Outcome)
+	assert.Equal("il_fan excludes il_heat which is running", r.Reason)
+	assert.False(r.On)
+	r = fan.NeededUntil("cooling", time.Now().Add(time.Minute))
+	assert.Equal(Rejected, r.Outcome)
+	assert.Empty(r.Claims)
+	s := l.Status()
+	assert.False(s.Outputs[0].Relay)
+	assert.True(s.Outputs[1].Relay)
+	assert.Equal(2, len(s.Violations))
+	assert.Equal("il_fan", s.Violations[0].Output)
+
+	// The refusal leaves the heat's claims alone.
+	if claims := heat.Claims(); assert.Len(claims, 1) {
+		assert.Equal("other", claims[0].Name)
+	}
+
+	// The heat starting stops the fan.
+	heat.Off()
+	r = fan.OnUntil(time.Now().Add(time.Minute))
+	assert.Equal(Applied, r.Outcome)
+	assert.True(r.On)
+	assert.True(l.Status().Outputs[0].Relay)
+	heat.OnUntil(time.Now().Add(time.Minute))
+	assert.Eventually(func() bool {
+		on, _ := fan.State()
+		return false == on
+	}, time.Second, 10*time.Millisecond)
+	s = l.Status()
+	assert.False(s.Outputs[0].Relay)
+	assert.True(s.Outputs[1].Relay)
+	assert.Equal(3, len(s.Violations))
+
+	fan.Shutdown()
+	heat.Shutdown()
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// LevelThing is an OnOffThing that runs at a level (0-100%), like a multi
+// speed fan, a variable speed circulator or a mixing valve.  Turning it on
+// without a level uses the last level asked for.
+type LevelThing interface {
+	OnOffThing
+
+	// Turns the thing on at the level until the specified time.  A level
+	// of 0 turns the thing off.
+	LevelUntil(level float64, until time.Time) OnOffResult
+
+	// Returns the level the thing runs at when it is on.
+	Level() float64
+}
+
+type LevelThingOpts struct {
+	// The on/off behavior of the thing.  The Gpio func is not used.
+	OnOffThingOpts
+
+	// The levels (%) the thing can run at, for example 50 and 100 for a two
+	// speed fan.  Requests are moved to the closest level.  If empty any
+	// level from 0 to 100 is allowed.
+	Levels []float64
+
+	// The level used until another is asked for.  The default is the
+	// highest level.
+	DefaultLevel float64
+
+	// If set, the thing can only be switched on and off so the level is
+	// made by running it for that share of each period.
+	CyclePeriod time.Duration
+
+	// Sets the output to a level (0-100%).  0 is off.
+	Set func(level float64)
+}
+
+type levelThing struct {
+	OnOffThing
+
+	levels []float64
+	period time.Duration
+	set    func(float64)
+	clock  Clock
+
+	mutex sync.Mutex
+	level float64
+	on    bool
+	cycle Timer
+
+	// Metrics
+	gauge prometheus.Gauge
+}
+
+func NewLevelThing(opts LevelThingOpts) LevelThing {
+	t := &levelThing{
+		levels: opts.Levels,
+		period: opts.CyclePeriod,
+		set:    opts.Set,
+		clock:  opts.Clock,
+		level:  100,
+	}
+
+	if nil == t.set {
+		t.set = func(level float64) {}
+	}
+	if nil == t.clock {
+		t.clock = RealClock{}
+	}
+	if 0 < len(t.levels) {
+		t.level = t.levels[len(t.levels)-1]
+	}
+	if 0 < opts.DefaultLevel {
+		t.level = t.snap(opts.DefaultLevel)
+	}
+
+	t.gauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: opts.Namespace,
+		Subsystem: "physical",
+		Name:      opts.Name + "_level",
+		Help:      opts.Name + " level (0-100%) at this moment.",
+	})
+
+	opts.OnOffThingOpts.Clock = t.clock
+	opts.OnOffThingOpts.Gpio = t.gpio
+	t.OnOffThing = NewOnOffThing(opts.OnOffThingOpts)
+
+	return t
+}
+
+// snap moves the level to the closest one the thing supports.
+func (t *levelThing) snap(level float64) float64 {
+	level = math.Max(0, math.Min(100, level))
+	if 0 == len(t.levels) {
+		return level
+	}
+
+	best := t.levels[0]
+	for _, v := range t.levels {
+		if math.Abs(v-level) < math.Abs(best-level) {
+			best = v
+		}
+	}
+	return best
+}
+
+func (t *levelThing) Level() float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.level
+}
+
+func (t *levelThing) LevelUntil(level float64, until time.Time) OnOffResult {
+	if level <= 0 {
+		return t.Off()
+	}
+
+	t.mutex.Lock()
+	t.level = t.snap(level)
+	if t.on {
+		t.apply()
+	}
+	t.mutex.Unlock()
+
+	return t.OnUntil(until)
+}
+
+// gpio is called by the OnOffThing when it turns on and off.
+func (t *levelThing) gpio(on bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.on = on
+	t.apply()
+}
+
+// apply sets the output to match the state and level.  The caller must hold
+// the mutex.
+func (t *levelThing) apply() {
+	if nil != t.cycle {
+		t.cycle.Stop()
+		t.cycle = nil
+	}
+
+	level := 0.0
+	if t.on {
+		level = t.level
+	}
+	t.gauge.Set(level)
+
+	if 0 == t.period || 0 == level || 100 == level {
+		t.set(level)
+		return
+	}
+	t.cycleOn()
+}
+
+// cycleOn and cycleOff alternate for time proportioned levels.  The caller
+// must hold the mutex.
+func (t *levelThing) cycleOn() {
+	t.set(100)
+	on := time.Duration(float64(t.period) * t.level / 100)
+	t.cycle = t.next(on, t.cycleOff)
+}
+
+func (t *levelThing) cycleOff() {
+	t.set(0)
+	off := t.period - time.Duration(float64(t.period)*t.level/100)
+	t.cycle = t.next(off, t.cycleOn)
+}
+
+// next calls f after d unless the cycle has been replaced by then.
+func (t *levelThing) next(d time.Duration, f func()) Timer {
+	var timer Timer
+	timer = t.clock.AfterFunc(d, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if timer == t.cycle {
+			f()
+		}
+	})
+	return timer
+}
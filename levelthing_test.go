@@ -0,0 +1,152 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type levelRecorder struct {
+	mutex  sync.Mutex
+	levels []float64
+}
+
+func (r *levelRecorder) set(level float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.levels = append(r.levels, level)
+}
+
+func (r *levelRecorder) last() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if 0 == len(r.levels) {
+		return -1
+	}
+	return r.levels[len(r.levels)-1]
+}
+
+func TestLevelThing(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	var rec levelRecorder
+	lt := NewLevelThing(LevelThingOpts{
+		OnOffThingOpts: OnOffThingOpts{
+			Namespace: testNamespace("testing"),
+			Name:      "twospeedfan",
+			Clock:     clock,
+		},
+		Levels: []float64{50, 100},
+		Set:    rec.set,
+	})
+
+	// The default is the highest level.
+	assert.Equal(100.0, lt.Level())
+	lt.OnUntil(clock.Now().Add(time.Minute))
+	assert.Equal(100.0, rec.last())
+
+	// Levels snap to the closest supported one, even while running.
+	r := lt.LevelUntil(40, clock.Now().Add(time.Minute))
+	assert.True(r.On)
+	assert.Equal(50.0, lt.Level())
+	assert.Equal(50.0, rec.last())
+
+	clock.Advance(time.Minute)
+	s, _ := lt.State()
+	assert.False(s)
+	assert.Equal(0.0, rec.last())
+
+	// Level 0 is off.
+	lt.LevelUntil(100, clock.Now().Add(time.Minute))
+	assert.Equal(100.0, rec.last())
+	r = lt.LevelUntil(0, clock.Now().Add(time.Minute))
+	assert.False(r.On)
+	assert.Equal(0.0, rec.last())
+
+	lt.Shutdown()
+}
+
+func TestLevelThingCycle(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	var rec levelRecorder
+	lt := NewLevelThing(LevelThingOpts{
+		OnOffThingOpts: OnOffThingOpts{
+			Namespace: testNamespace("testing"),
+			Name:      "mixingvalve",
+			Clock:     clock,
+		},
+		CyclePeriod: time.Minute,
+		Set:         rec.set,
+	})
+
+	lt.LevelUntil(25, clock.Now().Add(time.Hour))
+	assert.Equal(100.0, rec.last())
+	clock.Advance(time.Second * 14)
+	assert.Equal(100.0, rec.last())
+	clock.Advance(time.Second)
+	assert.Equal(0.0, rec.last())
+	clock.Advance(time.Second * 44)
+	assert.Equal(0.0, rec.last())
+	clock.Advance(time.Second)
+	assert.Equal(100.0, rec.last())
+
+	// The cycle stops with the thing.
+	lt.Off()
+	assert.Equal(0.0, rec.last())
+	clock.Advance(time.Minute * 5)
+	assert.Equal(0.0, rec.last())
+
+	lt.Shutdown()
+}
+
+func TestLevelOutputs(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Levels: map[string]LevelOpts{
+		"lo_fan": {
+			Levels: []float64{50, 100},
+			Stages: []LevelStage{{Level: 100, Bit: 16}},
+		},
+	}}, nil)
+	l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "lo_fan"}, 32)
+	l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "lo_pump"}, 1)
+	l.checkInterlocks()
+
+	until := clock.Now().Add(time.Hour)
+	l.SetLevel("lo_fan", 50, until)
+	assert.Equal(32, l.controlBitMask)
+	l.SetLevel("lo_fan", 100, until)
+	assert.Equal(48, l.controlBitMask)
+
+	// On/off outputs run for any level.
+	l.SetLevel("lo_pump", 30, until)
+	assert.Equal(49, l.controlBitMask)
+	l.SetLevel("lo_fan", 0, until)
+	assert.Equal(1, l.controlBitMask)
+
+	r := l.SetLevel("lo_missing", 50, until)
+	assert.Equal(Rejected, r.Outcome)
+
+	// Off keeps the level for next time.
+	assert.Equal(100.0, l.Status().Outputs[0].Level)
+}
@@ -29,11 +29,87 @@ const (
 	HeaterLoopIndex = 7
 )
 
+type LogicOpts struct {
+	// Where the outdoor temperature comes from.
+	Outdoor OutdoorTempOpts
+
+	// How the outdoor temperature adjusts heating.
+	Reset OutdoorResetOpts
+
+	// The daily downstairs setpoint schedule.  Manual changes via
+	// SetDownstairsTarget() last until the next scheduled change.
+	DownstairsSchedule SetpointSchedule
+
+	// How the downstairs thermostat decides to heat.  The default is a
+	// BurstThermostat.
+	DownstairsThermostat Thermostat
+
+	// How the house and hydronic loop are kept from freezing.
+	Freeze FreezeOpts
+
+	// How the domestic hot water recirculation is run.
+	Recirc RecircOpts
+
+	// How the whole house fan cools the house automatically.
+	Fan FanOpts
+
+	// How the boiler or water heater is fired and monitored.
+	HeatSource HeatSourceOpts
+
+	// How the energy used and its cost are worked out.
+	Energy EnergyOpts
+
+	// How the local history is kept.
+	History HistoryOpts
+
+	// The conditions that raise alerts and who is told.
+	Alerts AlertOpts
+
+	// How zones and the heater loop are watched for misbehaving.
+	Anomaly AnomalyOpts
+
+	// How idle pumps are exercised so they don't seize.
+	Exercise ExerciseOpts
+
+	// What changes while the house is away or on vacation.  Freeze
+	// protection always stays on.
+	Mode ModeOpts
+
+	// How people coming and going are noticed and acted on.
+	Presence PresenceOpts
+
+	// Where the automation rules are read from.
+	Rules RuleOpts
+
+	// What is wired to the board's inputs, by name.  The default is the
+	// cold water, hot water and heater loop flow meters.
+	Inputs map[string]InputOpts
+
+	// The wall thermostats wired to contact inputs, by zone.
+	WallThermostats map[string]WallThermostatOpts
+
+	// The rules between outputs enforced when the relays change.
+	Interlocks []Interlock
+
+	// The outputs that run at levels instead of just on and off, by
+	// OnOffThing name.
+	Levels map[string]LevelOpts
+
+	// The source of time.  The default is the wall clock.
+	Clock Clock
+}
+
 type Logic struct {
 	arduino     *ArduinoIoBoard
 	tempSensors *TempSensors
+	outdoor     OutdoorTemp
+	opts        LogicOpts
+	clock       Clock
 
 	controlBitMask int
+	outputs        map[string]*output
+	outputNames    []string
+	violations     []InterlockViolation
 
 	domesticHeatUntil   time.Time
 	downstairsHeatUntil time.Time
@@ -44,28 +120,84 @@ type Logic struct {
 	recircDHPump       OnOffThing
 	downstairsHeatPump OnOffThing
 	upstairsHeatPump   OnOffThing
+	heatSource         OnOffThing
 
-	last *ArduinoBoardStatus
+	inputs *inputTracker
+	walls  *wallThermostats
+
+	boardMutex     sync.Mutex
+	lastUpdate     time.Time
+	reportedRelays int
+
+	alerts *alertEngine
 
 	relayMutex      sync.Mutex
+	emergencyStop   bool
 	downstairsMutex sync.Mutex
 	wg              sync.WaitGroup
 	done            chan bool
 
 	downstairsTemp float64
 
+	recircMutex       sync.Mutex
+	recircDemandUntil time.Time
+	recircHot         bool
+	recircProfile     usageProfile
+
+	energy *energyLedger
+
+	history    *historyStore
+	flowMutex  sync.Mutex
+	flowTotals map[string]float64
+
+	// When the heater loop flow meter last pulsed.  Protected by flowMutex.
+	lastLoopFlow time.Time
+
+	anomalyMutex sync.Mutex
+	anomaly      *anomalyDetector
+
+	exercise *exerciser
+
+	// The mode set through SetMode, if any.
+	modeMutex sync.Mutex
+	modeSet   *ModePeriod
+
+	presence *presence
+
+	automation *ruleEngine
+
 	// Metrics
 	coldWaterCounter    prometheus.Counter
 	hotWaterCounter     prometheus.Counter
 	heaterLoopCounter   prometheus.Counter
 	changeCounter       prometheus.Counter
 	downstairsTempGauge prometheus.Gauge
+	freezeCounter       prometheus.Counter
+	interlockCounter    prometheus.Counter
+	deltaTGauge         prometheus.Gauge
+	highLimitCounter    prometheus.Counter
+	anomalyCounter      prometheus.Counter
+	exerciseCounter     prometheus.Counter
+	presenceGauge       prometheus.Gauge
+	ruleCounter         prometheus.Counter
 }
 
-func NewLogic(arduino *ArduinoIoBoard, ts *TempSensors) *Logic {
+func NewLogic(arduino *ArduinoIoBoard, ts *TempSensors, opts LogicOpts) *Logic {
 	l := &Logic{
 		arduino:     arduino,
 		tempSensors: ts,
+		opts:        opts,
+		clock:       opts.Clock,
+		done:        make(chan bool),
+		outputs:     make(map[string]*output),
+		energy:      newEnergyLedger(opts.Energy, "heaticus_maximus"),
+		history:     newHistoryStore(),
+		alerts:      newAlertEngine(opts.Alerts),
+		anomaly:     newAnomalyDetector(opts.Anomaly),
+		exercise:    newExerciser(opts.Exercise),
+		automation:  &ruleEngine{},
+		walls:       &wallThermostats{heating: make(map[string]bool)},
+		flowTotals:  map[string]float64{"cold": 0, "hot": 0, "loop": 0},
 		coldWaterCounter: promauto.NewCounter(prometheus.CounterOpts{
 			Subsystem: "physical",
 			Name:      "cold_water_usage",
@@ -91,57 +223,226 @@ func NewLogic(arduino *ArduinoIoBoard, ts *TempSensors) *Logic {
 			Name:      "downstairs_target_temp",
 			Help:      "the target temperature for downstairs (F)",
 		}),
+		freezeCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Subsystem: "physical",
+			Name:      "freeze_protection_activations",
+			Help:      "the count of times a sensor fell below its freeze floor",
+		}),
+		interlockCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Subsystem: "physical",
+			Name:      "interlock_violations",
+			Help:      "the count of requests refused or cut short by interlocks",
+		}),
+		deltaTGauge: promauto.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "physical",
+			Name:      "heat_source_delta_t",
+			Help:      "the heat source supply minus return temperature (F)",
+		}),
+		highLimitCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Subsystem: "physical",
+			Name:      "heat_source_high_limit_trips",
+			Help:      "the count of times the heat source reached the high limit",
+		}),
+		anomalyCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Subsystem: "physical",
+			Name:      "anomalies",
+			Help:      "the count of anomalies flagged",
+		}),
+		exerciseCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Subsystem: "physical",
+			Name:      "pump_exercises",
+			Help:      "the count of times an idle pump was exercised",
+		}),
+		presenceGauge: promauto.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "physical",
+			Name:      "people_home",
+			Help:      "the number of people home",
+		}),
+		ruleCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Subsystem: "physical",
+			Name:      "rules_fired",
+			Help:      "the count of times an automation rule acted",
+		}),
+	}
+
+	if nil == l.clock {
+		l.clock = RealClock{}
 	}
+	l.presence = newPresence(l.clock.Now(), opts.Presence)
+	l.inputs = newInputTracker("heaticus_maximus", l.inputOpts())
 
-	l.wholeHouseFan = NewOnOffThing(OnOffThingOpts{
+	l.wholeHouseFan = l.newOutput(OnOffThingOpts{
 		Namespace: "heaticus_maximus",
 		Name:      "whole_house_fan",
-		Gpio: func(on bool) {
-			l.control(32, on)
-		},
-	})
+	}, 32)
 
-	l.heaterLoopPump = NewOnOffThing(OnOffThingOpts{
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{
 		Namespace: "heaticus_maximus",
 		Name:      "heater_loop_pump",
-		Gpio: func(on bool) {
-			l.control(1, on)
-		},
-	})
+	}, 1)
 
-	l.recircDHPump = NewOnOffThing(OnOffThingOpts{
+	l.recircDHPump = l.newOutput(OnOffThingOpts{
 		Namespace:      "heaticus_maximus",
 		Name:           "recirculating_domestic_hot_pump",
 		BlackoutPeriod: time.Minute * 0,
-		Gpio: func(on bool) {
-			l.control(2, on)
-		},
-	})
+	}, 2)
 
-	l.downstairsHeatPump = NewOnOffThing(OnOffThingOpts{
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{
 		Namespace: "heaticus_maximus",
 		Name:      "downstairs_heat_pump",
-		Gpio: func(on bool) {
-			l.control(8, on)
-		},
-	})
+	}, 8)
 
-	l.upstairsHeatPump = NewOnOffThing(OnOffThingOpts{
+	l.upstairsHeatPump = l.newOutput(OnOffThingOpts{
 		Namespace: "heaticus_maximus",
 		Name:      "upstairs_heat_pump",
-		Gpio: func(on bool) {
-			l.control(4, on)
-		},
-	})
+	}, 4)
+
+	if 0 != opts.HeatSource.Bit {
+		l.heatSource = l.newOutput(OnOffThingOpts{
+			Namespace: "heaticus_maximus",
+			Name:      "heat_source",
+		}, opts.HeatSource.Bit)
+
+		// The burner must never fire without water moving.
+		l.opts.Interlocks = append(append([]Interlock{}, opts.Interlocks...), Interlock{
+			Output:   "heat_source",
+			Requires: "heater_loop_pump",
+		})
+	}
 
-	if nil != ts {
+	l.checkInterlocks()
+	l.checkWallThermostats()
+
+	if nil == opts.Outdoor.Clock {
+		opts.Outdoor.Clock = l.clock
+	}
+	l.outdoor = NewOutdoorTemp(opts.Outdoor, ts)
+
+	if sp, ok := opts.DownstairsSchedule.Current(l.clock.Now()); ok {
+		l.SetDownstairsTarget(sp.Target)
+	}
+
+	l.wg.Add(1)
+	go l.recirculation()
+
+	if 0 != opts.Fan.ComfortTemp {
 		l.wg.Add(1)
+		go l.fanAutomation()
+	}
+
+	if nil != ts {
+		l.wg.Add(2)
 		go l.downstairsThermostat()
+		go l.freezeProtection()
+	}
+
+	if nil != l.heatSource || "" != opts.HeatSource.SupplySensor {
+		l.wg.Add(1)
+		go l.heatSourceControl()
+	}
+
+	if 0 < len(opts.Energy.Outputs) || "" != opts.Energy.File {
+		l.wg.Add(1)
+		go l.energyAccounting()
+	}
+
+	l.wg.Add(1)
+	go l.historySampler()
+
+	l.wg.Add(1)
+	go l.anomalyDetection()
+
+	l.wg.Add(1)
+	go l.presenceTracking()
+
+	if "" != opts.Rules.File {
+		l.wg.Add(1)
+		go l.ruleAutomation()
+	}
+
+	if 0 < len(l.opts.WallThermostats) {
+		l.wg.Add(1)
+		go l.wallThermostatControl()
+	}
+
+	if 0 != opts.Exercise.Interval {
+		l.wg.Add(1)
+		go l.pumpExercise()
+	}
+
+	if 0 < len(opts.Alerts.Rules) {
+		l.wg.Add(1)
+		go l.alerting()
 	}
 
 	return l
 }
 
+// OutputStatus is the state of a single output.
+type OutputStatus struct {
+	Name          string       `json:"name"`
+	On            bool         `json:"on"`
+	Until         time.Time    `json:"until,omitempty"`
+	Relay         bool         `json:"relay"`
+	Level         float64      `json:"level,omitempty"`
+	Claims        []OnOffClaim `json:"claims,omitempty"`
+	Override      string       `json:"override"`
+	OverrideUntil time.Time    `json:"override_until,omitempty"`
+}
+
+// LogicStatus is the state of everything Logic controls.
+type LogicStatus struct {
+	Mode          ModePeriod `json:"mode"`
+	EmergencyStop bool       `json:"emergency_stop"`
+
+	Outputs    []OutputStatus       `json:"outputs"`
+	Violations []InterlockViolation `json:"interlock_violations"`
+	Anomalies  []Anomaly            `json:"anomalies"`
+	Inputs     []InputStatus        `json:"inputs"`
+
+	WallThermostats []WallThermostatStatus `json:"wall_thermostats"`
+}
+
+// Status returns the state of the outputs and the recent interlock
+// violations.
+func (l *Logic) Status() LogicStatus {
+	var s LogicStatus
+
+	for _, name := range l.outputNames {
+		thing := l.outputs[name].thing
+		on, until := thing.State()
+		level := 0.0
+		if lt, ok := thing.(LevelThing); ok {
+			level = lt.Level()
+		}
+		s.Outputs = append(s.Outputs, OutputStatus{
+			Name:   name,
+			On:     on,
+			Until:  until,
+			Level:  level,
+			Claims: thing.Claims(),
+		})
+	}
+
+	l.relayMutex.Lock()
+	for i := range s.Outputs {
+		o := l.outputs[s.Outputs[i].Name]
+		s.Outputs[i].Relay = l.relayOn(s.Outputs[i].Name)
+		s.Outputs[i].Override = o.override.Mode.String()
+		s.Outputs[i].OverrideUntil = o.override.Until
+	}
+	s.EmergencyStop = l.emergencyStop
+	s.Violations = append([]InterlockViolation{}, l.violations...)
+	l.relayMutex.Unlock()
+
+	s.Anomalies = l.Anomalies()
+	s.Inputs = l.Inputs()
+	s.WallThermostats = l.WallThermostats()
+	s.Mode = l.Mode()
+
+	return s
+}
+
 func (l *Logic) Start() (err error) {
 	l.arduino.Update = l.Update
 
@@ -159,27 +460,60 @@ func (l *Logic) Stop() {
 	l.recircDHPump.Shutdown()
 	l.downstairsHeatPump.Shutdown()
 	l.upstairsHeatPump.Shutdown()
-	l.done <- true
+	if nil != l.heatSource {
+		l.heatSource.Shutdown()
+	}
+	if nil != l.outdoor {
+		l.outdoor.Shutdown()
+	}
+	close(l.done)
 	l.wg.Wait()
 }
 
-func (l *Logic) Preheat() {
-	l.heaterLoopPump.NeededUntil("domestic", time.Now().Add(time.Minute*3))
-	l.recircDHPump.OnUntil(time.Now().Add(time.Minute * 3))
+func (l *Logic) Preheat() OnOffResult {
+	if l.away(l.clock.Now()) {
+		return OnOffResult{Outcome: Rejected, Reason: "nobody is home"}
+	}
+	l.heaterLoopPump.NeededUntil("domestic", l.clock.Now().Add(time.Minute*3))
+	return l.recircDHPump.OnUntil(l.clock.Now().Add(time.Minute * 3))
+}
+
+func (l *Logic) Fan(until time.Time) OnOffResult {
+	return l.wholeHouseFan.OnUntil(until)
 }
 
-func (l *Logic) Fan(until time.Time) {
-	l.wholeHouseFan.OnUntil(until)
+func (l *Logic) HeatUpstairs(until time.Time) OnOffResult {
+	return l.heatZone("upstairs", l.upstairsHeatPump, until)
 }
 
-func (l *Logic) HeatUpstairs(until time.Time) {
-	l.heaterLoopPump.NeededUntil("upstairs", until)
-	l.upstairsHeatPump.OnUntil(until)
+func (l *Logic) HeatDownstairs(until time.Time) OnOffResult {
+	return l.heatZone("downstairs", l.downstairsHeatPump, until)
 }
 
-func (l *Logic) HeatDownstairs(until time.Time) {
-	l.heaterLoopPump.NeededUntil("downstairs", until)
-	l.downstairsHeatPump.OnUntil(until)
+// heatZone runs the zone's pump and claims the heater loop for it.  The
+// zone gets no heat without the loop, so a loop request that is deferred or
+// rejected is reported in place of the pump's outcome.
+func (l *Logic) heatZone(zone string, pump OnOffThing, until time.Time) OnOffResult {
+	loop := l.heaterLoopPump.NeededUntil(zone, until)
+	r := pump.OnUntil(until)
+	if Applied != loop.Outcome && Rejected != r.Outcome {
+		r.Outcome = loop.Outcome
+		r.Start = loop.Start
+		r.Reason = "heater loop " + loop.Reason
+	}
+	return r
+}
+
+// zonePump returns the pump for the named zone or nil if there is no such
+// zone.
+func (l *Logic) zonePump(zone string) OnOffThing {
+	switch zone {
+	case "downstairs":
+		return l.downstairsHeatPump
+	case "upstairs":
+		return l.upstairsHeatPump
+	}
+	return nil
 }
 
 func (l *Logic) SetDownstairsTarget(goal float64) {
@@ -194,64 +528,108 @@ func (l *Logic) Update(s *ArduinoBoardStatus) {
 	//fmt.Printf("Update!\n")
 	l.changeCounter.Inc()
 
-	if nil == l.last {
-		l.last = s
-	}
+	l.boardMutex.Lock()
+	l.lastUpdate = l.clock.Now()
+	l.reportedRelays = s.RelayState
+	l.boardMutex.Unlock()
 
-	if s.Inputs[ColdWaterIndex] != l.last.Inputs[ColdWaterIndex] {
-		/* Cold water has increased 0.1G */
-		//fmt.Printf("Cold++\n")
-		l.coldWaterCounter.Add(0.1)
+	for _, ev := range l.inputs.update(s.Inputs, l.clock.Now()) {
+		l.inputEvent(ev)
 	}
-	if s.Inputs[HotWaterIndex] != l.last.Inputs[HotWaterIndex] {
-		/* Hot water has increased 0.1G */
-		//fmt.Printf("Hot++\n")
-		l.hotWaterCounter.Add(0.1)
+}
 
-		/* Make hot water because we know we need it. */
-		l.heaterLoopPump.NeededUntil("domestic", time.Now().Add(time.Second*30))
-		//l.recircDHPump.OnUntil(time.Now().Add(time.Second * 30))
-	}
-	if s.Inputs[HeaterLoopIndex] != l.last.Inputs[HeaterLoopIndex] {
-		/* Heater Loop has increased 0.1G */
-		//fmt.Printf("Heater++\n")
-		l.heaterLoopCounter.Add(0.1)
+func (l *Logic) control(name string, on bool) {
+	if on {
+		l.controlLevel(name, 100)
+	} else {
+		l.controlLevel(name, 0)
 	}
-	l.last = s
 }
 
-func (l *Logic) control(bit int, on bool) {
+// controlLevel switches an output through the interlocks at a level (%).
+func (l *Logic) controlLevel(name string, level float64) {
 	l.relayMutex.Lock()
 	defer l.relayMutex.Unlock()
 
-	if on {
-		l.controlBitMask |= bit
+	l.outputs[name].level = level
+	if 0 < level {
+		l.startOutput(name)
 	} else {
-		l.controlBitMask &^= bit
+		l.stopOutput(name)
+	}
+
+	l.applyRelays()
+}
+
+// SetLevel runs the named output at a level (%) until the time.  Outputs
+// that only switch on and off run for any level above 0.
+func (l *Logic) SetLevel(name string, level float64, until time.Time) OnOffResult {
+	o, ok := l.outputs[name]
+	if false == ok {
+		return OnOffResult{Outcome: Rejected, Reason: "no output named " + name}
 	}
 
-	l.arduino.SetRelayState(l.controlBitMask)
+	if lt, ok := o.thing.(LevelThing); ok {
+		return lt.LevelUntil(level, until)
+	}
+	if 0 < level {
+		return o.thing.OnUntil(until)
+	}
+	return o.thing.Off()
 }
 
 func (l *Logic) downstairsThermostat() {
 	defer l.wg.Done()
 
-	t := time.NewTicker(time.Second)
+	thermostat := l.opts.DownstairsThermostat
+	if nil == thermostat {
+		thermostat = &BurstThermostat{}
+	}
+
+	last := l.clock.Now()
+	t := l.clock.NewTicker(time.Second)
 	for {
 		select {
 		case <-l.done:
 			t.Stop()
 			return
-		case <-t.C:
-			present := (*l.tempSensors).Get("downstairs_main")
-			l.downstairsMutex.Lock()
-			target := l.downstairsTemp
-			l.downstairsMutex.Unlock()
-
-			if present < target {
-				l.HeatDownstairs(time.Now().Add(time.Minute * 3))
-				//l.HeatUpstairs(time.Now().Add(time.Minute * 3))
-			}
+		case now := <-t.C():
+			l.downstairsStep(thermostat, last, now)
+			last = now
 		}
 	}
 }
+
+// downstairsStep follows the setpoint schedule changes since last and heats
+// downstairs if the thermostat says it needs it.
+func (l *Logic) downstairsStep(thermostat Thermostat, last, now time.Time) {
+	if sp, ok := l.opts.DownstairsSchedule.Between(last, now); ok {
+		l.SetDownstairsTarget(sp.Target)
+	}
+
+	present := (*l.tempSensors).Get("downstairs_main")
+	l.downstairsMutex.Lock()
+	target := l.downstairsTemp
+	l.downstairsMutex.Unlock()
+
+	// Start working towards the next setpoint early so the house is
+	// comfortable when the change happens.
+	if next, when, ok := l.opts.DownstairsSchedule.Next(now); ok {
+		if next.Target > target && when.Sub(now) <= l.earlyStart() {
+			target = next.Target
+		}
+	}
+
+	target = l.modeTarget(now, target)
+
+	if _, own := l.wallDecides("downstairs", now); false == own {
+		return
+	}
+	if l.warmWeatherShutdown() {
+		return
+	}
+	if d := thermostat.Heat(present, target, l.heatRunTime()); 0 < d {
+		l.HeatDownstairs(now.Add(d))
+		//l.HeatUpstairs(time.Now().Add(time.Minute * 3))
+	}
+}
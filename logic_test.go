@@ -0,0 +1,77 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestLogic returns a Logic set up like NewLogic() but without any
+// outputs or goroutines, so a test adds only the outputs it needs and calls
+// the steps itself.  The metrics aren't registered.  If sensors is not nil
+// it is the Logic's TempSensors.
+func newTestLogic(clock Clock, opts LogicOpts, sensors *fakeSensors) *Logic {
+	counter := func(name string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: name})
+	}
+	gauge := func(name string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{Name: name})
+	}
+
+	l := &Logic{
+		arduino:             &ArduinoIoBoard{},
+		opts:                opts,
+		clock:               clock,
+		done:                make(chan bool),
+		outputs:             make(map[string]*output),
+		energy:              newEnergyLedger(opts.Energy, testNamespace("testing_energy")),
+		history:             newHistoryStore(),
+		alerts:              newAlertEngine(opts.Alerts),
+		exercise:            newExerciser(opts.Exercise),
+		automation:          &ruleEngine{},
+		walls:               &wallThermostats{heating: make(map[string]bool)},
+		flowTotals:          map[string]float64{"cold": 0, "hot": 0, "loop": 0},
+		coldWaterCounter:    counter("cold_water_usage"),
+		hotWaterCounter:     counter("hot_water_usage"),
+		heaterLoopCounter:   counter("heater_loop_flow"),
+		changeCounter:       counter("update_count"),
+		downstairsTempGauge: gauge("downstairs_target_temp"),
+		freezeCounter:       counter("freeze_protection_activations"),
+		interlockCounter:    counter("interlock_violations"),
+		deltaTGauge:         gauge("heat_source_delta_t"),
+		highLimitCounter:    counter("heat_source_high_limit_trips"),
+		anomalyCounter:      counter("anomalies"),
+		exerciseCounter:     counter("pump_exercises"),
+		presenceGauge:       gauge("people_home"),
+		ruleCounter:         counter("rules_fired"),
+	}
+	if nil != sensors {
+		var ts TempSensors = sensors
+		l.tempSensors = &ts
+	}
+
+	// The anomaly zones get gauges that aren't registered either.
+	ao := opts.Anomaly
+	ao.Zones = nil
+	l.anomaly = newAnomalyDetector(ao)
+	l.anomaly.opts.Zones = opts.Anomaly.Zones
+	for zone := range opts.Anomaly.Zones {
+		l.anomaly.zones[zone] = &zoneRecovery{gauge: gauge(zone + "_recovery_rate")}
+	}
+
+	l.presence = newPresence(clock.Now(), opts.Presence)
+	l.inputs = newInputTracker(testNamespace("testing"), l.inputOpts())
+	return l
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -8,6 +9,10 @@ import (
 )
 
 func main() {
+	simulate := flag.Bool("simulate", false, "use a simulated Arduino board instead of a real one")
+	script := flag.String("simulate-script", "", "a file of input changes for the simulated Arduino board")
+	speed := flag.Int("simulate-speed", 60, "how many times faster than real time the simulated house runs")
+	flag.Parse()
 
 	fmt.Printf("Hi\n")
 
@@ -19,16 +24,226 @@ func main() {
 			"28.84c5c4331401.5c": "downstairs_main",
 		},
 	}
-	ts, _ := NewTempSensors(tso)
-	names, _ := FindArduinos()
+	freezeFloor := 45.0
+	lo := LogicOpts{
+		Outdoor: OutdoorTempOpts{
+			Namespace: "heaticus_maximus",
+			Sensor:    "outdoor",
+		},
+		Reset: OutdoorResetOpts{
+			RunTime: ResetCurve{
+				{Outdoor: 0, Value: 6},
+				{Outdoor: 50, Value: 2},
+			},
+			EarlyStart: ResetCurve{
+				{Outdoor: 0, Value: 90},
+				{Outdoor: 50, Value: 15},
+			},
+			WarmWeatherShutdown: 65,
+		},
+		Freeze: FreezeOpts{
+			Floor: &freezeFloor,
+			Floors: map[string]float64{
+				"outdoor": -1000,
+			},
+			Zones: map[string][]string{
+				"downstairs_main": {"downstairs"},
+			},
+		},
+		Recirc: RecircOpts{
+			Windows: DailyWindows{
+				{Start: MustTimeOfDay("06:00"), End: MustTimeOfDay("07:30")},
+			},
+			Learn:       true,
+			ProfileFile: "hot_water_profile.json",
+		},
+		Fan: FanOpts{
+			ComfortTemp: 74,
+			Windows: DailyWindows{
+				{Start: MustTimeOfDay("18:00"), End: MustTimeOfDay("06:00")},
+			},
+			MaxRunTime: time.Hour * 4,
+		},
+		Interlocks: []Interlock{
+			{Output: "downstairs_heat_pump", Requires: "heater_loop_pump", Overrun: time.Second * 30},
+			{Output: "upstairs_heat_pump", Requires: "heater_loop_pump", Overrun: time.Second * 30},
+			{Output: "whole_house_fan", Excludes: "heater_loop_pump"},
+			{Output: "whole_house_fan", Excludes: "downstairs_heat_pump"},
+			{Output: "whole_house_fan", Excludes: "upstairs_heat_pump"},
+		},
+		Energy: EnergyOpts{
+			Outputs: map[string]EnergyOutput{
+				"heater_loop_pump":                {Watts: 85, Zone: "heater_loop"},
+				"recirculating_domestic_hot_pump": {Watts: 25, Zone: "domestic"},
+				"downstairs_heat_pump":            {Watts: 60, Zone: "downstairs"},
+				"upstairs_heat_pump":              {Watts: 60, Zone: "upstairs"},
+				"whole_house_fan":                 {Watts: 400, Zone: "cooling"},
+			},
+			ElectricRate: 0.12,
+			FuelRate:     1.10,
+			File:         "energy.json",
+		},
+		History: HistoryOpts{
+			File: "history.json",
+		},
+		Alerts: AlertOpts{
+			// No Notifiers are configured, so alerts are only seen at the
+			// /alerts web endpoint and in the log.  Add a WebhookNotifier,
+			// SMTPNotifier or CommandNotifier to be told about them.
+			Rules: []AlertRule{
+				SensorStaleAlert("downstairs_main", time.Minute*5),
+				BoardDisconnectedAlert(time.Minute),
+				RelayMismatchAlert(time.Second * 30),
+				LeakAlert(time.Hour*2, time.Minute*15),
+				ZoneBelowTargetAlert("downstairs_main", 3, time.Hour*2),
+				AnomalyAlert("no_rise_downstairs"),
+				AnomalyAlert("loop_no_flow"),
+				AnomalyAlert("loop_flow_while_off"),
+				AnomalyAlert("heat_source_sensor"),
+			},
+		},
+		Anomaly: AnomalyOpts{
+			Zones: map[string]string{
+				"downstairs": "downstairs_main",
+			},
+		},
+		Mode: ModeOpts{
+			AwaySetpoint:     62,
+			VacationSetpoint: 55,
+		},
+		Presence: PresenceOpts{
+			AutoAway:         true,
+			PreheatOnArrival: true,
+		},
+		Rules: RuleOpts{
+			File: "rules.yaml",
+		},
+		Inputs: map[string]InputOpts{
+			"cold_water":  {Bit: ColdWaterIndex, Kind: PulseInput, Flow: ColdWaterFlow},
+			"hot_water":   {Bit: HotWaterIndex, Kind: PulseInput, Flow: HotWaterFlow},
+			"heater_loop": {Bit: HeaterLoopIndex, Kind: PulseInput, Flow: HeaterLoopFlow},
+
+			// Pins 2-4 are inputs without pull-ups, so they float when
+			// nothing is wired to them.  Only add contacts for pins that
+			// are wired, for example a wall thermostat's call through an
+			// opto-isolator, and use it in WallThermostats.
+		},
+		Exercise: ExerciseOpts{
+			Interval: time.Hour * 24 * 7,
+			RunTime:  time.Second * 30,
+			At:       MustTimeOfDay("10:00"),
+		},
+		Levels: map[string]LevelOpts{
+			// The high speed relay is on output 4 (bit 16).
+			"whole_house_fan": {
+				Levels:       []float64{50, 100},
+				DefaultLevel: 50,
+				Stages:       []LevelStage{{Level: 100, Bit: 16}},
+			},
+		},
+	}
+	var tsp *TempSensors
 	a := &ArduinoIoBoard{}
-	if nil != names {
-		a.Filename = names[0]
+
+	var sim *ArduinoSim
+	var house *HouseModel
+	var clock *FakeClock
+	if *simulate {
+		// The house runs in accelerated virtual time.
+		clock = NewFakeClock(time.Now())
+		lo.Clock = clock
+
+		house = NewHouseModel(HouseModelOpts{
+			Zones: []ThermalZoneOpts{
+				{
+					Sensor:  "downstairs_main",
+					Zone:    "downstairs",
+					Loss:    0.05,
+					Gain:    6,
+					Lag:     time.Minute * 30,
+					Initial: 65,
+				},
+			},
+			Clock: clock,
+		}, clock.Now())
+		var ts TempSensors = house
+		tsp = &ts
+
+		var err error
+		sim, err = NewArduinoSim(ArduinoSimOpts{
+			OnRelay: func(state int) {
+				fmt.Printf("Simulated relays: %06b\n", state)
+			},
+		})
+		if nil != err {
+			fmt.Printf("Unable to create the simulated Arduino: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Simulated Arduino at %s\n", sim.Path())
+		a.Filename = sim.Path()
+
+		if "" != *script {
+			f, err := os.Open(*script)
+			if nil != err {
+				fmt.Printf("Unable to open the script: %v\n", err)
+				os.Exit(1)
+			}
+			go func() {
+				defer f.Close()
+				if err := sim.RunScript(f); nil != err {
+					fmt.Printf("%v\n", err)
+				}
+			}()
+		}
+	} else {
+		// Only the simulated house has an "outdoor" sensor; the real one
+		// is a plain text file of the temperature (F) kept up to date by a
+		// weather feed.
+		lo.Outdoor = OutdoorTempOpts{
+			Namespace: "heaticus_maximus",
+			File:      "outdoor_temp",
+		}
+
+		ts, err := NewTempSensors(tso)
+		if nil == err {
+			tsp = &ts
+		} else {
+			fmt.Printf("Unable to open the temperature sensors: %v\n", err)
+		}
+
+		names, _ := FindArduinos()
+		if nil != names {
+			a.Filename = names[0]
+		}
 	}
-	l := NewLogic(a, &ts)
+
+	l := NewLogic(a, tsp, lo)
 	l.Start()
 
-	wh := NewWeb(l, &ts, nil)
+	if nil != house {
+		house.Run(func(zone string) bool {
+			on, _ := l.zonePump(zone).State()
+			return on
+		})
+	}
+
+	stopClock := make(chan bool)
+	if nil != clock {
+		go func() {
+			t := time.NewTicker(time.Millisecond * 10)
+			defer t.Stop()
+			for {
+				select {
+				case <-stopClock:
+					return
+				case <-t.C:
+					clock.Advance(time.Millisecond * 10 * time.Duration(*speed))
+				}
+			}
+		}()
+	}
+
+	wh := NewWeb(l, tsp, nil)
 	wh.Start()
 
 	idleConnsClosed := make(chan struct{})
@@ -37,8 +252,13 @@ func main() {
 		signal.Notify(sigint, os.Interrupt)
 		<-sigint
 
+		close(stopClock)
 		wh.Stop()
 		l.Stop()
+		if nil != sim {
+			sim.Close()
+			house.Shutdown()
+		}
 		close(idleConnsClosed)
 	}()
 
@@ -0,0 +1,196 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// HouseMode is whether anyone is home.
+type HouseMode int
+
+const (
+	Home HouseMode = iota
+
+	// Away lowers the zone targets to the away setpoint, ignores the wall
+	// thermostats and stops the domestic hot water recirculation and
+	// preheating.
+	Away
+
+	// Vacation is like Away with the lower vacation setpoint.
+	Vacation
+)
+
+func (m HouseMode) String() string {
+	switch m {
+	case Home:
+		return "home"
+	case Away:
+		return "away"
+	case Vacation:
+		return "vacation"
+	}
+	return "unknown"
+}
+
+// ParseHouseMode converts "home", "away" or "vacation" into a HouseMode.
+func ParseHouseMode(s string) (HouseMode, error) {
+	for _, m := range []HouseMode{Home, Away, Vacation} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return Home, fmt.Errorf("Invalid house mode '%s'", s)
+}
+
+func (m HouseMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *HouseMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseHouseMode(string(text))
+	return err
+}
+
+// ModePeriod is a time the house is in a mode.  The zero Start means from
+// now and the zero End means until it is changed.
+type ModePeriod struct {
+	Mode  HouseMode `json:"mode"`
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+// Contains returns if now is within the period.
+func (p ModePeriod) Contains(now time.Time) bool {
+	return false == now.Before(p.Start) && (p.End.IsZero() || now.Before(p.End))
+}
+
+// ModeOpts sets what the house does while nobody is home.  The setpoints are
+// only for the zones with a thermostat of their own; a zone run only by a
+// wall thermostat isn't heated while away and relies on freeze protection.
+type ModeOpts struct {
+	// The zone target (F) while away.  The default is 62F.
+	AwaySetpoint float64
+
+	// The zone target (F) while on vacation.  The default is 55F.
+	VacationSetpoint float64
+
+	// Times the house is planned to be away or on vacation.
+	Schedule []ModePeriod
+}
+
+// modeAt returns the period the house is in at now.  A period set with
+// SetMode wins over the schedule.  The caller must not hold modeMutex.
+func (l *Logic) modeAt(now time.Time) ModePeriod {
+	l.modeMutex.Lock()
+	defer l.modeMutex.Unlock()
+
+	if nil != l.modeSet && false == l.modeSet.End.IsZero() && false == now.Before(l.modeSet.End) {
+		fmt.Printf("Mode: %s ended\n", l.modeSet.Mode)
+		l.modeSet = nil
+	}
+	if nil != l.modeSet && l.modeSet.Contains(now) {
+		return *l.modeSet
+	}
+	for _, p := range l.opts.Mode.Schedule {
+		if p.Contains(now) {
+			return p
+		}
+	}
+	return ModePeriod{Mode: Home}
+}
+
+// Mode returns the mode the house is in now.
+func (l *Logic) Mode() ModePeriod {
+	return l.modeAt(l.clock.Now())
+}
+
+// SetMode puts the house in the mode from start until end.  The zero start
+// means now and the zero end means until it is changed.  Setting Home
+// cancels the mode set before, including any scheduled period in effect.
+func (l *Logic) SetMode(mode HouseMode, start, end time.Time) error {
+	now := l.clock.Now()
+	if start.IsZero() {
+		start = now
+	}
+	if false == end.IsZero() && false == end.After(start) {
+		return fmt.Errorf("the end %s is not after the start %s", end.Format(time.Kitchen), start.Format(time.Kitchen))
+	}
+
+	if Home == mode && end.IsZero() {
+		// Home until the scheduled period in effect would have ended.
+		l.modeMutex.Lock()
+		l.modeSet = nil
+		l.modeMutex.Unlock()
+
+		p := l.modeAt(start)
+		if Home == p.Mode {
+			fmt.Printf("Mode: home\n")
+			return nil
+		}
+		if p.End.IsZero() {
+			return fmt.Errorf("the house is scheduled to be %s with no end", p.Mode)
+		}
+		end = p.End
+	}
+
+	l.modeMutex.Lock()
+	l.modeSet = &ModePeriod{Mode: mode, Start: start, End: end}
+	l.modeMutex.Unlock()
+
+	if end.IsZero() {
+		fmt.Printf("Mode: %s from %s\n", mode, start.Format(time.Kitchen))
+	} else {
+		fmt.Printf("Mode: %s from %s until %s\n", mode, start.Format(time.Kitchen), end.Format(time.Kitchen))
+	}
+	return nil
+}
+
+// away returns if nobody is home at now.
+func (l *Logic) away(now time.Time) bool {
+	return Home != l.modeAt(now).Mode
+}
+
+// modeTarget lowers a zone target (F) to the away or vacation setpoint while
+// the house is in that mode.  The target is restored early enough ahead of
+// the planned return for the house to be comfortable.
+func (l *Logic) modeTarget(now time.Time, target float64) float64 {
+	p := l.modeAt(now)
+
+	var setpoint float64
+	switch p.Mode {
+	case Home:
+		return target
+	case Away:
+		setpoint = l.opts.Mode.AwaySetpoint
+		if 0 == setpoint {
+			setpoint = 62
+		}
+	case Vacation:
+		setpoint = l.opts.Mode.VacationSetpoint
+		if 0 == setpoint {
+			setpoint = 55
+		}
+	}
+
+	if target <= setpoint {
+		return target
+	}
+	if false == p.End.IsZero() && p.End.Sub(now) <= l.earlyStart() {
+		return target
+	}
+	return setpoint
+}
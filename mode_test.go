@@ -0,0 +1,110 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHouseModeJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var p ModePeriod
+	assert.Nil(json.Unmarshal([]byte(`{"mode":"vacation","end":"2019-01-14T00:00:00Z"}`), &p))
+	assert.Equal(Vacation, p.Mode)
+	assert.True(p.Start.IsZero())
+
+	buf, err := json.Marshal(ModePeriod{Mode: Away})
+	assert.Nil(err)
+	assert.Contains(string(buf), `"mode":"away"`)
+
+	assert.NotNil(json.Unmarshal([]byte(`{"mode":"gone"}`), &p))
+}
+
+func TestHouseMode(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	l := newTestLogic(clock, LogicOpts{Mode: ModeOpts{
+		AwaySetpoint: 60,
+		Schedule: []ModePeriod{
+			{Mode: Vacation, Start: start.Add(time.Hour * 24), End: start.Add(time.Hour * 24 * 8)},
+		},
+	}}, nil)
+
+	assert.Equal(Home, l.Mode().Mode)
+	assert.Equal(68.0, l.modeTarget(clock.Now(), 68))
+
+	// Away until tonight.
+	assert.Nil(l.SetMode(Away, time.Time{}, start.Add(time.Hour*18)))
+	assert.Equal(Away, l.Mode().Mode)
+	assert.Equal(60.0, l.modeTarget(clock.Now(), 68))
+	assert.Equal(58.0, l.modeTarget(clock.Now(), 58))
+	assert.Equal(Rejected, l.Preheat().Outcome)
+
+	clock.Advance(time.Hour * 18)
+	assert.Equal(Home, l.Mode().Mode)
+	assert.Equal(68.0, l.modeTarget(clock.Now(), 68))
+
+	// The scheduled vacation.
+	clock.Advance(time.Hour * 6)
+	assert.Equal(Vacation, l.Mode().Mode)
+	assert.Equal(55.0, l.modeTarget(clock.Now(), 68))
+
+	// Coming home early only cancels this vacation.
+	clock.Advance(time.Hour * 24)
+	assert.Nil(l.SetMode(Home, time.Time{}, time.Time{}))
+	p := l.Mode()
+	assert.Equal(Home, p.Mode)
+	assert.Equal(start.Add(time.Hour*24*8), p.End)
+
+	assert.NotNil(l.SetMode(Away, clock.Now(), clock.Now()))
+}
+
+func TestLeakAlertAway(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{}, nil)
+
+	n := &recordingNotifier{}
+	e := newAlertEngine(AlertOpts{
+		Rules:     []AlertRule{LeakAlert(time.Hour, time.Minute*10)},
+		Notifiers: []Notifier{n},
+	})
+	assert.Nil(l.SetMode(Away, time.Time{}, time.Time{}))
+
+	for i := 0; i < 12; i++ {
+		l.flowTotals["cold"] += 0.1
+		e.check(l, clock.Now())
+		clock.Advance(time.Minute)
+	}
+	assert.Len(e.Active(), 1)
+
+	// At home the same use is fine.
+	assert.Nil(l.SetMode(Home, time.Time{}, time.Time{}))
+	e = newAlertEngine(AlertOpts{Rules: []AlertRule{LeakAlert(time.Hour, time.Minute*10)}})
+	for i := 0; i < 12; i++ {
+		l.flowTotals["cold"] += 0.1
+		e.check(l, clock.Now())
+		clock.Advance(time.Minute)
+	}
+	assert.Empty(e.Active())
+}
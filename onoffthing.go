@@ -15,6 +15,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -29,13 +30,25 @@ type OnOffThing interface {
 
 	// Turns the thing on until the specified time.  If the thing is already
 	// on, the time it turns off is adjusted
-	OnUntil(time.Time)
+	OnUntil(time.Time) OnOffResult
 
 	// Turns the thing on until the last thing that needs it expires.
-	NeededUntil(string, time.Time)
+	NeededUntil(string, time.Time) OnOffResult
 
-	// Turns the thing off indefinitely.
-	Off()
+	// Drops the named requester's claim.  The thing turns off if nothing
+	// else needs it.
+	Release(string) OnOffResult
+
+	// Returns the requesters that presently need the thing and until when.
+	Claims() []OnOffClaim
+
+	// Turns the thing off indefinitely once the minimum on time is met,
+	// dropping all the claims.
+	Off() OnOffResult
+
+	// Turns the thing off right away, ignoring the minimum on time.  This is
+	// for safety cutoffs.
+	ForceOff()
 
 	// Shuts down and turns everything off.
 	Shutdown()
@@ -53,50 +66,176 @@ type OnOffThingOpts struct {
 	// for this calculation.  The default is no blackout period.
 	BlackoutPeriod time.Duration
 
+	// The shortest time the thing runs once it is started so it does not
+	// short cycle.  An Off() or a shorter request is held off until then.
+	// The default is no minimum.
+	MinOnTime time.Duration
+
+	// The longest time the thing runs continuously before it is cut off in
+	// case whatever is asking for it is stuck.  The default is no maximum.
+	MaxOnTime time.Duration
+
+	// How long the thing stays off after MaxOnTime cut it off.  The default
+	// is the MaxOnTime.
+	MaxOnRest time.Duration
+
+	// The most times the thing will start in any hour.  The default is no
+	// limit.
+	MaxStartsPerHour int
+
+	// Requests made during the blackout period are started when it ends
+	// instead of being rejected.
+	QueueDuringBlackout bool
+
 	Gpio func(on bool)
+
+	// Checked each time the thing is about to turn on.  A non-empty reason
+	// refuses the request.  The default permits everything.
+	Permit func() string
+
+	// The source of time.  The default is the wall clock.
+	Clock Clock
+}
+
+type OnOffOutcome int
+
+const (
+	// The request was carried out.
+	Applied OnOffOutcome = iota
+
+	// The request will be carried out when the blackout period ends.
+	Deferred
+
+	// The request was refused.
+	Rejected
+)
+
+func (o OnOffOutcome) String() string {
+	switch o {
+	case Applied:
+		return "applied"
+	case Deferred:
+		return "deferred"
+	case Rejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// OnOffResult tells the caller what became of a request.
+type OnOffResult struct {
+	Outcome OnOffOutcome
+
+	// The state of the thing after the request and when it will change.
+	// For a deferred request Start is when the thing will turn on.
+	On    bool
+	Start time.Time
+	Until time.Time
+
+	// Set when the time asked for was changed to respect the limits.
+	Clamped bool
+
+	// Why the request was refused, deferred or changed.
+	Reason string
+
+	// The requesters that need the thing after the request.
+	Claims []OnOffClaim
+}
+
+// OnOffClaim is a requester that needs the thing until a time.
+type OnOffClaim struct {
+	Name  string    `json:"name"`
+	Until time.Time `json:"until"`
+}
+
+type onOffThingOp int
+
+const (
+	opState onOffThingOp = iota
+	opOnUntil
+	opNeededUntil
+	opRelease
+	opOff
+	opForceOff
+	opShutdown
+)
+
+// onOffThingCmd is a request to the goroutine that owns the thing's state.
+type onOffThingCmd struct {
+	op    onOffThingOp
+	name  string
+	when  time.Time
+	reply chan OnOffResult
 }
 
 type onOffThing struct {
 	name           string
-	state          bool
 	blackoutPeriod time.Duration
-	refreshPeriod  time.Duration
-	neededUntil    map[string]time.Time
-	until          time.Time
-	notBefore      time.Time
+	minOnTime      time.Duration
+	maxOnTime      time.Duration
+	maxOnRest      time.Duration
+	maxStarts      int
+	queue          bool
+	gpio           func(on bool)
+	permit         func() string
+	clock          Clock
+	cmds           chan onOffThingCmd
 	done           chan bool
 	wg             sync.WaitGroup
-	mutex          sync.Mutex
-	untilMutex     sync.Mutex
-	refreshTicker  *time.Ticker
-	changeTicker   *time.Ticker
-	gpio           func(on bool)
+
+	// Only used by run()
+	state       bool
+	onSince     time.Time
+	neededUntil map[string]time.Time
+	direct      time.Time
+	until       time.Time
+	notBefore   time.Time
+	starts      []time.Time
+	queued      time.Time
+	cutoff      bool
+	timer       Timer
 
 	// Metrics
-	status prometheus.Gauge
-	onTime prometheus.Counter
+	status   prometheus.Gauge
+	onTime   prometheus.Counter
+	rejected prometheus.Counter
+	clamped  prometheus.Counter
 }
 
 func NewOnOffThing(opts OnOffThingOpts) OnOffThing {
 	t := &onOffThing{
 		name:           opts.Name,
+		cmds:           make(chan onOffThingCmd),
 		done:           make(chan bool),
 		neededUntil:    make(map[string]time.Time),
-		refreshPeriod:  time.Second,
 		blackoutPeriod: opts.BlackoutPeriod,
+		minOnTime:      opts.MinOnTime,
+		maxOnTime:      opts.MaxOnTime,
+		maxOnRest:      opts.MaxOnRest,
+		maxStarts:      opts.MaxStartsPerHour,
+		queue:          opts.QueueDuringBlackout,
 		gpio:           opts.Gpio,
+		permit:         opts.Permit,
+		clock:          opts.Clock,
 	}
 
 	if nil == t.gpio {
 		t.gpio = func(on bool) {}
 	}
+	if nil == t.permit {
+		t.permit = func() string { return "" }
+	}
+	if nil == t.clock {
+		t.clock = RealClock{}
+	}
+	if 0 == t.maxOnRest {
+		t.maxOnRest = t.maxOnTime
+	}
 
-	// Initialize the tickers but stop them so we don't need
-	// to do nil checks everywhere
-	t.refreshTicker = time.NewTicker(time.Minute)
-	t.refreshTicker.Stop()
-	t.changeTicker = time.NewTicker(time.Minute)
-	t.changeTicker.Stop()
+	// The single timer only runs while the thing is on or has a request
+	// queued.
+	t.timer = t.clock.NewTimer(time.Minute)
+	t.timer.Stop()
 
 	t.status = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: opts.Namespace,
@@ -112,95 +251,321 @@ func NewOnOffThing(opts OnOffThingOpts) OnOffThing {
 		Help:      opts.Name + " total on time in seconds.",
 	})
 
+	t.rejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: opts.Namespace,
+		Subsystem: "physical",
+		Name:      opts.Name + "_rejected_requests",
+		Help:      opts.Name + " requests refused because of the limits.",
+	})
+
+	t.clamped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: opts.Namespace,
+		Subsystem: "physical",
+		Name:      opts.Name + "_clamped_requests",
+		Help:      opts.Name + " requests changed to respect the limits.",
+	})
+
 	t.wg.Add(1)
 	go t.run()
 
 	return t
 }
 
+// send passes the command to run() and waits for the result.  After the
+// thing is shut down the commands are ignored.
+func (t *onOffThing) send(cmd onOffThingCmd) OnOffResult {
+	cmd.reply = make(chan OnOffResult, 1)
+	select {
+	case t.cmds <- cmd:
+		return <-cmd.reply
+	case <-t.done:
+		return OnOffResult{Outcome: Rejected, Reason: "shut down"}
+	}
+}
+
 func (t *onOffThing) Shutdown() {
-	t.done <- true
+	t.send(onOffThingCmd{op: opShutdown})
 	t.wg.Wait()
 }
 
 func (t *onOffThing) State() (bool, time.Time) {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	if time.Now().After(t.until) {
-		return t.state, time.Time{}
-	}
-	return t.state, t.until
-}
-
-func (t *onOffThing) Off() {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	t.until = time.Now().Add(-1 * time.Nanosecond)
-	t.stop()
-}
-
-func (t *onOffThing) OnUntil(when time.Time) {
-	now := time.Now()
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	if now.After(t.notBefore) {
-		if false == t.state {
-			t.gpio(false)
-			t.refreshTicker.Stop()
-			t.refreshTicker = time.NewTicker(t.refreshPeriod)
+	r := t.send(onOffThingCmd{op: opState})
+	return r.On, r.Until
+}
+
+func (t *onOffThing) Off() OnOffResult {
+	return t.send(onOffThingCmd{op: opOff})
+}
+
+func (t *onOffThing) ForceOff() {
+	t.send(onOffThingCmd{op: opForceOff})
+}
+
+func (t *onOffThing) OnUntil(when time.Time) OnOffResult {
+	return t.send(onOffThingCmd{op: opOnUntil, when: when})
+}
+
+func (t *onOffThing) NeededUntil(name string, when time.Time) OnOffResult {
+	return t.send(onOffThingCmd{op: opNeededUntil, name: name, when: when})
+}
+
+func (t *onOffThing) Release(name string) OnOffResult {
+	return t.send(onOffThingCmd{op: opRelease, name: name})
+}
+
+func (t *onOffThing) Claims() []OnOffClaim {
+	return t.send(onOffThingCmd{op: opState}).Claims
+}
+
+// run owns the state of the thing.  It only wakes up for commands and when
+// the thing is due to turn off.
+func (t *onOffThing) run() {
+	defer t.wg.Done()
+	defer close(t.done)
+
+	for {
+		select {
+		case cmd := <-t.cmds:
+			now := t.clock.Now()
+			t.expire(now)
+			t.startQueued(now)
+
+			var r OnOffResult
+			switch cmd.op {
+			case opOnUntil:
+				// A direct request never cuts a claim short.
+				prev := t.direct
+				t.direct = cmd.when
+				r = t.onUntil(now, t.deadline(now))
+				if Rejected == r.Outcome {
+					t.direct = prev
+				}
+			case opNeededUntil:
+				prev, ok := t.neededUntil[cmd.name]
+				t.neededUntil[cmd.name] = cmd.when
+				r = t.onUntil(now, t.deadline(now))
+				if Rejected == r.Outcome {
+					// A refused request leaves the others as they were.
+					delete(t.neededUntil, cmd.name)
+					if ok {
+						t.neededUntil[cmd.name] = prev
+					}
+				}
+			case opRelease:
+				delete(t.neededUntil, cmd.name)
+				r = t.release(now)
+			case opOff:
+				t.drop()
+				r = t.off(now)
+			case opForceOff:
+				t.drop()
+				t.until = now
+				t.stop(now)
+			case opShutdown:
+				t.stop(now)
+				cmd.reply <- OnOffResult{}
+				return
+			}
+
+			t.count(r)
+
+			r.On = t.state
+			if t.state {
+				r.Until = t.until
+			}
+			r.Claims = t.claims()
+			cmd.reply <- r
+
+		case <-t.timer.C():
+			now := t.clock.Now()
+			t.expire(now)
+			t.startQueued(now)
 		}
-		t.gpio(true)
-		t.state = true
-		t.until = when
-		t.changeTicker.Stop()
-		t.changeTicker = time.NewTicker(when.Sub(now))
-		t.status.Set(1.0)
 	}
 }
 
-func (t *onOffThing) NeededUntil(name string, when time.Time) {
-	t.untilMutex.Lock()
-	t.neededUntil[name] = when
-
-	until := time.Now()
+// deadline returns when the last request for the thing runs out.
+func (t *onOffThing) deadline(now time.Time) time.Time {
+	until := now
+	if t.direct.After(until) {
+		until = t.direct
+	}
 	for _, v := range t.neededUntil {
 		if v.After(until) {
 			until = v
 		}
 	}
-	t.untilMutex.Unlock()
+	return until
+}
+
+// release shortens the time the thing runs to what the remaining requests
+// need.
+func (t *onOffThing) release(now time.Time) OnOffResult {
+	until := t.deadline(now)
+
+	if false == t.state {
+		if false == t.queued.IsZero() {
+			t.queued = time.Time{}
+			if until.After(now) {
+				t.queued = until
+			}
+		}
+		return OnOffResult{}
+	}
 
-	t.OnUntil(until)
+	if false == until.After(now) {
+		return t.off(now)
+	}
+	if until.Before(t.until) {
+		return t.onUntil(now, until)
+	}
+	return OnOffResult{}
 }
 
-func (t *onOffThing) run() {
-	defer t.wg.Done()
-	for {
-		t.mutex.Lock()
-		select {
-		case <-t.done:
-			t.stop()
-			t.mutex.Unlock()
-			return
-		case <-t.changeTicker.C:
-			t.stop()
-			t.mutex.Unlock()
-
-		case <-t.refreshTicker.C:
-			t.mutex.Unlock()
-			t.onTime.Inc()
-		default:
-			t.mutex.Unlock()
-			time.Sleep(100 * time.Millisecond)
+// drop forgets every request.
+func (t *onOffThing) drop() {
+	t.queued = time.Time{}
+	t.direct = time.Time{}
+	t.neededUntil = make(map[string]time.Time)
+}
+
+// claims returns the requesters that still need the thing, by name.
+func (t *onOffThing) claims() []OnOffClaim {
+	var list []OnOffClaim
+	for name, until := range t.neededUntil {
+		list = append(list, OnOffClaim{Name: name, Until: until})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (t *onOffThing) count(r OnOffResult) {
+	if Rejected == r.Outcome {
+		t.rejected.Inc()
+	} else if r.Clamped {
+		t.clamped.Inc()
+	}
+}
+
+// startQueued starts the request that was waiting for the blackout period
+// to end.
+func (t *onOffThing) startQueued(now time.Time) {
+	if t.queued.IsZero() || now.Before(t.notBefore) {
+		return
+	}
+	when := t.queued
+	t.queued = time.Time{}
+	t.count(t.onUntil(now, when))
+}
+
+func (t *onOffThing) onUntil(now, when time.Time) OnOffResult {
+	var r OnOffResult
+
+	if false == t.state {
+		if false == when.After(now) {
+			return r
+		}
+		if now.Before(t.notBefore) {
+			reason := "blackout period until " + t.notBefore.Format(time.Kitchen)
+			if false == t.queue || false == when.After(t.notBefore) {
+				return OnOffResult{Outcome: Rejected, Reason: reason}
+			}
+			t.queued = when
+			t.timer.Stop()
+			t.timer.Reset(t.notBefore.Sub(now))
+			return OnOffResult{Outcome: Deferred, Start: t.notBefore, Until: when, Reason: reason}
+		}
+
+		hour := now.Add(-1 * time.Hour)
+		for 0 < len(t.starts) && false == t.starts[0].After(hour) {
+			t.starts = t.starts[1:]
+		}
+		if 0 < t.maxStarts && len(t.starts) >= t.maxStarts {
+			return OnOffResult{Outcome: Rejected, Reason: "too many starts in the last hour"}
+		}
+		if reason := t.permit(); "" != reason {
+			return OnOffResult{Outcome: Rejected, Reason: reason}
+		}
+
+		t.gpio(true)
+		t.state = true
+		t.onSince = now
+		t.starts = append(t.starts, now)
+		t.status.Set(1.0)
+	}
+
+	if min := t.onSince.Add(t.minOnTime); when.Before(min) {
+		when = min
+		r.Clamped = true
+		r.Reason = "held on for the minimum on time"
+	}
+	t.cutoff = false
+	if max := t.onSince.Add(t.maxOnTime); 0 < t.maxOnTime && false == when.Before(max) {
+		t.cutoff = true
+		if when.After(max) {
+			when = max
+			r.Clamped = true
+			r.Reason = "cut short at the maximum on time"
+		}
+	}
+
+	t.until = when
+	t.timer.Stop()
+	t.timer.Reset(when.Sub(now))
+	return r
+}
+
+// off turns the thing off, or as soon as the minimum on time allows.
+func (t *onOffThing) off(now time.Time) OnOffResult {
+	if false == t.state {
+		return OnOffResult{}
+	}
+
+	if min := t.onSince.Add(t.minOnTime); now.Before(min) {
+		t.until = min
+		t.timer.Stop()
+		t.timer.Reset(min.Sub(now))
+		return OnOffResult{Clamped: true, Reason: "held on for the minimum on time"}
+	}
+
+	t.until = now
+	t.stop(now)
+	return OnOffResult{}
+}
+
+// expire turns the thing off if its time is up and forgets the requests
+// that have run out.  It is called both when the timer fires and before
+// each command so a late timer never matters.
+func (t *onOffThing) expire(now time.Time) {
+	if t.state && false == now.Before(t.until) {
+		t.stop(t.until)
+	}
+
+	for name, until := range t.neededUntil {
+		if false == now.Before(until) {
+			delete(t.neededUntil, name)
 		}
 	}
+	if false == now.Before(t.direct) {
+		t.direct = time.Time{}
+	}
 }
 
-func (t *onOffThing) stop() {
+// stop turns the thing off as of when, accounting for the on time exactly.
+func (t *onOffThing) stop(when time.Time) {
+	rest := t.blackoutPeriod
+	if t.state {
+		t.onTime.Add(when.Sub(t.onSince).Seconds())
+
+		// The safety cutoff rests the thing longer.
+		if t.cutoff && false == when.Before(t.onSince.Add(t.maxOnTime)) && t.maxOnRest > rest {
+			rest = t.maxOnRest
+		}
+	}
+	t.cutoff = false
 	t.gpio(false)
 	t.state = false
-	t.notBefore = time.Now().Add(t.blackoutPeriod)
-	t.changeTicker.Stop()
-	t.refreshTicker.Stop()
+	t.notBefore = when.Add(rest)
+	t.timer.Stop()
 	t.status.Set(0.0)
 }
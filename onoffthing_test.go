@@ -15,20 +15,31 @@
 package main
 
 import (
-	//"fmt"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+var testNamespaces int64
+
+// testNamespace returns a metrics namespace no other test has used, so the
+// tests can run more than once in the same process.
+func testNamespace(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, atomic.AddInt64(&testNamespaces, 1))
+}
+
 func TestBasics(t *testing.T) {
 	assert := assert.New(t)
 
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
 	opts := OnOffThingOpts{
-		Namespace: "testing",
-		Name:      "fan"}
+		Namespace: testNamespace("testing"),
+		Name:      "fan",
+		Clock:     clock}
 
 	oot := NewOnOffThing(opts)
 	s, when := oot.State()
@@ -36,16 +47,19 @@ func TestBasics(t *testing.T) {
 	assert.Equal(time.Time{}, when)
 
 	// Normal, set & wait.
-	oot.OnUntil(time.Now().Add(time.Second * 5))
+	oot.OnUntil(clock.Now().Add(time.Second * 5))
 	s, when = oot.State()
 	assert.True(s)
 	assert.NotEqual(time.Time{}, when)
-	time.Sleep(time.Second * 6)
+	clock.Advance(time.Second * 4)
+	s, _ = oot.State()
+	assert.True(s)
+	clock.Advance(time.Second * 2)
 	s, _ = oot.State()
 	assert.False(s)
 
 	// Stop it early.
-	oot.OnUntil(time.Now().Add(time.Second * 5))
+	oot.OnUntil(clock.Now().Add(time.Second * 5))
 	s, _ = oot.State()
 	assert.True(s)
 	oot.Off()
@@ -57,10 +71,12 @@ func TestBasics(t *testing.T) {
 func TestBlackout(t *testing.T) {
 	assert := assert.New(t)
 
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
 	opts := OnOffThingOpts{
-		Namespace:      "testing",
+		Namespace:      testNamespace("testing"),
 		Name:           "blackoutfan",
 		BlackoutPeriod: time.Second * 3,
+		Clock:          clock,
 	}
 
 	oot := NewOnOffThing(opts)
@@ -68,24 +84,24 @@ func TestBlackout(t *testing.T) {
 	assert.False(s)
 
 	/* Normal, set & wait. */
-	oot.OnUntil(time.Now().Add(time.Second * 2))
+	oot.OnUntil(clock.Now().Add(time.Second * 2))
 	s, _ = oot.State()
 	assert.True(s)
-	time.Sleep(time.Second * 3)
+	clock.Advance(time.Second * 3)
 	s, _ = oot.State()
 	assert.False(s)
 
 	/* Try to turn it back on during the blackout period */
-	oot.OnUntil(time.Now().Add(time.Second * 2))
+	oot.OnUntil(clock.Now().Add(time.Second * 2))
 	s, _ = oot.State()
 	assert.False(s)
 
-	time.Sleep(time.Second * 4)
+	clock.Advance(time.Second * 4)
 
 	/* Try to turn it back on after the blackout period */
 	s, _ = oot.State()
 	assert.False(s)
-	oot.OnUntil(time.Now().Add(time.Second * 2))
+	oot.OnUntil(clock.Now().Add(time.Second * 2))
 	s, _ = oot.State()
 	assert.True(s)
 
@@ -97,7 +113,7 @@ func TestNeededUntil(t *testing.T) {
 	//assert := assert.New(t)
 
 	opts := OnOffThingOpts{
-		Namespace: "testing",
+		Namespace: testNamespace("testing"),
 		Name:      "testNeededUntil",
 	}
 
@@ -128,3 +144,278 @@ func TestNeededUntil(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestTurnsOffWithoutPolling(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	gpio := make(chan bool, 10)
+	opts := OnOffThingOpts{
+		Namespace: testNamespace("testing"),
+		Name:      "timerfan",
+		Clock:     clock,
+		Gpio: func(on bool) {
+			gpio <- on
+		},
+	}
+
+	oot := NewOnOffThing(opts)
+	oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.True(<-gpio)
+
+	// Extending it doesn't toggle the output.
+	oot.OnUntil(clock.Now().Add(2 * time.Minute))
+	assert.Equal(0, len(gpio))
+
+	// The timer alone turns it off.
+	clock.Advance(2 * time.Minute)
+	select {
+	case on := <-gpio:
+		assert.False(on)
+	case <-time.After(time.Second):
+		assert.Fail("the thing was not turned off")
+	}
+
+	oot.Shutdown()
+
+	// Requests after shutdown are ignored.
+	oot.OnUntil(clock.Now().Add(time.Minute))
+	s, _ := oot.State()
+	assert.False(s)
+}
+
+func TestMinOnTime(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	oot := NewOnOffThing(OnOffThingOpts{
+		Namespace: testNamespace("testing"),
+		Name:      "minonpump",
+		MinOnTime: time.Minute,
+		Clock:     clock,
+	})
+
+	// A short request is stretched to the minimum.
+	r := oot.OnUntil(clock.Now().Add(time.Second * 5))
+	assert.True(r.On)
+	assert.True(r.Clamped)
+	assert.NotEqual(Rejected, r.Outcome)
+	assert.Equal(clock.Now().Add(time.Minute), r.Until)
+
+	// Off() waits for the minimum too.
+	clock.Advance(time.Second * 10)
+	r = oot.Off()
+	assert.True(r.On)
+	assert.True(r.Clamped)
+	assert.NotEqual("", r.Reason)
+
+	clock.Advance(time.Second * 49)
+	s, _ := oot.State()
+	assert.True(s)
+	clock.Advance(time.Second * 2)
+	s, _ = oot.State()
+	assert.False(s)
+
+	// Safety cutoffs don't wait.
+	oot.OnUntil(clock.Now().Add(time.Hour))
+	oot.ForceOff()
+	s, _ = oot.State()
+	assert.False(s)
+
+	oot.Shutdown()
+}
+
+func TestMaxOnTime(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	oot := NewOnOffThing(OnOffThingOpts{
+		Namespace: testNamespace("testing"),
+		Name:      "maxonpump",
+		MaxOnTime: time.Minute * 10,
+		MaxOnRest: time.Minute * 5,
+		Clock:     clock,
+	})
+
+	// A stuck caller keeps asking for more.
+	r := oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.True(r.On)
+	assert.False(r.Clamped)
+	for i := 0; i < 18; i++ {
+		clock.Advance(time.Second * 30)
+		r = oot.OnUntil(clock.Now().Add(time.Minute))
+	}
+	assert.True(r.On)
+	assert.False(r.Clamped)
+
+	clock.Advance(time.Second * 30)
+	r = oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.True(r.On)
+	assert.True(r.Clamped)
+
+	clock.Advance(time.Second * 31)
+	s, _ := oot.State()
+	assert.False(s)
+
+	// It rests before running again.
+	r = oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.False(r.On)
+	assert.Equal(Rejected, r.Outcome)
+	clock.Advance(time.Minute * 5)
+	r = oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.True(r.On)
+	assert.NotEqual(Rejected, r.Outcome)
+
+	// Turning it off early isn't a cutoff so there is no rest.
+	oot.Off()
+	clock.Advance(time.Second)
+	r = oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.True(r.On)
+
+	oot.Shutdown()
+}
+
+func TestMaxStartsPerHour(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	oot := NewOnOffThing(OnOffThingOpts{
+		Namespace:        testNamespace("testing"),
+		Name:             "startspump",
+		MaxStartsPerHour: 3,
+		Clock:            clock,
+	})
+
+	for i := 0; i < 3; i++ {
+		r := oot.OnUntil(clock.Now().Add(time.Minute))
+		assert.True(r.On)
+		clock.Advance(time.Minute * 10)
+	}
+
+	// A fourth start is refused.
+	r := oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.False(r.On)
+	assert.Equal(Rejected, r.Outcome)
+	assert.Equal("too many starts in the last hour", r.Reason)
+
+	// The first start ages out of the hour.
+	clock.Advance(time.Minute * 30)
+	r = oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.True(r.On)
+
+	// Extending a running thing isn't a start.
+	r = oot.OnUntil(clock.Now().Add(time.Minute * 2))
+	assert.True(r.On)
+	assert.NotEqual(Rejected, r.Outcome)
+
+	oot.Shutdown()
+}
+
+func TestQueueDuringBlackout(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	oot := NewOnOffThing(OnOffThingOpts{
+		Namespace:           testNamespace("testing"),
+		Name:                "queuedfan",
+		BlackoutPeriod:      time.Minute,
+		QueueDuringBlackout: true,
+		Clock:               clock,
+	})
+
+	r := oot.OnUntil(clock.Now().Add(time.Second * 10))
+	assert.Equal(Applied, r.Outcome)
+	assert.True(r.On)
+	clock.Advance(time.Second * 10)
+
+	// Too short to outlast the blackout.
+	r = oot.OnUntil(clock.Now().Add(time.Second * 30))
+	assert.Equal(Rejected, r.Outcome)
+	assert.NotEqual("", r.Reason)
+
+	r = oot.OnUntil(clock.Now().Add(time.Minute * 5))
+	assert.Equal(Deferred, r.Outcome)
+	assert.False(r.On)
+	assert.Equal(clock.Now().Add(time.Minute), r.Start)
+	assert.Equal(clock.Now().Add(time.Minute*5), r.Until)
+
+	clock.Advance(time.Second * 59)
+	s, _ := oot.State()
+	assert.False(s)
+	clock.Advance(time.Second)
+	s, when := oot.State()
+	assert.True(s)
+	assert.Equal(clock.Now().Add(time.Minute*4), when)
+
+	// Off() drops anything queued.
+	oot.Off()
+	clock.Advance(time.Second * 10)
+	r = oot.OnUntil(clock.Now().Add(time.Minute * 5))
+	assert.Equal(Deferred, r.Outcome)
+	oot.Off()
+	clock.Advance(time.Minute)
+	s, _ = oot.State()
+	assert.False(s)
+
+	oot.Shutdown()
+}
+
+func TestClaims(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	oot := NewOnOffThing(OnOffThingOpts{
+		Namespace: testNamespace("testing"),
+		Name:      "claimedpump",
+		Clock:     clock,
+	})
+	start := clock.Now()
+
+	r := oot.NeededUntil("upstairs", start.Add(time.Minute*5))
+	assert.True(r.On)
+	r = oot.NeededUntil("downstairs", start.Add(time.Minute*10))
+	assert.Equal(start.Add(time.Minute*10), r.Until)
+	assert.Equal([]OnOffClaim{
+		{Name: "downstairs", Until: start.Add(time.Minute * 10)},
+		{Name: "upstairs", Until: start.Add(time.Minute * 5)},
+	}, r.Claims)
+
+	// Releasing the longest claim falls back to the next one.
+	r = oot.Release("downstairs")
+	assert.True(r.On)
+	assert.Equal(start.Add(time.Minute*5), r.Until)
+	assert.Equal([]OnOffClaim{{Name: "upstairs", Until: start.Add(time.Minute * 5)}}, oot.Claims())
+
+	// Expired claims are forgotten.
+	oot.NeededUntil("freeze", start.Add(time.Minute))
+	clock.Advance(time.Minute * 2)
+	assert.Equal([]OnOffClaim{{Name: "upstairs", Until: start.Add(time.Minute * 5)}}, oot.Claims())
+
+	// A shorter direct request doesn't cut the claim short, and outlasts
+	// it once extended.
+	r = oot.OnUntil(clock.Now().Add(time.Minute))
+	assert.Equal(start.Add(time.Minute*5), r.Until)
+	r = oot.OnUntil(start.Add(time.Minute * 8))
+	assert.Equal(start.Add(time.Minute*8), r.Until)
+	r = oot.Release("upstairs")
+	assert.True(r.On)
+	assert.Equal(start.Add(time.Minute*8), r.Until)
+	clock.Advance(time.Minute * 6)
+	on, _ := oot.State()
+	assert.False(on)
+
+	// Releasing the last claim turns it off.
+	oot.NeededUntil("upstairs", clock.Now().Add(time.Minute))
+	r = oot.Release("upstairs")
+	assert.False(r.On)
+	assert.Nil(r.Claims)
+
+	// Off() drops every claim.
+	oot.NeededUntil("upstairs", clock.Now().Add(time.Minute))
+	oot.Off()
+	assert.Nil(oot.Claims())
+	on, _ = oot.State()
+	assert.False(on)
+
+	oot.Shutdown()
+}
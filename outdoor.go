@@ -0,0 +1,311 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type OutdoorTemp interface {
+	// Returns the outdoor temperature (F) and if the value is fresh enough
+	// to be trusted.
+	Get() (float64, bool)
+
+	// Shuts down and stops polling.
+	Shutdown()
+}
+
+type OutdoorTempOpts struct {
+	// The Namespace of the metrics for the thing
+	Namespace string
+
+	// The name of a TempSensors sensor to use as the outdoor temperature.
+	Sensor string
+
+	// The path to a local file containing the outdoor temperature (F).
+	File string
+
+	// The URL of a weather feed that returns the outdoor temperature (F).
+	URL string
+
+	// If set, the File or URL contains a JSON object and this is the name
+	// of the field holding the temperature.  Otherwise the content is
+	// expected to be a plain number.
+	Field string
+
+	// How often the File or URL is read.  The default is 5 minutes.
+	SamplePeriod time.Duration
+
+	// How old a reading, from any source, can be before it is no longer
+	// trusted.  The default is 3 sample periods.
+	MaxAge time.Duration
+
+	// The source of time.  The default is the wall clock.
+	Clock Clock
+}
+
+type outdoorTemp struct {
+	opts        OutdoorTempOpts
+	tempSensors *TempSensors
+	client      *http.Client
+	temp        float64
+	when        time.Time
+	wg          sync.WaitGroup
+	mutex       sync.Mutex
+	done        chan bool
+
+	// Metrics
+	gauge prometheus.Gauge
+}
+
+// NewOutdoorTemp creates the outdoor temperature source described by opts.
+// If no source is configured nil is returned.
+func NewOutdoorTemp(opts OutdoorTempOpts, ts *TempSensors) OutdoorTemp {
+	if "" == opts.Sensor && "" == opts.File && "" == opts.URL {
+		return nil
+	}
+
+	if 0 == opts.SamplePeriod {
+		opts.SamplePeriod = 5 * time.Minute
+	}
+	if 0 == opts.MaxAge {
+		opts.MaxAge = 3 * opts.SamplePeriod
+	}
+	if nil == opts.Clock {
+		opts.Clock = RealClock{}
+	}
+
+	o := &outdoorTemp{
+		opts:        opts,
+		tempSensors: ts,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		done:        make(chan bool),
+	}
+
+	o.gauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: opts.Namespace,
+		Subsystem: "physical",
+		Name:      "outdoor_temp",
+		Help:      "outdoor temperature (F)",
+	})
+
+	if "" == opts.Sensor {
+		o.sample()
+		o.wg.Add(1)
+		go o.run()
+	}
+
+	return o
+}
+
+func (o *outdoorTemp) Shutdown() {
+	if "" == o.opts.Sensor {
+		o.done <- true
+		o.wg.Wait()
+	}
+}
+
+func (o *outdoorTemp) Get() (float64, bool) {
+	if "" != o.opts.Sensor {
+		temp, ok := freshReading(o.tempSensors, o.opts.Sensor, o.opts.Clock.Now(), o.opts.MaxAge)
+		if ok {
+			o.gauge.Set(temp)
+		}
+		return temp, ok
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.when.IsZero() || o.opts.Clock.Since(o.when) > o.opts.MaxAge {
+		return o.temp, false
+	}
+	return o.temp, true
+}
+
+func (o *outdoorTemp) run() {
+	defer o.wg.Done()
+
+	t := o.opts.Clock.NewTicker(o.opts.SamplePeriod)
+	for {
+		select {
+		case <-o.done:
+			t.Stop()
+			return
+		case <-t.C():
+			o.sample()
+		}
+	}
+}
+
+func (o *outdoorTemp) sample() {
+	buf, err := o.fetch()
+	if nil != err {
+		fmt.Printf("Outdoor temperature: %v\n", err)
+		return
+	}
+
+	temp, err := o.parse(buf)
+	if nil != err {
+		fmt.Printf("Outdoor temperature: %v\n", err)
+		return
+	}
+
+	o.mutex.Lock()
+	o.temp = temp
+	o.when = o.opts.Clock.Now()
+	o.mutex.Unlock()
+	o.gauge.Set(temp)
+}
+
+func (o *outdoorTemp) fetch() ([]byte, error) {
+	if "" != o.opts.File {
+		return ioutil.ReadFile(o.opts.File)
+	}
+
+	resp, err := o.client.Get(o.opts.URL)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		return nil, fmt.Errorf("'%s' returned %d", o.opts.URL, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (o *outdoorTemp) parse(buf []byte) (float64, error) {
+	if "" == o.opts.Field {
+		return strconv.ParseFloat(strings.TrimSpace(string(buf)), 64)
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf, &obj); nil != err {
+		return 0, err
+	}
+	if temp, ok := obj[o.opts.Field].(float64); ok {
+		return temp, nil
+	}
+	return 0, fmt.Errorf("field '%s' not found or not a number", o.opts.Field)
+}
+
+// ResetPoint is a single point on a ResetCurve.
+type ResetPoint struct {
+	// The outdoor temperature (F)
+	Outdoor float64
+
+	// The value at this outdoor temperature.
+	Value float64
+}
+
+// ResetCurve maps outdoor temperature to a value using linear interpolation
+// between the points.  Outside the points the nearest value is used.
+type ResetCurve []ResetPoint
+
+// At returns the value of the curve at the outdoor temperature.
+func (c ResetCurve) At(outdoor float64) float64 {
+	if 0 == len(c) {
+		return 0
+	}
+
+	list := make(ResetCurve, len(c))
+	copy(list, c)
+	sort.Slice(list, func(i, j int) bool { return list[i].Outdoor < list[j].Outdoor })
+
+	if outdoor <= list[0].Outdoor {
+		return list[0].Value
+	}
+	for i := 1; i < len(list); i++ {
+		if outdoor <= list[i].Outdoor {
+			lo, hi := list[i-1], list[i]
+			return lo.Value + (hi.Value-lo.Value)*(outdoor-lo.Outdoor)/(hi.Outdoor-lo.Outdoor)
+		}
+	}
+	return list[len(list)-1].Value
+}
+
+type OutdoorResetOpts struct {
+	// Maps the outdoor temperature (F) to how many minutes a zone is heated
+	// each time its thermostat calls for heat.  The default, and the value
+	// used when the outdoor temperature is unknown, is 3 minutes.
+	RunTime ResetCurve
+
+	// Maps the outdoor temperature (F) to how many minutes before a
+	// scheduled setpoint change heating starts working towards the new
+	// setpoint.  The default, and the value used when the outdoor
+	// temperature is unknown, is no early start.
+	EarlyStart ResetCurve
+
+	// Above this outdoor temperature (F) the thermostats do not call for
+	// heat.  Zero disables the shutdown.
+	WarmWeatherShutdown float64
+}
+
+// heatRunTime returns how long a zone should be heated when its thermostat
+// calls for heat.
+func (l *Logic) heatRunTime() time.Duration {
+	if 0 == len(l.opts.Reset.RunTime) {
+		return time.Minute * 3
+	}
+
+	outdoor, ok := l.outdoorTemp()
+	if false == ok {
+		return time.Minute * 3
+	}
+	return time.Duration(l.opts.Reset.RunTime.At(outdoor) * float64(time.Minute))
+}
+
+// earlyStart returns how long before a scheduled setpoint change heating
+// should start.
+func (l *Logic) earlyStart() time.Duration {
+	if 0 == len(l.opts.Reset.EarlyStart) {
+		return 0
+	}
+
+	outdoor, ok := l.outdoorTemp()
+	if false == ok {
+		return 0
+	}
+	return time.Duration(l.opts.Reset.EarlyStart.At(outdoor) * float64(time.Minute))
+}
+
+// warmWeatherShutdown returns true when it is warm enough outside that the
+// thermostats should not call for heat.
+func (l *Logic) warmWeatherShutdown() bool {
+	if 0 == l.opts.Reset.WarmWeatherShutdown {
+		return false
+	}
+
+	outdoor, ok := l.outdoorTemp()
+	return ok && outdoor > l.opts.Reset.WarmWeatherShutdown
+}
+
+func (l *Logic) outdoorTemp() (float64, bool) {
+	if nil == l.outdoor {
+		return 0, false
+	}
+	return l.outdoor.Get()
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResetCurve(t *testing.T) {
+	assert := assert.New(t)
+
+	var empty ResetCurve
+	assert.Equal(0.0, empty.At(20))
+
+	c := ResetCurve{
+		{Outdoor: 50, Value: 2},
+		{Outdoor: 0, Value: 6},
+	}
+
+	assert.Equal(6.0, c.At(-20))
+	assert.Equal(6.0, c.At(0))
+	assert.Equal(4.0, c.At(25))
+	assert.Equal(2.0, c.At(50))
+	assert.Equal(2.0, c.At(80))
+}
+
+func TestOutdoorTempFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "outdoor")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "weather.json")
+	ioutil.WriteFile(file, []byte(`{"temp": 21.5}`), 0644)
+
+	o := NewOutdoorTemp(OutdoorTempOpts{
+		Namespace:    testNamespace("testing"),
+		File:         file,
+		Field:        "temp",
+		SamplePeriod: time.Hour,
+	}, nil)
+
+	temp, ok := o.Get()
+	assert.True(ok)
+	assert.Equal(21.5, temp)
+	o.Shutdown()
+
+	assert.Nil(NewOutdoorTemp(OutdoorTempOpts{}, nil))
+}
+
+func TestOutdoorTempSensor(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	sensors.clock = clock
+	var ts TempSensors = sensors
+
+	o := NewOutdoorTemp(OutdoorTempOpts{
+		Namespace: testNamespace("testing_sensor"),
+		Sensor:    "outdoor",
+		MaxAge:    time.Minute,
+		Clock:     clock,
+	}, &ts)
+
+	_, ok := o.Get()
+	assert.False(ok)
+
+	sensors.Set("outdoor", 18)
+	temp, ok := o.Get()
+	assert.True(ok)
+	assert.Equal(18.0, temp)
+
+	// A sensor that stops reading isn't trusted.
+	clock.Advance(time.Minute * 2)
+	_, ok = o.Get()
+	assert.False(ok)
+	o.Shutdown()
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// OverrideMode is how an output is controlled.
+type OverrideMode int
+
+const (
+	// Auto leaves the output to the automatic control.
+	Auto OverrideMode = iota
+
+	// ForcedOn keeps the relay on whatever the automatic control wants.
+	ForcedOn
+
+	// ForcedOff keeps the relay off whatever the automatic control wants,
+	// for example for maintenance.
+	ForcedOff
+)
+
+func (m OverrideMode) String() string {
+	switch m {
+	case Auto:
+		return "auto"
+	case ForcedOn:
+		return "on"
+	case ForcedOff:
+		return "off"
+	}
+	return "unknown"
+}
+
+// ParseOverrideMode converts "auto", "on" or "off" into an OverrideMode.
+func ParseOverrideMode(s string) (OverrideMode, error) {
+	for _, m := range []OverrideMode{Auto, ForcedOn, ForcedOff} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return Auto, fmt.Errorf("Invalid override mode '%s'", s)
+}
+
+// Override is the manual mode an output is held in.  The zero Until means
+// until it is changed.
+type Override struct {
+	Mode  OverrideMode
+	Until time.Time
+}
+
+// SetOverride holds the named output in the mode until the time given, or
+// until it is changed if until is the zero time.  Forcing an output on also
+// runs what it requires and stops what it can't run with.  The heat source
+// can't be forced on since only its control enforces the high limit.
+func (l *Logic) SetOverride(name string, mode OverrideMode, until time.Time) error {
+	now := l.clock.Now()
+	if Auto != mode && false == until.IsZero() && false == until.After(now) {
+		return fmt.Errorf("the override would end at %s which has passed", until.Format(time.Kitchen))
+	}
+
+	if err := l.setOverride(name, mode, until); nil != err {
+		return err
+	}
+
+	// Scheduled once relayMutex is released since the clock may call back
+	// right away.
+	if Auto != mode && false == until.IsZero() {
+		l.clock.AfterFunc(until.Sub(now), l.refreshRelays)
+	}
+	return nil
+}
+
+func (l *Logic) setOverride(name string, mode OverrideMode, until time.Time) error {
+	l.relayMutex.Lock()
+	defer l.relayMutex.Unlock()
+
+	o, ok := l.outputs[name]
+	if false == ok {
+		return fmt.Errorf("Unknown output '%s'", name)
+	}
+
+	if ForcedOn == mode {
+		if l.emergencyStop {
+			return fmt.Errorf("the emergency stop is active")
+		}
+		if nil != l.heatSource && o.thing == l.heatSource {
+			return fmt.Errorf("%s can't be forced on, it only runs under the high limit control", name)
+		}
+		for _, v := range l.opts.Interlocks {
+			if name == v.Output && "" != v.Requires && ForcedOff == l.outputs[v.Requires].override.Mode {
+				return fmt.Errorf("%s requires %s which is forced off", name, v.Requires)
+			}
+		}
+	}
+
+	prev := o.override
+	o.override = Override{Mode: mode, Until: until}
+	forced := l.forcedOn()
+	for _, v := range l.opts.Interlocks {
+		if "" != v.Excludes && forced[v.Output] && forced[v.Excludes] {
+			o.override = prev
+			return fmt.Errorf("%s excludes %s which would both be forced on", v.Output, v.Excludes)
+		}
+	}
+
+	if Auto == mode {
+		o.override.Until = time.Time{}
+		fmt.Printf("Override: %s back to auto\n", name)
+	} else if until.IsZero() {
+		fmt.Printf("Override: %s forced %s\n", name, mode)
+	} else {
+		fmt.Printf("Override: %s forced %s until %s\n", name, mode, until.Format(time.Kitchen))
+	}
+
+	l.applyRelays()
+	return nil
+}
+
+// EmergencyStop switches every relay off while stop is set, whatever the
+// automatic control or the overrides want.  The automatic control takes
+// over again once it is cleared.
+func (l *Logic) EmergencyStop(stop bool) {
+	l.relayMutex.Lock()
+	defer l.relayMutex.Unlock()
+
+	if stop != l.emergencyStop {
+		if stop {
+			fmt.Printf("Override: emergency stop, all outputs off\n")
+		} else {
+			fmt.Printf("Override: emergency stop cleared\n")
+		}
+	}
+	l.emergencyStop = stop
+
+	l.applyRelays()
+}
+
+// forcedOn returns the outputs forced on along with the outputs they
+// require.  The caller must hold relayMutex.
+func (l *Logic) forcedOn() map[string]bool {
+	forced := make(map[string]bool)
+	for name, o := range l.outputs {
+		if ForcedOn == o.override.Mode {
+			forced[name] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, v := range l.opts.Interlocks {
+			if forced[v.Output] && "" != v.Requires && false == forced[v.Requires] &&
+				ForcedOff != l.outputs[v.Requires].override.Mode {
+				forced[v.Requires] = true
+				changed = true
+			}
+		}
+	}
+	return forced
+}
+
+// applyOverrides changes which outputs are on to match the overrides and
+// the emergency stop.  The caller must hold relayMutex.
+func (l *Logic) applyOverrides(now time.Time, on map[string]bool) {
+	if l.emergencyStop {
+		for name := range on {
+			on[name] = false
+		}
+		return
+	}
+
+	for name, o := range l.outputs {
+		if Auto != o.override.Mode && false == o.override.Until.IsZero() && false == now.Before(o.override.Until) {
+			fmt.Printf("Override: %s expired, back to auto\n", name)
+			o.override = Override{}
+		}
+		switch o.override.Mode {
+		case ForcedOn:
+			on[name] = true
+		case ForcedOff:
+			on[name] = false
+		}
+	}
+
+	// Forced on outputs bring what they require.
+	forced := l.forcedOn()
+	for name := range forced {
+		on[name] = true
+	}
+
+	// And stop what can't run with them.
+	for _, v := range l.opts.Interlocks {
+		if "" == v.Excludes {
+			continue
+		}
+		if forced[v.Output] && false == forced[v.Excludes] {
+			on[v.Excludes] = false
+		}
+		if forced[v.Excludes] && false == forced[v.Output] {
+			on[v.Output] = false
+		}
+	}
+
+	// Nothing runs without what it requires, like the heat source when the
+	// heater loop pump is forced off.
+	for changed := true; changed; {
+		changed = false
+		for _, v := range l.opts.Interlocks {
+			if "" != v.Requires && on[v.Output] && false == on[v.Requires] {
+				on[v.Output] = false
+				changed = true
+			}
+		}
+	}
+}
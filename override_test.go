@@ -0,0 +1,153 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOverrideMode(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, m := range []OverrideMode{Auto, ForcedOn, ForcedOff} {
+		got, err := ParseOverrideMode(m.String())
+		assert.Nil(err)
+		assert.Equal(m, got)
+	}
+
+	_, err := ParseOverrideMode("sideways")
+	assert.NotNil(err)
+}
+
+func TestOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Interlocks: []Interlock{
+		{Output: "ov_zone", Requires: "ov_loop"},
+		{Output: "ov_fan", Excludes: "ov_loop"},
+	}}, nil)
+	zone := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ov_zone"}, 1)
+	loop := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ov_loop"}, 2)
+	fan := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ov_fan"}, 4)
+	l.checkInterlocks()
+
+	relays := func() int {
+		l.relayMutex.Lock()
+		defer l.relayMutex.Unlock()
+		return l.controlBitMask
+	}
+
+	zone.OnUntil(clock.Now().Add(time.Hour * 2))
+	zone.State()
+	assert.Equal(3, relays())
+
+	// Nothing runs without what it requires.
+	assert.Nil(l.SetOverride("ov_loop", ForcedOff, time.Time{}))
+	assert.Equal(0, relays())
+	s := l.Status()
+	assert.Equal("auto", s.Outputs[0].Override)
+	assert.Equal("off", s.Outputs[1].Override)
+	assert.True(s.Outputs[0].On)
+
+	assert.NotNil(l.SetOverride("ov_zone", ForcedOn, time.Time{}))
+	assert.NotNil(l.SetOverride("ov_missing", ForcedOff, time.Time{}))
+
+	assert.Nil(l.SetOverride("ov_loop", Auto, time.Time{}))
+	assert.Equal(3, relays())
+
+	// Overrides expire.
+	until := clock.Now().Add(time.Minute * 10)
+	assert.Nil(l.SetOverride("ov_zone", ForcedOff, until))
+	assert.Equal(2, relays())
+	assert.Equal(until, l.Status().Outputs[0].OverrideUntil)
+	clock.Advance(time.Minute * 10)
+	assert.Equal(3, relays())
+	assert.Equal("auto", l.Status().Outputs[0].Override)
+
+	// Forcing the fan on stops what it excludes.
+	assert.Nil(l.SetOverride("ov_fan", ForcedOn, time.Time{}))
+	assert.Equal(4, relays())
+	assert.NotNil(l.SetOverride("ov_loop", ForcedOn, time.Time{}))
+	assert.NotNil(l.SetOverride("ov_zone", ForcedOn, time.Time{}))
+	assert.Equal("auto", l.Status().Outputs[0].Override)
+	assert.Nil(l.SetOverride("ov_fan", Auto, time.Time{}))
+	assert.Equal(3, relays())
+
+	// Forcing the zone on brings the loop with it.
+	zone.Off()
+	zone.State()
+	clock.Advance(time.Second)
+	loop.State()
+	assert.Equal(0, relays())
+	assert.Nil(l.SetOverride("ov_zone", ForcedOn, time.Time{}))
+	assert.Equal(3, relays())
+
+	// The emergency stop beats everything.
+	l.EmergencyStop(true)
+	assert.Equal(0, relays())
+	assert.True(l.Status().EmergencyStop)
+	assert.NotNil(l.SetOverride("ov_fan", ForcedOn, time.Time{}))
+	fan.OnUntil(clock.Now().Add(time.Hour))
+	fan.State()
+	assert.Equal(0, relays())
+
+	l.EmergencyStop(false)
+	assert.Equal(3, relays())
+	assert.False(l.Status().EmergencyStop)
+
+	zone.Shutdown()
+	loop.Shutdown()
+	fan.Shutdown()
+}
+
+func TestOverrideRefused(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Interlocks: []Interlock{
+		{Output: "ovr_burner", Requires: "ovr_loop"},
+	}}, nil)
+	loop := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ovr_loop"}, 1)
+	l.heatSource = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ovr_burner"}, 2)
+	l.checkInterlocks()
+
+	relays := func() int {
+		l.relayMutex.Lock()
+		defer l.relayMutex.Unlock()
+		return l.controlBitMask
+	}
+
+	// The burner only fires under the high limit control.
+	assert.NotNil(l.SetOverride("ovr_burner", ForcedOn, time.Time{}))
+	assert.Nil(l.SetOverride("ovr_burner", ForcedOff, time.Time{}))
+	assert.Nil(l.SetOverride("ovr_burner", Auto, time.Time{}))
+
+	// An end that has passed is refused rather than run right away.
+	assert.NotNil(l.SetOverride("ovr_loop", ForcedOn, clock.Now()))
+	assert.NotNil(l.SetOverride("ovr_loop", ForcedOn, clock.Now().Add(-time.Minute)))
+	assert.Equal(0, relays())
+
+	assert.Nil(l.SetOverride("ovr_loop", ForcedOn, clock.Now().Add(time.Minute)))
+	assert.Equal(1, relays())
+	clock.Advance(time.Minute)
+	assert.Equal(0, relays())
+
+	loop.Shutdown()
+	l.heatSource.Shutdown()
+}
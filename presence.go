@@ -0,0 +1,299 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PresenceOpts struct {
+	// The people tracked on the local network mapped to the MAC address of
+	// their phone.  People can also be reported with SetPresence.
+	Devices map[string]string
+
+	// Where the neighbor table is read from.  The default is /proc/net/arp.
+	NeighborFile string
+
+	// How often the neighbor table is scanned.  The default is 1 minute.
+	ScanPeriod time.Duration
+
+	// How long after someone was last seen they are still counted as home,
+	// since phones drop off the network while asleep.  The default is 15
+	// minutes.
+	Timeout time.Duration
+
+	// Switches the house to away once everyone has left and back home when
+	// someone arrives.  Everyone leaving doesn't change a vacation.
+	AutoAway bool
+
+	// Preheats the domestic hot water when someone arrives.
+	PreheatOnArrival bool
+
+	// The downstairs target (F) set when someone arrives.  0 leaves it.
+	ArrivalTarget float64
+}
+
+// PersonStatus is whether someone is home.
+type PersonStatus struct {
+	Name     string    `json:"name"`
+	Home     bool      `json:"home"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+
+	// If they said they are home through SetPresence, which lasts until
+	// they say they have left.
+	Reported bool `json:"reported"`
+}
+
+// sighting is when someone was last seen and how.
+type sighting struct {
+	// The zero time means they were reported gone.
+	when time.Time
+
+	// They reported themselves home, as opposed to their phone being seen
+	// on the network, which only counts for the timeout.
+	reported bool
+}
+
+type presence struct {
+	seen map[string]sighting
+
+	// When tracking started, so people aren't counted gone right away.
+	since time.Time
+
+	// If anyone was home at the last step.
+	home bool
+
+	// If the house is away because everyone left, so coming home ends it.
+	// A vacation or away set by hand is left alone.
+	setAway bool
+
+	mutex sync.Mutex
+}
+
+func newPresence(now time.Time, opts PresenceOpts) *presence {
+	p := &presence{
+		seen:  make(map[string]sighting),
+		since: now,
+		home:  true,
+	}
+	for name := range opts.Devices {
+		p.seen[name] = sighting{when: now}
+	}
+	return p
+}
+
+func (l *Logic) presenceTimeout() time.Duration {
+	if 0 == l.opts.Presence.Timeout {
+		return time.Minute * 15
+	}
+	return l.opts.Presence.Timeout
+}
+
+// isHome returns if the person is home at now.  The caller must hold the
+// presence mutex.
+func (p *presence) isHome(s sighting, now time.Time, timeout time.Duration) bool {
+	if s.reported {
+		return true
+	}
+	seen := s.when
+	if seen.IsZero() {
+		return false
+	}
+	if seen.Before(p.since) {
+		seen = p.since
+	}
+	return now.Sub(seen) < timeout
+}
+
+// SetPresence records that the named person is home or has left, for
+// example from their phone.  Someone reported home stays home until they
+// are reported gone.
+func (l *Logic) SetPresence(name string, home bool) {
+	now := l.clock.Now()
+
+	l.presence.mutex.Lock()
+	if home {
+		l.presence.seen[name] = sighting{when: now, reported: true}
+	} else {
+		l.presence.seen[name] = sighting{}
+	}
+	l.presence.mutex.Unlock()
+
+	l.presenceStep(now)
+}
+
+// Presence returns who is home.
+func (l *Logic) Presence() []PersonStatus {
+	now := l.clock.Now()
+	timeout := l.presenceTimeout()
+
+	l.presence.mutex.Lock()
+	defer l.presence.mutex.Unlock()
+
+	list := []PersonStatus{}
+	for name, seen := range l.presence.seen {
+		list = append(list, PersonStatus{
+			Name:     name,
+			Home:     l.presence.isHome(seen, now, timeout),
+			LastSeen: seen.when,
+			Reported: seen.reported,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// presenceStep works out if anyone is home and acts on arrivals and
+// departures.
+func (l *Logic) presenceStep(now time.Time) {
+	opts := l.opts.Presence
+	timeout := l.presenceTimeout()
+	p := l.presence
+
+	p.mutex.Lock()
+	count := 0
+	for _, seen := range p.seen {
+		if p.isHome(seen, now, timeout) {
+			count++
+		}
+	}
+	l.presenceGauge.Set(float64(count))
+
+	// Nobody is tracked yet.
+	if 0 == len(p.seen) {
+		p.mutex.Unlock()
+		return
+	}
+
+	home := 0 < count
+	arrived := home && false == p.home
+	left := false == home && p.home
+	p.home = home
+	setAway := p.setAway
+	if arrived {
+		p.setAway = false
+	}
+	p.mutex.Unlock()
+
+	if arrived {
+		fmt.Printf("Presence: someone is home\n")
+		if opts.AutoAway && setAway && Away == l.modeAt(now).Mode {
+			if err := l.SetMode(Home, time.Time{}, time.Time{}); nil != err {
+				fmt.Printf("Presence: %v\n", err)
+			}
+		}
+		if 0 != opts.ArrivalTarget {
+			l.SetDownstairsTarget(opts.ArrivalTarget)
+		}
+		if opts.PreheatOnArrival {
+			if r := l.Preheat(); Rejected == r.Outcome {
+				fmt.Printf("Presence: preheat %s\n", r.Reason)
+			}
+		}
+	}
+
+	if left {
+		fmt.Printf("Presence: everyone has left\n")
+		if opts.AutoAway && false == l.away(now) {
+			if err := l.SetMode(Away, time.Time{}, time.Time{}); nil != err {
+				fmt.Printf("Presence: %v\n", err)
+			} else {
+				p.mutex.Lock()
+				p.setAway = true
+				p.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// readNeighbors returns the MAC addresses (lower case) of the complete
+// entries in a /proc/net/arp style neighbor table.
+func readNeighbors(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	macs := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // The header.
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || "0x0" == fields[2] {
+			continue
+		}
+		macs[strings.ToLower(fields[3])] = true
+	}
+	return macs, scanner.Err()
+}
+
+// scanNeighbors marks the people whose phones are in the neighbor table as
+// seen.
+func (l *Logic) scanNeighbors(now time.Time) {
+	opts := l.opts.Presence
+	file := opts.NeighborFile
+	if "" == file {
+		file = "/proc/net/arp"
+	}
+
+	macs, err := readNeighbors(file)
+	if nil != err {
+		fmt.Printf("Presence: %v\n", err)
+		return
+	}
+
+	l.presence.mutex.Lock()
+	for name, mac := range opts.Devices {
+		if macs[strings.ToLower(mac)] {
+			s := l.presence.seen[name]
+			s.when = now
+			l.presence.seen[name] = s
+		}
+	}
+	l.presence.mutex.Unlock()
+}
+
+// presenceTracking scans for the tracked phones and acts on people coming
+// and going.
+func (l *Logic) presenceTracking() {
+	defer l.wg.Done()
+
+	period := l.opts.Presence.ScanPeriod
+	if 0 == period {
+		period = time.Minute
+	}
+
+	t := l.clock.NewTicker(period)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			if 0 < len(l.opts.Presence.Devices) {
+				l.scanNeighbors(now)
+			}
+			l.presenceStep(now)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testNeighbors = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.20     0x1         0x2         AA:BB:CC:00:11:22     *        eth0
+192.168.1.21     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.22     0x1         0x2         aa:bb:cc:33:44:55     *        eth0
+`
+
+func TestReadNeighbors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "presence")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "arp")
+	assert.Nil(ioutil.WriteFile(file, []byte(testNeighbors), 0644))
+
+	macs, err := readNeighbors(file)
+	assert.Nil(err)
+	assert.Equal(map[string]bool{
+		"aa:bb:cc:00:11:22": true,
+		"aa:bb:cc:33:44:55": true,
+	}, macs)
+
+	_, err = readNeighbors(filepath.Join(dir, "missing"))
+	assert.NotNil(err)
+}
+
+func TestPresence(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "presence")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "arp")
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{Presence: PresenceOpts{
+		Devices:          map[string]string{"alex": "AA:BB:CC:00:11:22"},
+		NeighborFile:     file,
+		Timeout:          time.Minute * 10,
+		AutoAway:         true,
+		PreheatOnArrival: true,
+		ArrivalTarget:    70,
+	}}, nil)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "pr_loop"}, 1)
+	l.recircDHPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "pr_recirc"}, 2)
+
+	step := func(d time.Duration) {
+		clock.Advance(d)
+		l.scanNeighbors(clock.Now())
+		l.presenceStep(clock.Now())
+	}
+
+	// The phone isn't on the network, but it hasn't been long.
+	assert.Nil(ioutil.WriteFile(file, []byte("header\n"), 0644))
+	step(time.Minute)
+	assert.Equal(Home, l.Mode().Mode)
+
+	step(time.Minute * 9)
+	assert.Equal(Away, l.Mode().Mode)
+	assert.Equal([]PersonStatus{{Name: "alex", Home: false, LastSeen: clock.Now().Add(-time.Minute * 10)}}, l.Presence())
+
+	// The phone joins the network.
+	assert.Nil(ioutil.WriteFile(file, []byte(testNeighbors), 0644))
+	step(time.Minute)
+	assert.Equal(Home, l.Mode().Mode)
+	assert.Equal(70.0, l.downstairsTemp)
+	on, _ := l.recircDHPump.State()
+	assert.True(on)
+
+	// Someone else says they left, but alex is still home.
+	l.SetPresence("sam", false)
+	assert.Equal(Home, l.Mode().Mode)
+
+	// Everyone gone.
+	assert.Nil(ioutil.WriteFile(file, []byte("header\n"), 0644))
+	step(time.Minute * 10)
+	assert.Equal(Away, l.Mode().Mode)
+
+	// A phone calls in.
+	l.SetPresence("sam", true)
+	assert.Equal(Home, l.Mode().Mode)
+
+	// Saying so lasts past the timeout, even with the phone off the
+	// network.
+	step(time.Minute * 30)
+	assert.Equal(Home, l.Mode().Mode)
+	assert.Equal(PersonStatus{Name: "sam", Home: true, LastSeen: clock.Now().Add(-time.Minute * 30), Reported: true}, l.Presence()[1])
+
+	// Until sam says they left.
+	l.SetPresence("sam", false)
+	assert.Equal(Away, l.Mode().Mode)
+	l.SetPresence("sam", true)
+
+	// Leaving doesn't end a vacation.
+	assert.Nil(l.SetMode(Vacation, time.Time{}, time.Time{}))
+	l.SetPresence("sam", false)
+	step(time.Minute * 10)
+	assert.Equal(Vacation, l.Mode().Mode)
+
+	// Nor does a house sitter, or a phone left behind, turning up while
+	// the vacation is in progress.
+	assert.Nil(ioutil.WriteFile(file, []byte(testNeighbors), 0644))
+	step(time.Minute)
+	assert.Equal(Vacation, l.Mode().Mode)
+	assert.Nil(ioutil.WriteFile(file, []byte("header\n"), 0644))
+	step(time.Minute * 10)
+	assert.Equal(Vacation, l.Mode().Mode)
+
+	// Away set by hand is left alone too.
+	assert.Nil(l.SetMode(Away, time.Time{}, time.Time{}))
+	l.SetPresence("sam", true)
+	assert.Equal(Away, l.Mode().Mode)
+
+	l.heaterLoopPump.Shutdown()
+	l.recircDHPump.Shutdown()
+}
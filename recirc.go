@@ -0,0 +1,307 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	usageSlot      = 15 * time.Minute
+	usageSlotCount = int(7 * 24 * time.Hour / usageSlot)
+	usageWeek      = 7 * 24 * time.Hour
+)
+
+type RecircOpts struct {
+	// The times of day the domestic hot water is kept hot.
+	Windows DailyWindows
+
+	// How long an on-demand request keeps the recirculation running if
+	// the return line never gets hot.  The default is 5 minutes.
+	DemandPeriod time.Duration
+
+	// The name of the TempSensors sensor on the recirculation return line.
+	// If empty the pump runs for the whole window or demand period.
+	ReturnSensor string
+
+	// The return line temperature (F) that means hot water has arrived.
+	// The default is 100F.
+	HotTemp float64
+
+	// How far (F) below HotTemp the return line must cool before the pump
+	// is run again.  The default is 10F.
+	Hysteresis float64
+
+	// Enables learning when hot water is usually used and preheating
+	// before those times.
+	Learn bool
+
+	// How far ahead of the usual usage the preheating starts.  The
+	// default is 10 minutes.
+	LearnLead time.Duration
+
+	// The number of gallons usually used in a 15 minute slot of the week
+	// that is worth preheating for.  The default is 1 gallon.
+	LearnThreshold float64
+
+	// How much weight the latest week gets when updating the usage
+	// profile (0-1).  The default is 0.25.
+	LearnWeight float64
+
+	// Where the learned profile is saved so it survives restarts.  If
+	// empty the profile is only kept in memory.
+	ProfileFile string
+}
+
+// usageProfile is the weekly domestic hot water usage broken into 15 minute
+// slots starting at midnight Sunday.
+type usageProfile struct {
+	Slots [usageSlotCount]usageSlotHistory
+
+	mutex sync.Mutex
+}
+
+type usageSlotHistory struct {
+	// The week this slot was last used in.
+	Week int64
+
+	// Gallons used in this slot in Week.
+	Current float64
+
+	// The weighted average gallons used in this slot across the weeks.
+	Average float64
+}
+
+func usageIndex(when time.Time) (int64, int) {
+	y, m, d := when.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, when.Location())
+	slot := (int(when.Weekday())*24*int(time.Hour) + int(when.Sub(midnight))) / int(usageSlot)
+
+	sunday := midnight.AddDate(0, 0, -int(when.Weekday()))
+	week := time.Date(sunday.Year(), sunday.Month(), sunday.Day(), 0, 0, 0, 0, time.UTC).Unix() / int64(usageWeek/time.Second)
+
+	return week, slot % usageSlotCount
+}
+
+// fold moves the current usage into the average if the week has changed.
+func (h *usageSlotHistory) fold(week int64, weight float64) {
+	if week == h.Week {
+		return
+	}
+	if 0 < h.Week {
+		h.Average = h.Average*(1-weight) + h.Current*weight
+
+		// Weeks without any usage count as zero.
+		if missed := week - h.Week - 1; 0 < missed {
+			h.Average *= math.Pow(1-weight, float64(missed))
+		}
+	}
+	h.Week = week
+	h.Current = 0
+}
+
+func (p *usageProfile) record(when time.Time, gallons, weight float64) {
+	week, slot := usageIndex(when)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Slots[slot].fold(week, weight)
+	p.Slots[slot].Current += gallons
+}
+
+// expected returns the largest usual usage in any slot between from and to.
+func (p *usageProfile) expected(from, to time.Time, weight float64) float64 {
+	var rv float64
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for when := from; ; when = when.Add(usageSlot) {
+		// The slot holding to counts even when it is less than a slot
+		// after the last one.
+		if when.After(to) {
+			when = to
+		}
+		week, slot := usageIndex(when)
+		h := p.Slots[slot]
+		h.fold(week, weight)
+		if h.Average > rv {
+			rv = h.Average
+		}
+		if false == when.Before(to) {
+			return rv
+		}
+	}
+}
+
+func (p *usageProfile) load(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if nil != err {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return json.Unmarshal(buf, p)
+}
+
+func (p *usageProfile) save(file string) error {
+	p.mutex.Lock()
+	buf, err := json.Marshal(p)
+	p.mutex.Unlock()
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(file, buf, 0644)
+}
+
+// Recirculate runs the domestic hot water recirculation until hot water
+// reaches the return line or the demand period expires.
+func (l *Logic) Recirculate() OnOffResult {
+	now := l.clock.Now()
+	if l.away(now) {
+		return OnOffResult{Outcome: Rejected, Reason: "nobody is home"}
+	}
+
+	period := l.opts.Recirc.DemandPeriod
+	if 0 == period {
+		period = time.Minute * 5
+	}
+
+	l.recircMutex.Lock()
+	l.recircDemandUntil = now.Add(period)
+	l.recircHot = false
+	l.recircMutex.Unlock()
+
+	until := now.Add(time.Minute)
+	l.heaterLoopPump.NeededUntil(recircClaim, until)
+	return l.recircDHPump.NeededUntil(recircClaim, until)
+}
+
+// recordHotWater adds hot water usage to the learned profile.
+func (l *Logic) recordHotWater(gallons float64) {
+	if l.opts.Recirc.Learn {
+		l.recircProfile.record(l.clock.Now(), gallons, l.recircWeight())
+	}
+}
+
+func (l *Logic) recircWeight() float64 {
+	if 0 == l.opts.Recirc.LearnWeight {
+		return 0.25
+	}
+	return l.opts.Recirc.LearnWeight
+}
+
+// recircClaim is the recirculation's claim on the heater loop and the
+// recirculation pump.  Hot water being drawn and Preheat claim the loop as
+// "domestic", which recirculation stopping mustn't cancel.
+const recircClaim = "recirc"
+
+// recircOpts returns the recirculation options with the defaults filled in.
+func (l *Logic) recircOpts() RecircOpts {
+	opts := l.opts.Recirc
+	if 0 == opts.HotTemp {
+		opts.HotTemp = 100
+	}
+	if 0 == opts.Hysteresis {
+		opts.Hysteresis = 10
+	}
+	if 0 == opts.LearnLead {
+		opts.LearnLead = time.Minute * 10
+	}
+	if 0 == opts.LearnThreshold {
+		opts.LearnThreshold = 1
+	}
+	return opts
+}
+
+// recirculation keeps the domestic hot water hot during the scheduled
+// windows, on demand and ahead of the usual usage.
+func (l *Logic) recirculation() {
+	defer l.wg.Done()
+
+	opts := l.recircOpts()
+	if opts.Learn && "" != opts.ProfileFile {
+		if err := l.recircProfile.load(opts.ProfileFile); nil != err {
+			fmt.Printf("Recirculation profile: %v\n", err)
+		}
+	}
+
+	t := l.clock.NewTicker(time.Second)
+	saved := l.clock.Now()
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			if opts.Learn && "" != opts.ProfileFile {
+				l.recircProfile.save(opts.ProfileFile)
+			}
+			return
+		case now := <-t.C():
+			if opts.Learn && "" != opts.ProfileFile && now.Sub(saved) > time.Hour {
+				if err := l.recircProfile.save(opts.ProfileFile); nil != err {
+					fmt.Printf("Recirculation profile: %v\n", err)
+				}
+				saved = now
+			}
+			l.recircStep(now)
+		}
+	}
+}
+
+// recircStep runs the recirculation pump while hot water is wanted and the
+// return line is cold.
+func (l *Logic) recircStep(now time.Time) {
+	opts := l.recircOpts()
+
+	l.recircMutex.Lock()
+	wanted := now.Before(l.recircDemandUntil)
+	hot := l.recircHot
+	if temp, ok := reading(l.tempSensors, opts.ReturnSensor); ok {
+		if temp >= opts.HotTemp {
+			hot = true
+		} else if temp < opts.HotTemp-opts.Hysteresis {
+			hot = false
+		}
+	}
+	if hot && false == l.recircHot {
+		// Hot water has arrived so the demand is satisfied.
+		l.recircDemandUntil = time.Time{}
+	}
+	l.recircHot = hot
+	l.recircMutex.Unlock()
+
+	if opts.Windows.Contains(now) {
+		wanted = true
+	}
+	if opts.Learn && opts.LearnThreshold <= l.recircProfile.expected(now, now.Add(opts.LearnLead), l.recircWeight()) {
+		wanted = true
+	}
+
+	// Stop once the water is hot or nobody is home to use it.
+	if hot || l.away(now) || false == wanted {
+		l.recircDHPump.Release(recircClaim)
+		l.heaterLoopPump.Release(recircClaim)
+		return
+	}
+
+	until := now.Add(time.Minute)
+	l.heaterLoopPump.NeededUntil(recircClaim, until)
+	l.recircDHPump.NeededUntil(recircClaim, until)
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// claimed returns if the thing has a claim by the name.
+func claimed(thing OnOffThing, name string) bool {
+	for _, c := range thing.Claims() {
+		if name == c.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUsageProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	var p usageProfile
+
+	// A Monday morning shower, 4 weeks in a row.
+	shower := time.Date(2019, 1, 7, 6, 40, 0, 0, time.Local)
+	for i := 0; i < 4; i++ {
+		p.record(shower.AddDate(0, 0, 7*i), 5, 0.5)
+	}
+
+	// Nothing has been learned about the first week's Tuesday.
+	week := shower.AddDate(0, 0, 28)
+	assert.Equal(0.0, p.expected(week.Add(24*time.Hour), week.Add(25*time.Hour), 0.5))
+
+	// The following Monday the shower is expected.
+	v := p.expected(week.Add(-10*time.Minute), week, 0.5)
+	assert.InDelta(5*(1-0.0625), v, 0.0001)
+
+	// Skipping weeks decays the expectation.
+	later := p.expected(week.AddDate(0, 0, 14), week.AddDate(0, 0, 14), 0.5)
+	assert.True(later < v)
+
+	dir, err := ioutil.TempDir("", "profile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "profile.json")
+	assert.Nil(p.save(file))
+
+	var loaded usageProfile
+	assert.Nil(loaded.load(file))
+	assert.Equal(v, loaded.expected(week.Add(-10*time.Minute), week, 0.5))
+}
+
+func TestRecirculation(t *testing.T) {
+	assert := assert.New(t)
+
+	// A Monday.
+	day := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(day.Add(time.Hour * 5))
+	sensors := newFakeSensors()
+	l := newTestLogic(clock, LogicOpts{Recirc: RecircOpts{
+		Windows: DailyWindows{
+			{Start: MustTimeOfDay("06:00"), End: MustTimeOfDay("07:30")},
+		},
+		ReturnSensor: "dhw_return",
+		Learn:        true,
+	}}, sensors)
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "rc_loop"}, 1)
+	l.recircDHPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "rc_pump"}, 2)
+	loop, pump := l.heaterLoopPump, l.recircDHPump
+
+	// Nothing wants hot water.
+	sensors.Set("dhw_return", 70)
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+
+	// On demand it runs until the return line is hot, and stopping leaves
+	// hot water being drawn alone.
+	r := l.Recirculate()
+	assert.Equal(Applied, r.Outcome)
+	assert.True(r.On)
+	loop.NeededUntil("domestic", clock.Now().Add(time.Minute*3))
+	clock.Advance(time.Second)
+	l.recircStep(clock.Now())
+	assert.True(claimed(pump, recircClaim))
+	assert.True(claimed(loop, recircClaim))
+	sensors.Set("dhw_return", 101)
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+	assert.False(claimed(loop, recircClaim))
+	assert.True(claimed(loop, "domestic"))
+
+	// The demand was satisfied.
+	sensors.Set("dhw_return", 70)
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+
+	// In the window it runs until the return line is hot, and again once it
+	// cools past the hysteresis.
+	clock.Set(day.Add(time.Hour * 6))
+	l.recircStep(clock.Now())
+	assert.True(claimed(pump, recircClaim))
+	sensors.Set("dhw_return", 100)
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+	sensors.Set("dhw_return", 91)
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+	sensors.Set("dhw_return", 89)
+	l.recircStep(clock.Now())
+	assert.True(claimed(pump, recircClaim))
+
+	// The window ending stops it.
+	clock.Set(day.Add(time.Hour*7 + time.Minute*30))
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+
+	// The 08:00 bath of the last 4 weeks is preheated for.
+	for i := 1; i <= 4; i++ {
+		l.recircProfile.record(day.Add(time.Hour*8).AddDate(0, 0, -7*i), 5, l.recircWeight())
+	}
+	clock.Set(day.Add(time.Hour*7 + time.Minute*45))
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+	clock.Set(day.Add(time.Hour*7 + time.Minute*52))
+	l.recircStep(clock.Now())
+	assert.True(claimed(pump, recircClaim))
+
+	// Nobody is home to use it.
+	assert.Nil(l.SetMode(Away, time.Time{}, time.Time{}))
+	l.recircStep(clock.Now())
+	assert.False(claimed(pump, recircClaim))
+	assert.False(claimed(loop, recircClaim))
+	assert.Equal(Rejected, l.Recirculate().Outcome)
+
+	loop.Shutdown()
+	pump.Shutdown()
+}
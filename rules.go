@@ -0,0 +1,499 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type RuleOpts struct {
+	// The YAML file the rules are read from.  It is read again whenever it
+	// changes.
+	File string
+
+	// How often the file is checked for changes.  The default is 10
+	// seconds.
+	ReloadPeriod time.Duration
+}
+
+// RuleTrigger is what starts a rule.  Exactly one of Input, Temperature, At
+// or Event is set.
+type RuleTrigger struct {
+	// An input's pulse, contact closing or button press, by input name,
+	// like the "hot_water" flow meter.
+	Input string
+
+	// A sensor crossing below or above a temperature (F).
+	Temperature string
+	Below       *float64
+	Above       *float64
+
+	// A time of day, "15:04".
+	At string
+
+	// An event sent through RuleEvent, for example from the web API.
+	Event string
+}
+
+// RuleCondition must hold for a triggered rule to act.  Each field that is
+// set is checked.
+type RuleCondition struct {
+	// A sensor is below and/or above a temperature (F).
+	Temperature string
+	Below       *float64
+	Above       *float64
+
+	// The house mode is "home", "away" or "vacation".
+	Mode string
+
+	// The time of day is between After and Before, "15:04".
+	After  string
+	Before string
+
+	// An output's relay is "on" or "off".
+	Output string
+	State  string
+}
+
+// RuleAction is something a rule does.  Exactly one of On, Needed, Off or
+// Setpoint is set.
+type RuleAction struct {
+	// Runs the output for For.  Like Needed it is a claim under the rule's
+	// name, so it never replaces a manual or other request.
+	On string
+
+	// Claims the output for For under the rule's name, like a zone needing
+	// the heater loop.
+	Needed string
+
+	// Releases the rules' claims on the output.  Anything else that needs
+	// the output keeps it running.
+	Off string
+
+	// How long On and Needed last.
+	For time.Duration
+
+	// Sets the downstairs target (F).
+	Setpoint *float64
+}
+
+// Rule is an automation read from the rules file.
+type Rule struct {
+	Name string
+	When RuleTrigger
+	If   []RuleCondition
+	Do   []RuleAction
+}
+
+// The prefix of the claims the rules make, followed by the rule's name.
+const ruleClaim = "rule:"
+
+// ruleName is what a rule name may be.  The names become claim names, which
+// end up in logs and metric labels.
+var ruleName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// compiledRule is a checked Rule with its times parsed.
+type compiledRule struct {
+	Rule
+
+	at      TimeOfDay
+	windows []DailyWindow
+
+	// The last temperature seen for a temperature trigger.
+	last float64
+	seen bool
+}
+
+// RulesStatus is which rules are loaded.
+type RulesStatus struct {
+	File   string    `json:"file"`
+	Loaded time.Time `json:"loaded,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Rules  []string  `json:"rules"`
+}
+
+type ruleEngine struct {
+	rules []*compiledRule
+
+	// The file's modification time when it was last read.
+	modTime time.Time
+	loaded  time.Time
+	err     error
+
+	mutex sync.Mutex
+}
+
+// readRules reads and checks the rules in a YAML file with a "rules" list.
+func (l *Logic) readRules(file string) ([]*compiledRule, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); nil != err {
+		return nil, err
+	}
+
+	var list []Rule
+	if err := v.UnmarshalKey("rules", &list); nil != err {
+		return nil, err
+	}
+
+	var rules []*compiledRule
+	names := make(map[string]bool)
+	for i, r := range list {
+		if "" == r.Name {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		if false == ruleName.MatchString(r.Name) {
+			return nil, fmt.Errorf("rule '%s' may only use letters, digits, '_' and '-'", r.Name)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule '%s' is repeated", r.Name)
+		}
+		names[r.Name] = true
+
+		cr, err := l.compileRule(r)
+		if nil != err {
+			return nil, fmt.Errorf("rule '%s': %v", r.Name, err)
+		}
+		rules = append(rules, cr)
+	}
+	return rules, nil
+}
+
+func (l *Logic) compileRule(r Rule) (*compiledRule, error) {
+	cr := &compiledRule{Rule: r}
+
+	w := r.When
+	triggers := 0
+	for _, set := range []bool{"" != w.Input, "" != w.Temperature, "" != w.At, "" != w.Event} {
+		if set {
+			triggers++
+		}
+	}
+	if 1 != triggers {
+		return nil, fmt.Errorf("needs exactly one of input, temperature, at or event")
+	}
+
+	if _, ok := l.inputOpts()[w.Input]; "" != w.Input && false == ok {
+		return nil, fmt.Errorf("unknown input '%s'", w.Input)
+	}
+	if "" != w.Temperature && nil == w.Below && nil == w.Above {
+		return nil, fmt.Errorf("temperature needs below or above")
+	}
+	if "" != w.At {
+		at, err := ParseTimeOfDay(w.At)
+		if nil != err {
+			return nil, err
+		}
+		cr.at = at
+	}
+
+	for _, c := range r.If {
+		if "" != c.Mode {
+			if _, err := ParseHouseMode(c.Mode); nil != err {
+				return nil, err
+			}
+		}
+		if "" != c.Output {
+			if _, ok := l.outputs[c.Output]; false == ok {
+				return nil, fmt.Errorf("unknown output '%s'", c.Output)
+			}
+			if "on" != c.State && "off" != c.State {
+				return nil, fmt.Errorf("output state must be on or off, not '%s'", c.State)
+			}
+		}
+
+		var win DailyWindow
+		if "" != c.After || "" != c.Before {
+			after, err := ParseTimeOfDay(c.After)
+			if nil != err {
+				return nil, err
+			}
+			before, err := ParseTimeOfDay(c.Before)
+			if nil != err {
+				return nil, err
+			}
+			win = DailyWindow{Start: after, End: before}
+		}
+		cr.windows = append(cr.windows, win)
+	}
+
+	if 0 == len(r.Do) {
+		return nil, fmt.Errorf("does nothing")
+	}
+	for _, a := range r.Do {
+		actions := 0
+		for _, name := range []string{a.On, a.Needed, a.Off} {
+			if "" == name {
+				continue
+			}
+			actions++
+			if _, ok := l.outputs[name]; false == ok {
+				return nil, fmt.Errorf("unknown output '%s'", name)
+			}
+		}
+		if nil != a.Setpoint {
+			actions++
+		}
+		if 1 != actions {
+			return nil, fmt.Errorf("each action needs exactly one of on, needed, off or setpoint")
+		}
+		if ("" != a.On || "" != a.Needed) && 0 >= a.For {
+			return nil, fmt.Errorf("on and needed need a for duration")
+		}
+	}
+
+	return cr, nil
+}
+
+// loadRules reads the rules file if it has changed since it was last read.
+// A file with errors leaves the rules as they were.
+func (l *Logic) loadRules(now time.Time) {
+	e := l.automation
+	file := l.opts.Rules.File
+
+	info, err := os.Stat(file)
+	e.mutex.Lock()
+	same := nil == err && info.ModTime().Equal(e.modTime)
+	e.mutex.Unlock()
+	if same {
+		return
+	}
+
+	var rules []*compiledRule
+	if nil == err {
+		rules, err = l.readRules(file)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if nil != info {
+		e.modTime = info.ModTime()
+	}
+	if nil != err {
+		if nil == e.err || err.Error() != e.err.Error() {
+			fmt.Printf("Rules: %v\n", err)
+		}
+		e.err = err
+		return
+	}
+
+	fmt.Printf("Rules: loaded %d from %s\n", len(rules), file)
+	e.rules = rules
+	e.loaded = now
+	e.err = nil
+}
+
+// Rules returns which rules are loaded.
+func (l *Logic) Rules() RulesStatus {
+	e := l.automation
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	s := RulesStatus{
+		File:   l.opts.Rules.File,
+		Loaded: e.loaded,
+		Rules:  []string{},
+	}
+	if nil != e.err {
+		s.Error = e.err.Error()
+	}
+	for _, r := range e.rules {
+		s.Rules = append(s.Rules, r.Name)
+	}
+	return s
+}
+
+// crossed returns if the temperature moved from one side of the trigger to
+// the other.
+func (r *compiledRule) crossed(temp float64) bool {
+	last, seen := r.last, r.seen
+	r.last, r.seen = temp, true
+	if false == seen {
+		return false
+	}
+
+	w := r.When
+	if nil != w.Below && last >= *w.Below && temp < *w.Below {
+		return true
+	}
+	if nil != w.Above && last <= *w.Above && temp > *w.Above {
+		return true
+	}
+	return false
+}
+
+// triggered returns the rules that match.  The caller must hold the engine
+// mutex.
+func (e *ruleEngine) triggered(match func(r *compiledRule) bool) []*compiledRule {
+	var list []*compiledRule
+	for _, r := range e.rules {
+		if match(r) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// ruleInput fires the rules triggered by an input becoming active.
+func (l *Logic) ruleInput(input string) {
+	l.automation.mutex.Lock()
+	list := l.automation.triggered(func(r *compiledRule) bool {
+		return input == r.When.Input
+	})
+	l.automation.mutex.Unlock()
+
+	l.fireRules(l.clock.Now(), list)
+}
+
+// RuleEvent fires the rules triggered by the named event and returns how
+// many acted.
+func (l *Logic) RuleEvent(name string) int {
+	l.automation.mutex.Lock()
+	list := l.automation.triggered(func(r *compiledRule) bool {
+		return name == r.When.Event
+	})
+	l.automation.mutex.Unlock()
+
+	return l.fireRules(l.clock.Now(), list)
+}
+
+// ruleStep fires the rules triggered by temperatures crossing and times of
+// day passing since last.
+func (l *Logic) ruleStep(last, now time.Time) {
+	l.automation.mutex.Lock()
+	list := l.automation.triggered(func(r *compiledRule) bool {
+		if "" != r.When.At {
+			at := r.at.On(now)
+			return last.Before(at) && false == now.Before(at)
+		}
+		if "" != r.When.Temperature {
+			if temp, ok := reading(l.tempSensors, r.When.Temperature); ok {
+				return r.crossed(temp)
+			}
+		}
+		return false
+	})
+	l.automation.mutex.Unlock()
+
+	l.fireRules(now, list)
+}
+
+// ruleHolds returns if the condition holds at now.
+func (l *Logic) ruleHolds(c RuleCondition, win DailyWindow, now time.Time) bool {
+	if "" != c.Temperature {
+		temp, ok := reading(l.tempSensors, c.Temperature)
+		if false == ok {
+			return false
+		}
+		if nil != c.Below && temp >= *c.Below {
+			return false
+		}
+		if nil != c.Above && temp <= *c.Above {
+			return false
+		}
+	}
+	if "" != c.Mode && c.Mode != l.modeAt(now).Mode.String() {
+		return false
+	}
+	if ("" != c.After || "" != c.Before) && false == win.Contains(now) {
+		return false
+	}
+	if "" != c.Output {
+		l.relayMutex.Lock()
+		on := l.relayOn(c.Output)
+		l.relayMutex.Unlock()
+		if on != ("on" == c.State) {
+			return false
+		}
+	}
+	return true
+}
+
+// fireRules runs the actions of the rules whose conditions hold and
+// returns how many acted.
+func (l *Logic) fireRules(now time.Time, list []*compiledRule) int {
+	count := 0
+	for _, r := range list {
+		ok := true
+		for i, c := range r.If {
+			if false == l.ruleHolds(c, r.windows[i], now) {
+				ok = false
+				break
+			}
+		}
+		if false == ok {
+			continue
+		}
+
+		count++
+		l.ruleCounter.Inc()
+		for _, a := range r.Do {
+			switch {
+			case "" != a.On:
+				l.outputs[a.On].thing.NeededUntil(ruleClaim+r.Name, now.Add(a.For))
+			case "" != a.Needed:
+				l.outputs[a.Needed].thing.NeededUntil(ruleClaim+r.Name, now.Add(a.For))
+			case "" != a.Off:
+				thing := l.outputs[a.Off].thing
+				for _, c := range thing.Claims() {
+					if strings.HasPrefix(c.Name, ruleClaim) {
+						thing.Release(c.Name)
+					}
+				}
+			case nil != a.Setpoint:
+				l.SetDownstairsTarget(*a.Setpoint)
+			}
+		}
+	}
+	return count
+}
+
+// ruleAutomation runs the rules and reloads them when the file changes.
+func (l *Logic) ruleAutomation() {
+	defer l.wg.Done()
+
+	period := l.opts.Rules.ReloadPeriod
+	if 0 == period {
+		period = time.Second * 10
+	}
+
+	last := l.clock.Now()
+	l.loadRules(last)
+	checked := last
+
+	t := l.clock.NewTicker(time.Second)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			if now.Sub(checked) >= period {
+				l.loadRules(now)
+				checked = now
+			}
+			l.ruleStep(last, now)
+			last = now
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRules = `
+rules:
+  - name: hot
+    when:
+      input: hot_water
+    do:
+      - needed: ru_loop
+        for: 30s
+  - name: cold
+    when:
+      temperature: ru_main
+      below: 68
+    if:
+      - mode: home
+      - output: ru_fan
+        state: "off"
+    do:
+      - on: ru_zone
+        for: 3m
+  - name: morning
+    when:
+      at: "06:00"
+    do:
+      - setpoint: 70
+  - name: bath
+    when:
+      event: bath
+    if:
+      - after: "06:00"
+        before: "22:00"
+    do:
+      - on: ru_zone
+        for: 10m
+      - off: ru_fan
+  - name: vent
+    when:
+      event: vent
+    do:
+      - on: ru_fan
+        for: 2h
+`
+
+func writeRules(t *testing.T, file, rules string, when time.Time) {
+	if err := ioutil.WriteFile(file, []byte(rules), 0644); nil != err {
+		t.Fatal(err)
+	}
+	// The modification time is what is watched, so make sure it changes.
+	if err := os.Chtimes(file, when, when); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rules")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules.yaml")
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 5, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+
+	l := newTestLogic(clock, LogicOpts{Rules: RuleOpts{File: file}}, sensors)
+	loop := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ru_loop"}, 1)
+	zone := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ru_zone"}, 2)
+	fan := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "ru_fan"}, 4)
+
+	// A missing file is reported.
+	l.loadRules(clock.Now())
+	assert.NotEqual("", l.Rules().Error)
+
+	writeRules(t, file, testRules, clock.Now())
+	l.loadRules(clock.Now())
+	s := l.Rules()
+	assert.Equal("", s.Error)
+	assert.Equal([]string{"hot", "cold", "morning", "bath", "vent"}, s.Rules)
+
+	// Input edges.
+	l.ruleInput("cold_water")
+	assert.Empty(loop.Claims())
+	l.ruleInput("hot_water")
+	claims := loop.Claims()
+	if assert.Len(claims, 1) {
+		assert.Equal("rule:hot", claims[0].Name)
+		assert.Equal(clock.Now().Add(time.Second*30), claims[0].Until)
+	}
+
+	// Temperatures crossing, but only while the fan is off.
+	step := func(d time.Duration) {
+		last := clock.Now()
+		clock.Advance(d)
+		l.ruleStep(last, clock.Now())
+	}
+	sensors.Set("ru_main", 67)
+	step(time.Second)
+	on, _ := zone.State()
+	assert.False(on)
+
+	sensors.Set("ru_main", 69)
+	step(time.Second)
+	fan.OnUntil(clock.Now().Add(time.Hour))
+	fan.State()
+	sensors.Set("ru_main", 67)
+	step(time.Second)
+	on, _ = zone.State()
+	assert.False(on)
+
+	fan.Off()
+	fan.State()
+	sensors.Set("ru_main", 69)
+	step(time.Second)
+	sensors.Set("ru_main", 67)
+	step(time.Second)
+	on, until := zone.State()
+	assert.True(on)
+	assert.Equal(clock.Now().Add(time.Minute*3), until)
+	assert.True(claimed(zone, "rule:cold"))
+
+	// A rule never cuts a manual request short.
+	zone.OnUntil(clock.Now().Add(time.Minute * 5))
+	sensors.Set("ru_main", 69)
+	step(time.Second)
+	sensors.Set("ru_main", 67)
+	step(time.Second)
+	_, until = zone.State()
+	assert.Equal(clock.Now().Add(time.Minute*5-time.Second*2), until)
+
+	// Times of day.
+	step(time.Hour - time.Second*10)
+	assert.Equal(0.0, l.downstairsTemp)
+	step(time.Second * 10)
+	assert.Equal(70.0, l.downstairsTemp)
+
+	// Events, within their window.  Off only releases the rules' claims,
+	// so the manual request keeps the fan running.
+	fan.OnUntil(clock.Now().Add(time.Hour))
+	assert.Equal(1, l.RuleEvent("vent"))
+	_, until = fan.State()
+	assert.Equal(clock.Now().Add(time.Hour*2), until)
+	assert.Equal(1, l.RuleEvent("bath"))
+	assert.Empty(fan.Claims())
+	on, until = fan.State()
+	assert.True(on)
+	assert.Equal(clock.Now().Add(time.Hour), until)
+	assert.Equal(0, l.RuleEvent("shower"))
+
+	clock.Advance(time.Hour * 17)
+	assert.Equal(0, l.RuleEvent("bath"))
+
+	// A bad file leaves the rules as they were.
+	writeRules(t, file, "rules:\n  - name: broken\n    when:\n      event: x\n    do:\n      - on: ru_missing\n        for: 1m\n", clock.Now().Add(time.Minute))
+	l.loadRules(clock.Now())
+	s = l.Rules()
+	assert.Contains(s.Error, "ru_missing")
+	assert.Len(s.Rules, 5)
+
+	// Names with spaces are refused.
+	writeRules(t, file, "rules:\n  - name: morning bath\n    when:\n      event: x\n    do:\n      - off: ru_zone\n", clock.Now().Add(time.Second*90))
+	l.loadRules(clock.Now())
+	s = l.Rules()
+	assert.Contains(s.Error, "morning bath")
+	assert.Len(s.Rules, 5)
+
+	// A good one replaces them.
+	writeRules(t, file, "rules:\n  - name: only\n    when:\n      event: x\n    do:\n      - off: ru_zone\n", clock.Now().Add(time.Minute*2))
+	l.loadRules(clock.Now())
+	s = l.Rules()
+	assert.Equal("", s.Error)
+	assert.Equal([]string{"only"}, s.Rules)
+
+	loop.Shutdown()
+	zone.Shutdown()
+	fan.Shutdown()
+}
+
+func TestCompileRule(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 5, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{}, nil)
+	pump := l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "cr_pump"}, 1)
+
+	below := 60.0
+	good := RuleAction{On: "cr_pump", For: time.Minute}
+	tests := []struct {
+		rule Rule
+		ok   bool
+	}{
+		{Rule{When: RuleTrigger{Event: "x"}, Do: []RuleAction{good}}, true},
+		{Rule{When: RuleTrigger{}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Event: "x", At: "06:00"}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Input: "gas"}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Temperature: "t"}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Temperature: "t", Below: &below}, Do: []RuleAction{good}}, true},
+		{Rule{When: RuleTrigger{At: "25:00"}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Event: "x"}}, false},
+		{Rule{When: RuleTrigger{Event: "x"}, Do: []RuleAction{{On: "cr_pump"}}}, false},
+		{Rule{When: RuleTrigger{Event: "x"}, Do: []RuleAction{{On: "cr_pump", Off: "cr_pump", For: time.Minute}}}, false},
+		{Rule{When: RuleTrigger{Event: "x"}, If: []RuleCondition{{Mode: "asleep"}}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Event: "x"}, If: []RuleCondition{{Output: "cr_pump", State: "spinning"}}, Do: []RuleAction{good}}, false},
+		{Rule{When: RuleTrigger{Event: "x"}, If: []RuleCondition{{After: "06:00"}}, Do: []RuleAction{good}}, false},
+	}
+	for i, test := range tests {
+		_, err := l.compileRule(test.rule)
+		assert.Equal(test.ok, nil == err, "test %d: %v", i, err)
+	}
+
+	pump.Shutdown()
+}
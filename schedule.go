@@ -0,0 +1,179 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TimeOfDay is the offset from local midnight.
+type TimeOfDay time.Duration
+
+// ParseTimeOfDay converts a "15:04" style string into a TimeOfDay.
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	t, err := time.Parse("15:04", s)
+	if nil != err {
+		return 0, fmt.Errorf("Invalid time of day '%s': %v", s, err)
+	}
+	return TimeOfDay(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute), nil
+}
+
+// MustTimeOfDay is like ParseTimeOfDay but panics on error.  It is meant
+// for hard coded configuration.
+func MustTimeOfDay(s string) TimeOfDay {
+	t, err := ParseTimeOfDay(s)
+	if nil != err {
+		panic(err)
+	}
+	return t
+}
+
+// On returns the time this TimeOfDay happens on the same local day as day.
+func (t TimeOfDay) On(day time.Time) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, day.Location()).Add(time.Duration(t))
+}
+
+func (t TimeOfDay) String() string {
+	d := time.Duration(t)
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// SetpointChange is a target temperature that takes effect at a time of day.
+type SetpointChange struct {
+	At     TimeOfDay
+	Target float64
+}
+
+// SetpointSchedule is a daily list of setpoint changes.
+type SetpointSchedule []SetpointChange
+
+func (s SetpointSchedule) sorted() SetpointSchedule {
+	rv := make(SetpointSchedule, len(s))
+	copy(rv, s)
+	sort.Slice(rv, func(i, j int) bool { return rv[i].At < rv[j].At })
+	return rv
+}
+
+// Current returns the setpoint in effect at now.
+func (s SetpointSchedule) Current(now time.Time) (SetpointChange, bool) {
+	if 0 == len(s) {
+		return SetpointChange{}, false
+	}
+
+	list := s.sorted()
+
+	// Before the first change of the day the last change from yesterday
+	// is still in effect.
+	rv := list[len(list)-1]
+	for _, v := range list {
+		if v.At.On(now).After(now) {
+			break
+		}
+		rv = v
+	}
+	return rv, true
+}
+
+// Next returns the next setpoint change after now and when it happens.
+func (s SetpointSchedule) Next(now time.Time) (SetpointChange, time.Time, bool) {
+	if 0 == len(s) {
+		return SetpointChange{}, time.Time{}, false
+	}
+
+	list := s.sorted()
+	for _, v := range list {
+		if when := v.At.On(now); when.After(now) {
+			return v, when, true
+		}
+	}
+	return list[0], list[0].At.On(now.AddDate(0, 0, 1)), true
+}
+
+// Between returns the most recent setpoint change that happened after from
+// and up to and including to.
+func (s SetpointSchedule) Between(from, to time.Time) (SetpointChange, bool) {
+	next, when, ok := s.Next(from)
+	if false == ok || when.After(to) {
+		return SetpointChange{}, false
+	}
+
+	rv := next
+	for {
+		next, when, _ = s.Next(when)
+		if when.After(to) {
+			return rv, true
+		}
+		rv = next
+	}
+}
+
+// DailyWindow is a period of time each day.  If End is before Start the
+// window wraps past midnight.
+type DailyWindow struct {
+	Start TimeOfDay
+	End   TimeOfDay
+}
+
+// Contains returns if now is inside the window.
+func (w DailyWindow) Contains(now time.Time) bool {
+	_, ok := w.Until(now)
+	return ok
+}
+
+// Until returns when the window that now is inside of ends.
+func (w DailyWindow) Until(now time.Time) (time.Time, bool) {
+	start := w.Start.On(now)
+	end := w.End.On(now)
+
+	if w.End < w.Start {
+		// Wraps past midnight.
+		if now.Before(end) {
+			return end, true
+		}
+		if false == now.Before(start) {
+			return w.End.On(now.AddDate(0, 0, 1)), true
+		}
+		return time.Time{}, false
+	}
+
+	if false == now.Before(start) && now.Before(end) {
+		return end, true
+	}
+	return time.Time{}, false
+}
+
+// DailyWindows is a list of windows; a time is inside it if any of the
+// windows contains it.
+type DailyWindows []DailyWindow
+
+// Until returns when the latest window that now is inside of ends.
+func (ws DailyWindows) Until(now time.Time) (time.Time, bool) {
+	var rv time.Time
+	for _, w := range ws {
+		if end, ok := w.Until(now); ok && end.After(rv) {
+			rv = end
+		}
+	}
+	return rv, !rv.IsZero()
+}
+
+// Contains returns if now is inside any of the windows.
+func (ws DailyWindows) Contains(now time.Time) bool {
+	_, ok := ws.Until(now)
+	return ok
+}
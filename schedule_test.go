@@ -0,0 +1,64 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetpointSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	s := SetpointSchedule{
+		{At: MustTimeOfDay("22:00"), Target: 62},
+		{At: MustTimeOfDay("06:30"), Target: 68},
+	}
+
+	day := time.Date(2019, 1, 10, 0, 0, 0, 0, time.Local)
+
+	// Before the first change of the day, last night's setpoint holds.
+	sp, ok := s.Current(day.Add(time.Hour))
+	assert.True(ok)
+	assert.Equal(62.0, sp.Target)
+
+	sp, ok = s.Current(day.Add(12 * time.Hour))
+	assert.True(ok)
+	assert.Equal(68.0, sp.Target)
+
+	next, when, ok := s.Next(day.Add(12 * time.Hour))
+	assert.True(ok)
+	assert.Equal(62.0, next.Target)
+	assert.Equal(day.Add(22*time.Hour), when)
+
+	// Wraps to tomorrow morning.
+	next, when, ok = s.Next(day.Add(23 * time.Hour))
+	assert.True(ok)
+	assert.Equal(68.0, next.Target)
+	assert.Equal(day.AddDate(0, 0, 1).Add(6*time.Hour+30*time.Minute), when)
+
+	_, ok = s.Between(day.Add(7*time.Hour), day.Add(8*time.Hour))
+	assert.False(ok)
+
+	sp, ok = s.Between(day.Add(6*time.Hour), day.Add(23*time.Hour))
+	assert.True(ok)
+	assert.Equal(62.0, sp.Target)
+
+	_, err := ParseTimeOfDay("25:00")
+	assert.NotNil(err)
+	assert.Equal("06:30", MustTimeOfDay("06:30").String())
+}
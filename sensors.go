@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -15,6 +16,14 @@ type TempSensors interface {
 	Shutdown()
 
 	Get(name string) float64
+
+	// Returns when the named sensor last produced a reading, or the zero
+	// time if it never has.  Get keeps returning the last reading after a
+	// sensor stops responding.
+	LastRead(name string) time.Time
+
+	// Returns the names of all the configured sensors that were found.
+	Names() []string
 }
 
 type TempSensorsOpts struct {
@@ -27,13 +36,18 @@ type TempSensorsOpts struct {
 	SamplePeriod time.Duration
 
 	Names map[string]string
+
+	// The source of time.  The default is the wall clock.
+	Clock Clock
 }
 
 type tempSensors struct {
 	adapter  *ds2480.Ds2480
-	ticker   *time.Ticker
+	ticker   Ticker
 	devices  map[string]*ds18x20.Ds18x20
 	readings map[string]float64
+	lastRead map[string]time.Time
+	clock    Clock
 	wg       sync.WaitGroup
 	mutex    sync.Mutex
 	done     chan bool
@@ -68,7 +82,13 @@ func NewTempSensors(opts TempSensorsOpts) (TempSensors, error) {
 		adapter:  adapter,
 		devices:  make(map[string]*ds18x20.Ds18x20),
 		readings: make(map[string]float64),
+		lastRead: make(map[string]time.Time),
 		metrics:  make(map[string]prometheus.Gauge),
+		done:     make(chan bool),
+		clock:    opts.Clock,
+	}
+	if nil == ts.clock {
+		ts.clock = RealClock{}
 	}
 
 	list, err := adapter.Search()
@@ -80,7 +100,6 @@ func NewTempSensors(opts TempSensorsOpts) (TempSensors, error) {
 		if name, ok := opts.Names[v.String()]; ok {
 			sensor, _ := ds18x20.New(adapter, v)
 			ts.devices[name] = sensor
-			ts.readings[name] = 0.0
 			ts.metrics[name] = promauto.NewGauge(prometheus.GaugeOpts{
 				Namespace: opts.Namespace,
 				Subsystem: "physical",
@@ -91,11 +110,11 @@ func NewTempSensors(opts TempSensorsOpts) (TempSensors, error) {
 		}
 	}
 
+	ts.ticker = ts.clock.NewTicker(opts.SamplePeriod)
+
 	ts.wg.Add(1)
 	go ts.run()
 
-	ts.ticker = time.NewTicker(opts.SamplePeriod)
-
 	return ts, nil
 }
 
@@ -115,6 +134,45 @@ func (ts *tempSensors) Get(name string) float64 {
 	return temp
 }
 
+func (ts *tempSensors) LastRead(name string) time.Time {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.lastRead[name]
+}
+
+func (ts *tempSensors) Names() []string {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	list := make([]string, 0, len(ts.devices))
+	for k := range ts.devices {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// reading returns the named temperature and if the sensor has a reading.
+func reading(ts *TempSensors, name string) (float64, bool) {
+	if nil == ts || nil == *ts {
+		return 0, false
+	}
+	temp := (*ts).Get(name)
+	return temp, -1000 != temp
+}
+
+// freshReading returns the named temperature and if the sensor has read
+// within maxAge of now.
+func freshReading(ts *TempSensors, name string, now time.Time, maxAge time.Duration) (float64, bool) {
+	temp, ok := reading(ts, name)
+	if false == ok {
+		return temp, false
+	}
+	last := (*ts).LastRead(name)
+	return temp, false == last.IsZero() && now.Sub(last) <= maxAge
+}
+
 func (ts *tempSensors) run() {
 	defer ts.wg.Done()
 	for {
@@ -123,7 +181,7 @@ func (ts *tempSensors) run() {
 			ts.ticker.Stop()
 			ts.adapter.Close()
 			return
-		case <-ts.ticker.C:
+		case <-ts.ticker.C():
 			ds18x20.ConvertAll(ts.adapter)
 			for k, v := range ts.devices {
 				temp, err := v.LastTemp()
@@ -133,13 +191,11 @@ func (ts *tempSensors) run() {
 
 					ts.mutex.Lock()
 					ts.readings[k] = temp
+					ts.lastRead[k] = ts.clock.Now()
 					ts.mutex.Unlock()
 					ts.metrics[k].Set(temp)
 				}
 			}
-
-		default:
-			time.Sleep(100 * time.Millisecond)
 		}
 	}
 }
@@ -0,0 +1,77 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+)
+
+// Thermostat decides if a zone needs heat.  It is asked about once a second.
+type Thermostat interface {
+	// Returns how long the zone should be heated given the present and
+	// target temperatures (F) and the run time from the outdoor reset.
+	// Zero means no heat is needed.
+	Heat(present, target float64, runTime time.Duration) time.Duration
+}
+
+// BurstThermostat heats for the whole run time whenever the zone is below
+// the target.
+type BurstThermostat struct{}
+
+func (t *BurstThermostat) Heat(present, target float64, runTime time.Duration) time.Duration {
+	if present < target {
+		return runTime
+	}
+	return 0
+}
+
+// DeadbandThermostat starts heating when the zone is below the target and
+// keeps heating until the zone is Differential above the target.
+type DeadbandThermostat struct {
+	// How far (F) above the target to heat to.
+	Differential float64
+
+	heating bool
+}
+
+func (t *DeadbandThermostat) Heat(present, target float64, runTime time.Duration) time.Duration {
+	if present < target {
+		t.heating = true
+	} else if present >= target+t.Differential {
+		t.heating = false
+	}
+
+	if t.heating {
+		return runTime
+	}
+	return 0
+}
+
+// ProportionalThermostat shortens the run time as the zone approaches the
+// target so there is less overshoot from the radiant lag.
+type ProportionalThermostat struct {
+	// How far (F) below the target the full run time is used.
+	Band float64
+}
+
+func (t *ProportionalThermostat) Heat(present, target float64, runTime time.Duration) time.Duration {
+	if present >= target {
+		return 0
+	}
+	if 0 >= t.Band || target-present >= t.Band {
+		return runTime
+	}
+	return time.Duration(float64(runTime) * (target - present) / t.Band)
+}
@@ -0,0 +1,274 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WallThermostatMode is how a wall thermostat's call for heat and the
+// zone's own thermostat decide together.  Whatever the mode, the wall
+// thermostat runs the zone alone when the zone's sensor has no recent
+// reading.  Only downstairs has a thermostat of its own, so the other zones
+// can only use WallPassthrough.  While the house is away or on vacation the
+// wall thermostats are ignored and the zone's own thermostat heats to the
+// mode's setpoint; freeze protection still heats every zone it is set up
+// for.
+type WallThermostatMode int
+
+const (
+	// WallPassthrough runs the zone from the wall thermostat alone.
+	WallPassthrough WallThermostatMode = iota
+
+	// WallOr heats when either thermostat calls.
+	WallOr
+
+	// WallAnd lets the zone's own thermostat heat only while the wall
+	// thermostat calls, so the wall thermostat can keep the zone off.
+	WallAnd
+
+	// WallPriority lets the wall thermostat decide for a while after it is
+	// changed.  Then the zone's own thermostat decides again.
+	WallPriority
+
+	// WallFallback ignores the wall thermostat while the zone's sensor is
+	// working.
+	WallFallback
+)
+
+func (m WallThermostatMode) String() string {
+	switch m {
+	case WallPassthrough:
+		return "passthrough"
+	case WallOr:
+		return "or"
+	case WallAnd:
+		return "and"
+	case WallPriority:
+		return "priority"
+	case WallFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// ParseWallThermostatMode converts "passthrough", "or", "and", "priority" or
+// "fallback" into a WallThermostatMode.
+func ParseWallThermostatMode(s string) (WallThermostatMode, error) {
+	for _, m := range []WallThermostatMode{WallPassthrough, WallOr, WallAnd, WallPriority, WallFallback} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return WallPassthrough, fmt.Errorf("Invalid wall thermostat mode '%s'", s)
+}
+
+func (m WallThermostatMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *WallThermostatMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseWallThermostatMode(string(text))
+	return err
+}
+
+type WallThermostatOpts struct {
+	// The contact input wired to the thermostat's call for heat.
+	Input string
+
+	Mode WallThermostatMode
+
+	// The sensor the zone's own thermostat heats by.  Without one the wall
+	// thermostat runs the zone alone.
+	Sensor string
+
+	// How old the sensor's last reading may be before the wall thermostat
+	// takes over.  The default is 5 minutes.
+	MaxAge time.Duration
+
+	// How long a change at the wall thermostat wins with WallPriority.  The
+	// default is 2 hours.
+	Hold time.Duration
+}
+
+// WallThermostatStatus is what a wall thermostat is doing.
+type WallThermostatStatus struct {
+	Zone    string             `json:"zone"`
+	Input   string             `json:"input"`
+	Mode    WallThermostatMode `json:"mode"`
+	Calling bool               `json:"calling"`
+
+	// If the call is running the zone right now.
+	Heating bool `json:"heating"`
+}
+
+// wallClaim is how long each renewal of a wall thermostat's claim lasts, so
+// the zone stops soon after the call does even if the release is missed.
+const wallClaim = time.Minute
+
+type wallThermostats struct {
+	// The zones whose pumps the wall thermostats have claimed.
+	heating map[string]bool
+	mutex   sync.Mutex
+}
+
+// checkWallThermostats drops the wall thermostats that can't work and
+// follows the calls of the rest as they change.
+func (l *Logic) checkWallThermostats() {
+	inputs := l.inputOpts()
+	list := make(map[string]WallThermostatOpts)
+	for zone, w := range l.opts.WallThermostats {
+		if nil == l.zonePump(zone) {
+			fmt.Printf("Wall thermostat: ignoring unknown zone '%s'\n", zone)
+			continue
+		}
+		if in, ok := inputs[w.Input]; false == ok || ContactInput != in.Kind {
+			fmt.Printf("Wall thermostat: ignoring %s, '%s' is not a contact input\n", zone, w.Input)
+			continue
+		}
+		if WallPassthrough != w.Mode && ("downstairs" != zone || "" == w.Sensor) {
+			fmt.Printf("Wall thermostat: %s has no thermostat of its own to combine with, using passthrough\n", zone)
+			w.Mode = WallPassthrough
+		}
+		list[zone] = w
+
+		zone := zone
+		l.Subscribe(w.Input, func(ev InputEvent) {
+			l.wallStep(zone, ev.When)
+		})
+	}
+	l.opts.WallThermostats = list
+}
+
+// wallDecides returns if the zone's wall thermostat is calling and running
+// the zone, and if the zone's own thermostat may heat.
+func (l *Logic) wallDecides(zone string, now time.Time) (heat, own bool) {
+	w, ok := l.opts.WallThermostats[zone]
+	if false == ok {
+		return false, true
+	}
+
+	call, since, _ := l.inputState(w.Input)
+
+	maxAge := w.MaxAge
+	if 0 == maxAge {
+		maxAge = time.Minute * 5
+	}
+	_, healthy := freshReading(l.tempSensors, w.Sensor, now, maxAge)
+	healthy = healthy && "" != w.Sensor
+
+	// Nobody is home to have asked for the heat, so only the setpoint for
+	// the mode counts.
+	if l.away(now) {
+		return false, healthy
+	}
+
+	if false == healthy {
+		return call, false
+	}
+
+	switch w.Mode {
+	case WallOr:
+		return call, true
+	case WallAnd:
+		return false, call
+	case WallPriority:
+		hold := w.Hold
+		if 0 == hold {
+			hold = time.Hour * 2
+		}
+		if false == since.IsZero() && now.Sub(since) < hold {
+			return call, false
+		}
+		return false, true
+	case WallFallback:
+		return false, true
+	}
+	return call, false
+}
+
+// wallStep runs or releases the zone's pump and the heater loop for its wall
+// thermostat.
+func (l *Logic) wallStep(zone string, now time.Time) {
+	heat, _ := l.wallDecides(zone, now)
+	pump := l.zonePump(zone)
+	claim := "wall:" + zone
+
+	// Calls changing and the ticker mustn't interleave their claims.
+	l.walls.mutex.Lock()
+	defer l.walls.mutex.Unlock()
+
+	was := l.walls.heating[zone]
+	l.walls.heating[zone] = heat
+
+	if heat {
+		if false == was {
+			fmt.Printf("Wall thermostat: %s calling for heat\n", zone)
+		}
+		l.heaterLoopPump.NeededUntil(claim, now.Add(wallClaim))
+		pump.NeededUntil(claim, now.Add(wallClaim))
+		return
+	}
+
+	if was {
+		fmt.Printf("Wall thermostat: %s done\n", zone)
+		pump.Release(claim)
+		l.heaterLoopPump.Release(claim)
+	}
+}
+
+// WallThermostats returns what the wall thermostats are doing.
+func (l *Logic) WallThermostats() []WallThermostatStatus {
+	list := []WallThermostatStatus{}
+	for zone, w := range l.opts.WallThermostats {
+		call, _ := l.InputActive(w.Input)
+
+		l.walls.mutex.Lock()
+		heating := l.walls.heating[zone]
+		l.walls.mutex.Unlock()
+
+		list = append(list, WallThermostatStatus{
+			Zone:    zone,
+			Input:   w.Input,
+			Mode:    w.Mode,
+			Calling: call,
+			Heating: heating,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Zone < list[j].Zone })
+	return list
+}
+
+// wallThermostatControl keeps the claims of the wall thermostats calling
+// from running out and notices sensors failing and priority holds ending.
+func (l *Logic) wallThermostatControl() {
+	defer l.wg.Done()
+
+	t := l.clock.NewTicker(time.Second * 15)
+	for {
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case now := <-t.C():
+			for zone := range l.opts.WallThermostats {
+				l.wallStep(zone, now)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newWallLogic returns a Logic with the downstairs and upstairs wall
+// thermostats on bits 2 and 3.
+func newWallLogic(clock Clock, sensors *fakeSensors, walls map[string]WallThermostatOpts) *Logic {
+	sensors.clock = clock
+	return newTestLogic(clock, LogicOpts{
+		Inputs: map[string]InputOpts{
+			"wt_down": {Bit: 2, Kind: ContactInput},
+			"wt_up":   {Bit: 3, Kind: ContactInput},
+			"wt_flow": {Bit: 5, Kind: PulseInput},
+		},
+		WallThermostats: walls,
+	}, sensors)
+}
+
+func wallBoard(l *Logic, down, up int) {
+	l.Update(&ArduinoBoardStatus{Inputs: map[int]int{2: down, 3: up}})
+}
+
+func TestWallThermostatDecides(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	l := newWallLogic(clock, sensors, nil)
+	wallBoard(l, 0, 0)
+
+	tests := []struct {
+		mode    WallThermostatMode
+		call    bool
+		healthy bool
+		heat    bool
+		own     bool
+	}{
+		{WallPassthrough, true, true, true, false},
+		{WallPassthrough, false, true, false, false},
+		{WallOr, true, true, true, true},
+		{WallOr, false, true, false, true},
+		{WallAnd, true, true, false, true},
+		{WallAnd, false, true, false, false},
+		{WallFallback, true, true, false, true},
+		{WallFallback, true, false, true, false},
+		{WallFallback, false, false, false, false},
+		{WallOr, true, false, true, false},
+		{WallAnd, true, false, true, false},
+	}
+	for i, test := range tests {
+		l.opts.WallThermostats = map[string]WallThermostatOpts{
+			"downstairs": {Input: "wt_down", Mode: test.mode, Sensor: "downstairs_main"},
+		}
+		if test.healthy {
+			sensors.Set("downstairs_main", 68)
+		} else {
+			sensors.Set("downstairs_main", -1000)
+		}
+		l.inputs.inputs["wt_down"].active = test.call
+
+		heat, own := l.wallDecides("downstairs", clock.Now())
+		assert.Equal(test.heat, heat, "test %d", i)
+		assert.Equal(test.own, own, "test %d", i)
+	}
+
+	// A sensor that stops reading counts as unhealthy once its last reading
+	// is too old.
+	l.opts.WallThermostats = map[string]WallThermostatOpts{
+		"downstairs": {Input: "wt_down", Mode: WallFallback, Sensor: "downstairs_main", MaxAge: time.Minute},
+	}
+	sensors.Set("downstairs_main", 68)
+	clock.Advance(time.Minute)
+	heat, own := l.wallDecides("downstairs", clock.Now())
+	assert.False(heat)
+	assert.True(own)
+	clock.Advance(time.Second)
+	heat, own = l.wallDecides("downstairs", clock.Now())
+	assert.True(heat)
+	assert.False(own)
+
+	// Without a wall thermostat the zone's own thermostat decides.
+	heat, own = l.wallDecides("upstairs", clock.Now())
+	assert.False(heat)
+	assert.True(own)
+
+	// While away the call is ignored and the zone's own thermostat heats to
+	// the away setpoint.
+	assert.Nil(l.SetMode(Away, time.Time{}, time.Time{}))
+	l.opts.WallThermostats = map[string]WallThermostatOpts{
+		"downstairs": {Input: "wt_down", Mode: WallOr, Sensor: "downstairs_main"},
+	}
+	sensors.Set("downstairs_main", 68)
+	heat, own = l.wallDecides("downstairs", clock.Now())
+	assert.False(heat)
+	assert.True(own)
+	sensors.Set("downstairs_main", -1000)
+	heat, own = l.wallDecides("downstairs", clock.Now())
+	assert.False(heat)
+	assert.False(own)
+}
+
+func TestWallThermostatPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	sensors := newFakeSensors()
+	l := newWallLogic(clock, sensors, map[string]WallThermostatOpts{
+		"downstairs": {Input: "wt_down", Mode: WallPriority, Sensor: "downstairs_main", Hold: time.Hour},
+	})
+	sensors.Set("downstairs_main", 68)
+
+	// Until the wall thermostat is touched the zone's own thermostat
+	// decides.
+	wallBoard(l, 1, 0)
+	heat, own := l.wallDecides("downstairs", clock.Now())
+	assert.False(heat)
+	assert.True(own)
+
+	// Turning it down keeps the zone off for the hold.
+	clock.Advance(time.Minute)
+	wallBoard(l, 0, 0)
+	heat, own = l.wallDecides("downstairs", clock.Now())
+	assert.False(heat)
+	assert.False(own)
+
+	clock.Advance(time.Hour)
+	sensors.Set("downstairs_main", 68)
+	heat, own = l.wallDecides("downstairs", clock.Now())
+	assert.False(heat)
+	assert.True(own)
+}
+
+func TestWallThermostatPassthrough(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := NewFakeClock(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC))
+	l := newWallLogic(clock, newFakeSensors(), map[string]WallThermostatOpts{
+		"upstairs": {Input: "wt_up", Mode: WallOr, Sensor: "upstairs_main"},
+		"attic":    {Input: "wt_up"},
+		"basement": {Input: "wt_flow"},
+	})
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "wt_loop"}, 1)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "wt_downstairs"}, 2)
+	l.upstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: testNamespace("testing"), Name: "wt_upstairs"}, 4)
+
+	// Unknown zones and inputs that aren't contacts are dropped.
+	l.checkWallThermostats()
+	assert.Len(l.opts.WallThermostats, 1)
+
+	// Upstairs has no thermostat of its own to combine with.
+	assert.Equal(WallPassthrough, l.opts.WallThermostats["upstairs"].Mode)
+
+	wallBoard(l, 0, 0)
+	assert.Empty(l.upstairsHeatPump.Claims())
+
+	// The call runs the zone pump and the heater loop.
+	wallBoard(l, 0, 1)
+	claims := l.upstairsHeatPump.Claims()
+	if assert.Len(claims, 1) {
+		assert.Equal("wall:upstairs", claims[0].Name)
+		assert.Equal(clock.Now().Add(wallClaim), claims[0].Until)
+	}
+	assert.Len(l.heaterLoopPump.Claims(), 1)
+	s := l.WallThermostats()
+	if assert.Len(s, 1) {
+		assert.True(s[0].Calling)
+		assert.True(s[0].Heating)
+	}
+
+	// The claims are kept up while it calls.
+	clock.Advance(time.Second * 30)
+	l.wallStep("upstairs", clock.Now())
+	claims = l.upstairsHeatPump.Claims()
+	if assert.Len(claims, 1) {
+		assert.Equal(clock.Now().Add(wallClaim), claims[0].Until)
+	}
+
+	// And dropped when it stops.
+	wallBoard(l, 0, 0)
+	assert.Empty(l.upstairsHeatPump.Claims())
+	assert.Empty(l.heaterLoopPump.Claims())
+	assert.False(l.WallThermostats()[0].Heating)
+
+	// Nobody is home to want the heat.
+	assert.Nil(l.SetMode(Vacation, time.Time{}, time.Time{}))
+	wallBoard(l, 0, 1)
+	assert.Empty(l.upstairsHeatPump.Claims())
+	assert.Empty(l.heaterLoopPump.Claims())
+	assert.True(l.WallThermostats()[0].Calling)
+	assert.False(l.WallThermostats()[0].Heating)
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+	l.upstairsHeatPump.Shutdown()
+}
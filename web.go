@@ -16,10 +16,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -37,42 +39,263 @@ type webHandler struct {
 	metricsEndpoint *http.Server
 }
 
+// writeJSON sends v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if nil != err {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(buf)
+}
+
+// describe explains what became of a request in words for the post page.
+func describe(what string, r OnOffResult) string {
+	msg := what + ": " + r.Outcome.String()
+	switch r.Outcome {
+	case Applied:
+		if r.On {
+			msg += ", on until " + r.Until.Format(time.Kitchen)
+		}
+	case Deferred:
+		msg += ", on from " + r.Start.Format(time.Kitchen) + " until " + r.Until.Format(time.Kitchen)
+	}
+	if "" != r.Reason {
+		msg += " (" + r.Reason + ")"
+	}
+	return msg
+}
+
 func (wh *webHandler) handleControl(w http.ResponseWriter, r *http.Request) {
+	var results []string
+
 	fan_goal := r.URL.Query().Get("fan_goal_state")
 	if "run" == fan_goal {
 		fan_duration, err := time.ParseDuration(r.URL.Query().Get("fan_duration"))
 		fmt.Printf("Duration: %v\n", fan_duration)
 		if nil == err {
-			wh.logic.Fan(time.Now().Add(fan_duration))
+			until := wh.logic.clock.Now().Add(fan_duration)
+			if level, err := strconv.ParseFloat(r.URL.Query().Get("fan_level"), 64); nil == err {
+				results = append(results, describe("Fan", wh.logic.SetLevel("whole_house_fan", level, until)))
+			} else {
+				results = append(results, describe("Fan", wh.logic.Fan(until)))
+			}
+		} else {
+			results = append(results, "Fan: rejected ("+err.Error()+")")
 		}
 	}
 	preheat := r.URL.Query().Get("preheat_domestic")
 	if "preheat" == preheat {
-		wh.logic.Preheat()
+		results = append(results, describe("Preheat", wh.logic.Preheat()))
+	}
+	recirculate := r.URL.Query().Get("recirculate")
+	if "demand" == recirculate {
+		results = append(results, describe("Recirculate", wh.logic.Recirculate()))
 	}
 	heat_goal := r.URL.Query().Get("heat_goal_state")
 	if "run" == heat_goal {
 		heat_down_duration, err := time.ParseDuration(r.URL.Query().Get("heat_down_duration"))
 		if nil == err {
 			fmt.Printf("Duration: %v\n", heat_down_duration)
-			wh.logic.HeatDownstairs(time.Now().Add(heat_down_duration))
+			results = append(results, describe("Downstairs", wh.logic.HeatDownstairs(wh.logic.clock.Now().Add(heat_down_duration))))
 		}
 		heat_up_duration, err := time.ParseDuration(r.URL.Query().Get("heat_up_duration"))
 		if nil == err {
 			fmt.Printf("Duration: %v\n", heat_up_duration)
-			wh.logic.HeatUpstairs(time.Now().Add(heat_up_duration))
+			results = append(results, describe("Upstairs", wh.logic.HeatUpstairs(wh.logic.clock.Now().Add(heat_up_duration))))
 		}
 	}
 	if "maintain" == heat_goal {
 		if goal, err := strconv.ParseFloat(r.URL.Query().Get("heat_target"), 64); nil == err {
 			wh.logic.SetDownstairsTarget(goal)
+			results = append(results, "Downstairs target: applied")
+		} else {
+			results = append(results, "Downstairs target: rejected ("+err.Error()+")")
 		}
 	}
 
-	buf, _ := ioutil.ReadFile(wh.post_page)
-	w.WriteHeader(200)
+	override_output := r.URL.Query().Get("override_output")
+	if "" != override_output {
+		what := "Override " + override_output
+		mode, err := ParseOverrideMode(r.URL.Query().Get("override_mode"))
+		if nil == err {
+			var until time.Time
+			if d, err := time.ParseDuration(r.URL.Query().Get("override_duration")); nil == err {
+				until = wh.logic.clock.Now().Add(d)
+			}
+			err = wh.logic.SetOverride(override_output, mode, until)
+		}
+		if nil == err {
+			results = append(results, what+": applied")
+		} else {
+			results = append(results, what+": rejected ("+err.Error()+")")
+		}
+	}
+	house_mode := r.URL.Query().Get("house_mode")
+	if "" != house_mode {
+		mode, err := ParseHouseMode(house_mode)
+		var start, end time.Time
+		if nil == err {
+			start, err = parseWhen(r.URL.Query().Get("house_mode_start"))
+		}
+		if nil == err {
+			end, err = parseWhen(r.URL.Query().Get("house_mode_end"))
+		}
+		if nil == err {
+			err = wh.logic.SetMode(mode, start, end)
+		}
+		if nil == err {
+			results = append(results, "House mode: applied")
+		} else {
+			results = append(results, "House mode: rejected ("+err.Error()+")")
+		}
+	}
+	switch r.URL.Query().Get("emergency_stop") {
+	case "stop":
+		wh.logic.EmergencyStop(true)
+		results = append(results, "Emergency stop: applied")
+	case "clear":
+		wh.logic.EmergencyStop(false)
+		results = append(results, "Emergency stop cleared: applied")
+	}
+
+	t, err := template.ParseFiles(wh.post_page)
+	if nil != err {
+		w.WriteHeader(500)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html")
-	w.Write(buf)
+	w.WriteHeader(200)
+	t.Execute(w, results)
+}
+
+// parseWhen parses a local "2006-01-02T15:04" time from a web form.  An
+// empty string is the zero time.
+func parseWhen(s string) (time.Time, error) {
+	if "" == s {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", s, time.Local)
+}
+
+// mode returns the house mode, or sets it from a JSON ModePeriod.
+func (wh *webHandler) mode(w http.ResponseWriter, r *http.Request) {
+	if "PUT" == r.Method {
+		var p ModePeriod
+		if err := json.NewDecoder(r.Body).Decode(&p); nil != err {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := wh.logic.SetMode(p.Mode, p.Start, p.End); nil != err {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	writeJSON(w, wh.logic.Mode())
+}
+
+// presence returns who is home, or records someone arriving or leaving
+// from name= and home=true|false, or a JSON PersonStatus body as sent by a
+// webhook.
+func (wh *webHandler) presence(w http.ResponseWriter, r *http.Request) {
+	if "GET" != r.Method {
+		p := PersonStatus{Name: r.URL.Query().Get("name")}
+		var err error
+		if "" == p.Name {
+			err = json.NewDecoder(r.Body).Decode(&p)
+		} else {
+			p.Home, err = strconv.ParseBool(r.URL.Query().Get("home"))
+		}
+		if nil == err && "" == p.Name {
+			err = fmt.Errorf("no name given")
+		}
+		if nil != err {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		wh.logic.SetPresence(p.Name, p.Home)
+	}
+
+	writeJSON(w, wh.logic.Presence())
+}
+
+func (wh *webHandler) rules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, wh.logic.Rules())
+}
+
+// event fires the rules triggered by the event in name= and returns how
+// many acted.
+func (wh *webHandler) event(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if "" == name {
+		http.Error(w, "no name given", 400)
+		return
+	}
+
+	writeJSON(w, map[string]int{"fired": wh.logic.RuleEvent(name)})
+}
+
+func (wh *webHandler) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, wh.logic.Status())
+}
+
+func (wh *webHandler) energy(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, wh.logic.Energy())
+}
+
+// HistorySeries is a series returned by the history API.
+type HistorySeries struct {
+	Name   string         `json:"name"`
+	Points []HistoryPoint `json:"points"`
+}
+
+// history lists the series, or returns the points of the series asked for
+// with series=name (repeatable) over range=24h or from=/to= RFC3339 times.
+func (wh *webHandler) history(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var rv interface{}
+	if names, ok := q["series"]; ok {
+		to := wh.logic.clock.Now()
+		from := to.Add(-24 * time.Hour)
+		if d, err := time.ParseDuration(q.Get("range")); nil == err {
+			from = to.Add(-d)
+		}
+		if t, err := time.Parse(time.RFC3339, q.Get("from")); nil == err {
+			from = t
+		}
+		if t, err := time.Parse(time.RFC3339, q.Get("to")); nil == err {
+			to = t
+		}
+
+		list := []HistorySeries{}
+		for _, name := range names {
+			list = append(list, HistorySeries{
+				Name:   name,
+				Points: wh.logic.History(name, from, to),
+			})
+		}
+		rv = list
+	} else {
+		rv = wh.logic.HistoryNames()
+	}
+
+	writeJSON(w, rv)
+}
+
+func (wh *webHandler) alerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, wh.logic.Alerts())
+}
+
+func (wh *webHandler) exercises(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, wh.logic.Exercises())
+}
+
+func (wh *webHandler) inputs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, wh.logic.Inputs())
 }
 
 func (wh *webHandler) page(w http.ResponseWriter, r *http.Request) {
@@ -116,6 +339,16 @@ func NewWeb(l *Logic, ts *TempSensors, v *viper.Viper) *webHandler {
 	wh.ctlRoute = mux.NewRouter()
 	wh.ctlRoute.HandleFunc("/", wh.page)
 	wh.ctlRoute.HandleFunc("/control", wh.handleControl)
+	wh.ctlRoute.HandleFunc("/status", wh.status).Methods("GET")
+	wh.ctlRoute.HandleFunc("/energy", wh.energy).Methods("GET")
+	wh.ctlRoute.HandleFunc("/history", wh.history).Methods("GET")
+	wh.ctlRoute.HandleFunc("/alerts", wh.alerts).Methods("GET")
+	wh.ctlRoute.HandleFunc("/exercises", wh.exercises).Methods("GET")
+	wh.ctlRoute.HandleFunc("/inputs", wh.inputs).Methods("GET")
+	wh.ctlRoute.HandleFunc("/mode", wh.mode).Methods("GET", "PUT")
+	wh.ctlRoute.HandleFunc("/presence", wh.presence).Methods("GET", "PUT", "POST")
+	wh.ctlRoute.HandleFunc("/rules", wh.rules).Methods("GET")
+	wh.ctlRoute.HandleFunc("/event", wh.event).Methods("POST", "PUT")
 
 	wh.metricsRoute = mux.NewRouter()
 	wh.metricsRoute.Handle("/metrics", promhttp.Handler())
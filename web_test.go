@@ -0,0 +1,217 @@
+// Copyright 2019 Weston Schmidt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newWebLogic returns a web handler for a Logic with a heater loop pump
+// that waits 5 minutes between runs and a downstairs pump.  The post page
+// lists the results one per line.
+func newWebLogic(t *testing.T, dir string) (*webHandler, *Logic) {
+	clock := NewFakeClock(time.Date(2019, 1, 7, 8, 0, 0, 0, time.UTC))
+	l := newTestLogic(clock, LogicOpts{}, nil)
+	namespace := testNamespace("testing_web")
+	l.heaterLoopPump = l.newOutput(OnOffThingOpts{
+		Namespace:           namespace,
+		Name:                "wb_loop",
+		BlackoutPeriod:      time.Minute * 5,
+		QueueDuringBlackout: true,
+	}, 1)
+	l.downstairsHeatPump = l.newOutput(OnOffThingOpts{Namespace: namespace, Name: "wb_zone"}, 2)
+
+	wh := NewWeb(l, nil, nil)
+	wh.post_page = filepath.Join(dir, "post.html")
+	if err := ioutil.WriteFile(wh.post_page, []byte("{{range .}}{{.}}\n{{end}}"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	return wh, l
+}
+
+func serve(wh *webHandler, method, url, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	wh.ctlRoute.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return rec
+}
+
+func TestWebMode(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "web")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	wh, l := newWebLogic(t, dir)
+
+	rec := serve(wh, "GET", "/mode", "")
+	assert.Equal(200, rec.Code)
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(`{"mode":"home","start":"0001-01-01T00:00:00Z","end":"0001-01-01T00:00:00Z"}`, rec.Body.String())
+
+	rec = serve(wh, "PUT", "/mode", `{"mode":"away"}`)
+	assert.Equal(200, rec.Code)
+	var p ModePeriod
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &p))
+	assert.Equal(Away, p.Mode)
+	assert.Equal(Away, l.Mode().Mode)
+
+	// Bad requests change nothing.
+	rec = serve(wh, "PUT", "/mode", `{"mode":"gone"}`)
+	assert.Equal(400, rec.Code)
+	rec = serve(wh, "PUT", "/mode", `{"mode":"vacation","start":"2019-01-08T00:00:00Z","end":"2019-01-07T00:00:00Z"}`)
+	assert.Equal(400, rec.Code)
+	assert.Equal(Away, l.Mode().Mode)
+
+	// And from the control form.
+	rec = serve(wh, "GET", "/control?house_mode=home", "")
+	assert.Equal("House mode: applied\n", rec.Body.String())
+	assert.Equal(Home, l.Mode().Mode)
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+}
+
+func TestWebPresence(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "web")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	wh, l := newWebLogic(t, dir)
+
+	rec := serve(wh, "GET", "/presence", "")
+	assert.Equal(200, rec.Code)
+	assert.Equal("[]", rec.Body.String())
+
+	rec = serve(wh, "POST", "/presence?name=alex&home=true", "")
+	assert.Equal(200, rec.Code)
+	var list []PersonStatus
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &list))
+	if assert.Len(list, 1) {
+		assert.Equal("alex", list[0].Name)
+		assert.True(list[0].Home)
+	}
+
+	// As sent by a webhook.
+	rec = serve(wh, "PUT", "/presence", `{"name":"alex","home":false}`)
+	assert.Equal(200, rec.Code)
+	list = nil
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &list))
+	if assert.Len(list, 1) {
+		assert.False(list[0].Home)
+	}
+
+	rec = serve(wh, "POST", "/presence", `{"home":true}`)
+	assert.Equal(400, rec.Code)
+	rec = serve(wh, "POST", "/presence?name=alex&home=maybe", "")
+	assert.Equal(400, rec.Code)
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+}
+
+func TestWebOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "web")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	wh, l := newWebLogic(t, dir)
+
+	rec := serve(wh, "GET", "/control?override_output=wb_zone&override_mode=off&override_duration=1h", "")
+	assert.Equal(200, rec.Code)
+	assert.Equal("Override wb_zone: applied\n", rec.Body.String())
+	l.relayMutex.Lock()
+	assert.Equal(ForcedOff, l.outputs["wb_zone"].override.Mode)
+	assert.Equal(l.clock.Now().Add(time.Hour), l.outputs["wb_zone"].override.Until)
+	l.relayMutex.Unlock()
+
+	rec = serve(wh, "GET", "/control?override_output=wb_zone&override_mode=sideways", "")
+	assert.Contains(rec.Body.String(), "Override wb_zone: rejected (Invalid override mode")
+	rec = serve(wh, "GET", "/control?override_output=wb_attic&override_mode=on", "")
+	assert.Contains(rec.Body.String(), "Override wb_attic: rejected (Unknown output")
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+}
+
+func TestWebEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "web")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	wh, l := newWebLogic(t, dir)
+
+	file := filepath.Join(dir, "rules.yaml")
+	l.opts.Rules = RuleOpts{File: file}
+	writeRules(t, file, `
+rules:
+  - name: bath
+    when:
+      event: bath
+    do:
+      - on: wb_zone
+        for: 10m
+`, l.clock.Now())
+	l.loadRules(l.clock.Now())
+
+	rec := serve(wh, "POST", "/event?name=bath", "")
+	assert.Equal(200, rec.Code)
+	assert.Equal(`{"fired":1}`, rec.Body.String())
+	on, _ := l.downstairsHeatPump.State()
+	assert.True(on)
+
+	rec = serve(wh, "POST", "/event?name=shower", "")
+	assert.Equal(`{"fired":0}`, rec.Body.String())
+
+	rec = serve(wh, "POST", "/event", "")
+	assert.Equal(400, rec.Code)
+	rec = serve(wh, "GET", "/event?name=bath", "")
+	assert.Equal(405, rec.Code)
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+}
+
+func TestWebHeatReportsLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "web")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	wh, l := newWebLogic(t, dir)
+
+	rec := serve(wh, "GET", "/control?heat_goal_state=run&heat_down_duration=10m", "")
+	assert.Equal("Downstairs: applied, on until 8:10AM\n", rec.Body.String())
+
+	// The zone pump runs but the loop has to wait.
+	l.heaterLoopPump.Off()
+	l.downstairsHeatPump.Off()
+	rec = serve(wh, "GET", "/control?heat_goal_state=run&heat_down_duration=10m", "")
+	assert.Equal("Downstairs: deferred, on from 8:05AM until 8:10AM (heater loop blackout period until 8:05AM)\n", rec.Body.String())
+
+	l.heaterLoopPump.Shutdown()
+	l.downstairsHeatPump.Shutdown()
+}